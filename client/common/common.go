@@ -14,16 +14,21 @@ const (
 
 	Version          = 70001
 	DefaultUserAgent = "/Gocoin:" + lib.Version + "/"
-	Services         = uint64(0x00000001)
+
+	NODE_NETWORK         = uint64(0x00000001)
+	NODE_NETWORK_LIMITED = uint64(0x00000400) // BIP-159: only the last 288 blocks can be served
+
+	MinPruneMB = 550
+
+	MaxBlockSegmentMB = 4095 // block positions within a segment file are stored as uint32
 
 	MaxCachedBlocks = 600
 )
 
 var (
-	BlockChain   *chain.Chain
-	GenesisBlock *btc.Uint256
-	Magic        [4]byte
-	Testnet      bool
+	BlockChain *chain.Chain
+	Params     *btc.ChainParams // network we are on
+	Services   = NODE_NETWORK   // NODE_NETWORK_LIMITED instead, if we prune blocks
 
 	Last struct {
 		sync.Mutex // use it for writing and reading from non-chain thread
@@ -1,9 +1,11 @@
 package common
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/wchh/gocoin/lib/btc"
 	"github.com/wchh/gocoin/lib/chain"
 	"github.com/wchh/gocoin/lib/others/sys"
 	"io/ioutil"
@@ -17,15 +19,24 @@ import (
 
 var (
 	FLAG struct { // Command line only options
-		Rescan bool
+		Rescan   bool
+		LoadUtxo string // UTXO snapshot file to rebuild the unspent DB from
 	}
 
 	CFG struct { // Options that can come from either command line or common file
-		Testnet     bool
-		ConnectOnly string
-		Datadir     string
-		Walletdir   string
-		TextUI      struct {
+		Testnet          bool
+		Regtest          bool
+		Signet           bool
+		SignetChallenge  string // hex encoded challenge script of a custom signet (empty for the default one)
+		ConnectOnly      string
+		Datadir          string
+		Walletdir        string
+		Prune            uint   // keep the block database within this many MB (0 for no pruning)
+		BlockSegmentMB   uint   // size of the block database's segment files
+		TxIndex          bool   // index all the transactions, to find them by txid
+		AddrIndex        bool   // index all the outputs, to show history and balance of any address
+		UtxoSnapshotHash string // expected hash of a UTXO snapshot loaded with -loadutxo
+		TextUI           struct {
 			Enabled bool
 		}
 		WebUI struct {
@@ -46,8 +57,11 @@ var (
 		TXPool struct {
 			Enabled        bool // Global on/off swicth
 			AllowMemInputs bool
+			AllowRBF       bool // Let txs signalling BIP-125 get replaced by ones paying more
 			FeePerByte     uint64
 			MaxTxSize      uint32
+			MaxSizeMB      uint32 // 0 - no limit
+			SaveOnDisk     bool   // Save the pool on exit and restore it on the next start
 			MinVoutValue   uint64
 			// If something is 1KB big, it expires after this many minutes.
 			// Otherwise expiration time will be proportionally different.
@@ -101,8 +115,11 @@ func InitConfig() {
 
 	CFG.TXPool.Enabled = true
 	CFG.TXPool.AllowMemInputs = true
+	CFG.TXPool.AllowRBF = true
 	CFG.TXPool.FeePerByte = 1
 	CFG.TXPool.MaxTxSize = 10e3
+	CFG.TXPool.MaxSizeMB = 100
+	CFG.TXPool.SaveOnDisk = true
 	CFG.TXPool.MinVoutValue = 0
 	CFG.TXPool.TxExpireMinPerKB = 180
 	CFG.TXPool.TxExpireMaxHours = 12
@@ -115,6 +132,8 @@ func InitConfig() {
 	CFG.Memory.GCPercTrshold = 100 // 100%
 	CFG.Memory.MaxCachedBlocks = 500
 
+	CFG.BlockSegmentMB = 128
+
 	CFG.MiningStatHours = 24
 	CFG.HashrateHours = 6
 	CFG.UserAgent = DefaultUserAgent
@@ -134,10 +153,17 @@ func InitConfig() {
 	}
 
 	flag.BoolVar(&FLAG.Rescan, "r", false, "Rebuild the unspent DB (fixes 'Unknown input TxID' errors)")
+	flag.StringVar(&FLAG.LoadUtxo, "loadutxo", "", "Rebuild the unspent DB from the given snapshot file (must match UtxoSnapshotHash)")
 	flag.BoolVar(&CFG.Testnet, "t", CFG.Testnet, "Use Testnet3")
+	flag.BoolVar(&CFG.Regtest, "regtest", CFG.Regtest, "Use Regtest (private chain, with blocks generated by the \"generate\" command)")
+	flag.BoolVar(&CFG.Signet, "signet", CFG.Signet, "Use Signet")
+	flag.StringVar(&CFG.SignetChallenge, "signetchallenge", CFG.SignetChallenge, "Hex encoded block challenge script of a custom signet")
 	flag.StringVar(&CFG.ConnectOnly, "c", CFG.ConnectOnly, "Connect only to this host and nowhere else")
 	flag.BoolVar(&CFG.Net.ListenTCP, "l", CFG.Net.ListenTCP, "Listen for incoming TCP connections (on default port)")
 	flag.StringVar(&CFG.Datadir, "d", CFG.Datadir, "Specify Gocoin's database root folder")
+	flag.UintVar(&CFG.Prune, "prune", CFG.Prune, fmt.Sprint("Delete old blocks to keep their database within this many MB (0 - keep all, minimum ", MinPruneMB, ")"))
+	flag.BoolVar(&CFG.TxIndex, "txindex", CFG.TxIndex, "Maintain the index of all the transactions (not possible with -prune)")
+	flag.BoolVar(&CFG.AddrIndex, "addrindex", CFG.AddrIndex, "Maintain the history of all the addresses (not possible with -prune)")
 	flag.UintVar(&CFG.Net.MaxUpKBps, "ul", CFG.Net.MaxUpKBps, "Upload limit in KB/s (0 for no limit)")
 	flag.UintVar(&CFG.Net.MaxDownKBps, "dl", CFG.Net.MaxDownKBps, "Download limit in KB/s (0 for no limit)")
 	flag.StringVar(&CFG.WebUI.Interface, "webui", CFG.WebUI.Interface, "Serve WebUI from the given interface")
@@ -160,15 +186,36 @@ func InitConfig() {
 	}
 	flag.Parse()
 
+	if CFG.Prune != 0 && CFG.Prune < MinPruneMB {
+		CFG.Prune = MinPruneMB
+	}
+
+	if _, e := hex.DecodeString(CFG.SignetChallenge); e != nil {
+		println("Error in", ConfigFile, "SignetChallenge:", e.Error())
+		os.Exit(1)
+	}
+
 	Reset()
 }
 
-func DataSubdir() string {
-	if CFG.Testnet {
-		return "tstnet"
-	} else {
-		return "btcnet"
+// Returns parameters of the network selected by the config
+// (the client only switches to it after a restart)
+func ConfigParams() *btc.ChainParams {
+	if CFG.Regtest {
+		return &btc.RegTestParams
+	}
+	if CFG.Signet {
+		if CFG.SignetChallenge != "" {
+			chal, _ := hex.DecodeString(CFG.SignetChallenge)
+			return btc.NewSignetParams(chal)
+		}
+		return &btc.SigNetParams
 	}
+	return btc.GetChainParams(CFG.Testnet)
+}
+
+func DataSubdir() string {
+	return ConfigParams().DataSubdir
 }
 
 func SaveConfig() bool {
@@ -188,14 +235,16 @@ func Reset() {
 	MaxExpireTime = time.Duration(CFG.TXPool.TxExpireMaxHours) * time.Hour
 	ExpirePerKB = time.Duration(CFG.TXPool.TxExpireMinPerKB) * time.Minute
 	chain.MaxCachedBlocks = CFG.Memory.MaxCachedBlocks
+	if CFG.BlockSegmentMB > MaxBlockSegmentMB {
+		CFG.BlockSegmentMB = MaxBlockSegmentMB
+	}
+	if CFG.BlockSegmentMB > 0 {
+		chain.BlockSegmentSize = uint64(CFG.BlockSegmentMB) << 20
+	}
 	if CFG.Net.TCPPort != 0 {
 		DefaultTcpPort = uint16(CFG.Net.TCPPort)
 	} else {
-		if CFG.Testnet {
-			DefaultTcpPort = 18333
-		} else {
-			DefaultTcpPort = 8333
-		}
+		DefaultTcpPort = ConfigParams().DefaultPort
 	}
 
 	ips := strings.Split(CFG.WebUI.AllowedIP, ",")
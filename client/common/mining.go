@@ -28,7 +28,7 @@ func TxMiner(cbtx *btc.Tx) (string, int) {
 		}
 	}
 
-	adr := btc.NewAddrFromPkScript(cbtx.TxOut[0].Pk_script, Testnet)
+	adr := btc.NewAddrFromPkScript(cbtx.TxOut[0].Pk_script, Params)
 	if adr != nil {
 		return adr.String(), -1
 	}
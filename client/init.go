@@ -18,22 +18,16 @@ import (
 )
 
 func host_init() {
-	var e error
 	BtcRootDir := sys.BitcoinHome()
 	common.GocoinHomeDir = common.CFG.Datadir + string(os.PathSeparator)
 
-	common.Testnet = common.CFG.Testnet // So chaging this value would will only affect the behaviour after restart
-	if common.CFG.Testnet {             // testnet3
-		common.GenesisBlock = btc.NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
-		common.Magic = [4]byte{0x0B, 0x11, 0x09, 0x07}
-		common.GocoinHomeDir += common.DataSubdir() + string(os.PathSeparator)
-		BtcRootDir += "testnet3" + string(os.PathSeparator)
+	common.Params = common.ConfigParams() // So chaging the config will only affect the behaviour after restart
+	common.GocoinHomeDir += common.Params.DataSubdir + string(os.PathSeparator)
+	if common.Params != &btc.MainNetParams { // testnet3, regtest or signet
+		BtcRootDir += common.Params.Name + string(os.PathSeparator)
 		network.AlertPubKey, _ = hex.DecodeString("04302390343f91cc401d56d68b123028bf52e5fca1939df127f63c6467cdf9c8e2c14b61104cf817d0b780da337893ecc4aaff1309e536162dabbdb45200ca2b0a")
 		common.MaxPeersNeeded = 100
 	} else {
-		common.GenesisBlock = btc.NewUint256FromString("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
-		common.Magic = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
-		common.GocoinHomeDir += common.DataSubdir() + string(os.PathSeparator)
 		network.AlertPubKey, _ = hex.DecodeString("04fc9702847840aaf195de8442ebecedf5b095cdbb9bc716bda9110971b28a49e0ead8564ff0db22209e0374782c093bb899692d524e9d6a6956e7c5ecbcd68284")
 		common.MaxPeersNeeded = 1000
 	}
@@ -42,11 +36,10 @@ func host_init() {
 	os.MkdirAll(common.GocoinHomeDir, 0770)
 	sys.LockDatabaseDir(common.GocoinHomeDir)
 
-	fi, e := os.Stat(common.GocoinHomeDir + "blockchain.dat")
-	if e != nil {
+	if !chain.BlockDBExists(common.GocoinHomeDir) {
 		os.RemoveAll(common.GocoinHomeDir)
 		fmt.Println("You seem to be running Gocoin for the fist time on this PC")
-		fi, e = os.Stat(BtcRootDir + "blocks/blk00000.dat")
+		fi, e := os.Stat(BtcRootDir + "blocks/blk00000.dat")
 		if e == nil && fi.Size() > 1024*1024 {
 			fmt.Println("There is a database from Satoshi client on your disk...")
 			if textui.AskYesNo("Do you want to import this database into Gocoin?") {
@@ -60,7 +53,7 @@ func host_init() {
 	os.MkdirAll(common.CFG.Walletdir+string(os.PathSeparator)+"stealth", 0770)
 	default_wallet_fn := common.CFG.Walletdir + string(os.PathSeparator) + wallet.DefaultFileName
 	println("default_wallet_fn", default_wallet_fn)
-	fi, _ = os.Stat(default_wallet_fn)
+	fi, _ := os.Stat(default_wallet_fn)
 	if fi == nil || fi.IsDir() {
 		fmt.Println(default_wallet_fn, "not found")
 
@@ -97,11 +90,51 @@ func host_init() {
 		}
 	}()
 
+	if common.CFG.Prune != 0 {
+		if common.FLAG.Rescan {
+			fmt.Println("Rebuilding the unspent database (-r) is not possible with pruned blocks")
+			sys.UnlockDatabaseDir()
+			os.Exit(1)
+		}
+		if common.CFG.TxIndex {
+			fmt.Println("The transaction index (-txindex) is not possible with pruned blocks")
+			sys.UnlockDatabaseDir()
+			os.Exit(1)
+		}
+		if common.CFG.AddrIndex {
+			fmt.Println("The address index (-addrindex) is not possible with pruned blocks")
+			sys.UnlockDatabaseDir()
+			os.Exit(1)
+		}
+		common.Services = common.NODE_NETWORK_LIMITED
+		fmt.Println("Pruning mode: blocks' data will be kept within", common.CFG.Prune, "MB")
+	}
+
 	ext := &chain.NewChanOpts{NotifyTxAdd: wallet.TxNotifyAdd,
-		NotifyTxDel: wallet.TxNotifyDel, LoadWalk: wallet.NewUTXO}
+		NotifyTxDel: wallet.TxNotifyDel, LoadWalk: wallet.NewUTXO,
+		PruneTarget: uint64(common.CFG.Prune) << 20, TxIndex: common.CFG.TxIndex,
+		AddrIndex: common.CFG.AddrIndex}
+
+	if common.FLAG.LoadUtxo != "" {
+		if common.FLAG.Rescan {
+			fmt.Println("Rebuilding the unspent database (-r) is not possible together with -loadutxo")
+			sys.UnlockDatabaseDir()
+			os.Exit(1)
+		}
+		ext.UtxoSnapshot = common.FLAG.LoadUtxo
+		if common.CFG.UtxoSnapshotHash != "" {
+			h := btc.NewUint256FromString(common.CFG.UtxoSnapshotHash)
+			if h == nil {
+				fmt.Println("Incorrect UtxoSnapshotHash:", common.CFG.UtxoSnapshotHash)
+				sys.UnlockDatabaseDir()
+				os.Exit(1)
+			}
+			ext.UtxoSnapshotHash = h
+		}
+	}
 
 	sta := time.Now().UnixNano()
-	common.BlockChain = chain.NewChainExt(common.GocoinHomeDir, common.GenesisBlock, common.FLAG.Rescan, ext)
+	common.BlockChain = chain.NewChainExt(common.GocoinHomeDir, common.Params, common.FLAG.Rescan, ext)
 	sto := time.Now().UnixNano()
 	if chain.AbortNow {
 		fmt.Printf("Blockchain opening aborted after %.3f seconds\n", float64(sto-sta)/1e9)
@@ -109,6 +142,10 @@ func host_init() {
 		sys.UnlockDatabaseDir()
 		os.Exit(1)
 	}
+	if common.BlockChain.Blocks.PrunedCount() > 0 {
+		// i.e. the blocks below a loaded UTXO snapshot are known only from their headers
+		common.Services = common.NODE_NETWORK_LIMITED
+	}
 	wallet.ChainInitDone()
 	al, sy := sys.MemUsed()
 	fmt.Printf("Blockchain open in %.3f seconds.  %d + %d MB of RAM used (%d)\n",
@@ -140,8 +177,8 @@ func stat(totnsec, pernsec int64, totbytes, perbytes uint64, height uint32) {
 func import_blockchain(dir string) {
 	trust := !textui.AskYesNo("Do you want to verify scripts while importing (will be slow)?")
 
-	BlockDatabase := blockdb.NewBlockDB(dir, common.Magic)
-	chain := chain.NewChain(common.GocoinHomeDir, common.GenesisBlock, false)
+	BlockDatabase := blockdb.NewBlockDB(dir, common.Params.Magic)
+	chain := chain.NewChain(common.GocoinHomeDir, common.Params, false)
 
 	var bl *btc.Block
 	var er error
@@ -11,7 +11,6 @@ import (
 	"github.com/wchh/gocoin/client/wallet"
 	"github.com/wchh/gocoin/lib"
 	"github.com/wchh/gocoin/lib/btc"
-	"github.com/wchh/gocoin/lib/chain"
 	"github.com/wchh/gocoin/lib/others/peersdb"
 	"github.com/wchh/gocoin/lib/others/sys"
 	"github.com/wchh/gocoin/lib/qdb"
@@ -48,8 +47,9 @@ func LocalAcceptBlock(bl *btc.Block, from *network.OneConnection) (e error) {
 		network.ReceivedBlocks[bl.Hash.BIdx()].TmAccept = time.Now().Sub(sta)
 		network.MutexRcv.Unlock()
 
+		height := common.BlockChain.BlockIndex[bl.Hash.BIdx()].Height
 		for i := 1; i < len(bl.Txs); i++ {
-			network.TxMined(bl.Txs[i])
+			network.TxMined(bl.Txs[i], height)
 			/* dupa
 			if msg:=contains_message(bl.Txs[i]); msg!=nil {
 				for xx:=range msg {
@@ -178,6 +178,18 @@ func HandleNetBlock(newbl *network.BlockRcvd) {
 	}
 }
 
+// Called from the blockchain thread, for blocks generated locally (in regtest mode)
+func HandleLocalBlock(bl *btc.Block) (e error) {
+	e, _, _ = common.BlockChain.CheckBlock(bl)
+	if e != nil {
+		return
+	}
+	network.MutexRcv.Lock()
+	network.ReceivedBlocks[bl.Hash.BIdx()] = &network.OneReceivedBlock{Time: time.Now()}
+	network.MutexRcv.Unlock()
+	return LocalAcceptBlock(bl, nil)
+}
+
 func defrag_db() {
 	if (usif.DefragBlocksDB & 1) != 0 {
 		qdb.SetDefragPercent(1)
@@ -192,37 +204,30 @@ func defrag_db() {
 	}
 
 	if (usif.DefragBlocksDB & 2) != 0 {
-		fmt.Println("Creating empty database in", common.GocoinHomeDir+"defrag", "...")
-		os.RemoveAll(common.GocoinHomeDir + "defrag")
-		defragdb := chain.NewBlockDB(common.GocoinHomeDir + "defrag")
-		fmt.Println("Defragmenting the database...")
-		blk := common.BlockChain.BlockTreeRoot
-		for {
-			blk = blk.FindPathTo(common.BlockChain.BlockTreeEnd)
-			if blk == nil {
-				fmt.Println("Database defragmenting finished successfully")
-				fmt.Println("To use the new DB, move the two new files to a parent directory and restart the client")
-				break
+		ch := common.BlockChain
+		// Blocks that are not in the main chain, and no longer can get into it, are dropped
+		keep := func(h *btc.Uint256) bool {
+			ch.BlockIndexAccess.Lock()
+			defer ch.BlockIndexAccess.Unlock()
+			node := ch.BlockIndex[h.BIdx()]
+			if node == nil || node.Height > ch.BlockTreeEnd.Height {
+				return true
 			}
-			if (blk.Height & 0xff) == 0 {
-				fmt.Printf("%d / %d blocks written (%d%%)\r", blk.Height, common.BlockChain.BlockTreeEnd.Height,
-					100*blk.Height/common.BlockChain.BlockTreeEnd.Height)
-			}
-			bl, trusted, er := common.BlockChain.Blocks.BlockGet(blk.BlockHash)
-			if er != nil {
-				fmt.Println("FATAL ERROR during BlockGet:", er.Error())
-				break
-			}
-			nbl, er := btc.NewBlock(bl)
+			return ch.BlockTreeEnd.FindAncestor(node.Height) == node
+		}
+		fmt.Println("Defragmenting the blocks database...")
+		var saved uint64
+		segs := ch.Blocks.Segments()
+		for i, n := range segs {
+			fmt.Printf("%d / %d segment files done\r", i, len(segs))
+			sv, er := ch.Blocks.DefragSegment(n, keep)
 			if er != nil {
-				fmt.Println("FATAL ERROR during NewBlock:", er.Error())
+				fmt.Println("\nERROR while defragmenting segment", n, ":", er.Error())
 				break
 			}
-			nbl.Trusted = trusted
-			defragdb.BlockAdd(blk.Height, nbl)
+			saved += sv
 		}
-		defragdb.Sync()
-		defragdb.Close()
+		fmt.Println("Database defragmenting finished.", saved>>20, "MB saved")
 	}
 }
 
@@ -260,7 +265,8 @@ func main() {
 	txPoolTick := time.Tick(time.Minute)
 	netTick := time.Tick(time.Second)
 
-	peersdb.Testnet = common.Testnet
+	peersdb.Params = common.Params
+	usif.ProcessLocalBlock = HandleLocalBlock
 	peersdb.ConnectOnly = common.CFG.ConnectOnly
 	peersdb.Services = common.Services
 	peersdb.InitPeers(common.GocoinHomeDir)
@@ -275,6 +281,8 @@ func main() {
 		network.ReceivedBlocks[k] = &network.OneReceivedBlock{Time: time.Unix(int64(v.Timestamp()), 0)}
 	}
 
+	network.MempoolLoad()
+
 	if common.CFG.TextUI.Enabled {
 		go textui.MainThread()
 	}
@@ -345,6 +353,7 @@ func main() {
 	}
 
 	network.NetCloseAll()
+	network.MempoolSave()
 	peersdb.ClosePeerDB()
 
 	if usif.DefragBlocksDB != 0 {
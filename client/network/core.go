@@ -182,7 +182,7 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 	c.LastBtsSent = uint32(len(pl))
 
 	binary.LittleEndian.PutUint32(sbuf[0:4], common.Version)
-	copy(sbuf[0:4], common.Magic[:])
+	copy(sbuf[0:4], common.Params.Magic[:])
 	copy(sbuf[4:16], cmd)
 	binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
 
@@ -272,7 +272,7 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 			c.HandleError(e)
 			return nil
 		}
-		if c.recv.hdr_len>=4 && !bytes.Equal(c.recv.hdr[:4], common.Magic[:]) {
+		if c.recv.hdr_len>=4 && !bytes.Equal(c.recv.hdr[:4], common.Params.Magic[:]) {
 			c.Mutex.Unlock()
 			if common.DebugLevel >0 {
 				println("FetchMessage: Proto out of sync")
@@ -41,6 +41,8 @@ func (c *OneConnection) ProcessGetData(pl []byte) {
 			if er == nil {
 				c.SendRawMsg("block", bl)
 			} else {
+				// Unknown block, or its data has already been pruned
+				common.CountSafe("GetdataNoBlock")
 				notfound = append(notfound, h[:]...)
 			}
 		} else if typ == 1 {
@@ -0,0 +1,187 @@
+package network
+
+import (
+	"github.com/wchh/gocoin/client/common"
+	"github.com/wchh/gocoin/lib/btc"
+	"math"
+	"sort"
+)
+
+/*
+	Fee estimator: for each tx that enters the memory pool, we note the block height and its fee rate.
+	Once the tx gets mined, we know how many blocks it has waited. The stats are kept per fee rate
+	bucket, for each number of blocks (target) up to FeeEstMaxBlocks: how many txs got confirmed
+	within the target and how many did not (still waiting, or removed from the pool unmined).
+	With each new block the old data decay, so the recent blocks matter the most.
+	Txs with unconfirmed inputs are not tracked, as their fee rate is not what gets them mined.
+*/
+
+const (
+	FeeEstMaxBlocks = 48
+	FeeEstSuccess   = 0.85 // required fraction of txs that got confirmed within the target
+
+	feeEstMinSPKB    = 1000 // the lowest bucket - 1 satoshi per vbyte
+	feeEstMaxSPKB    = 1e7
+	feeEstSpacing    = 1.1   // ratio between boundaries of the subsequent buckets
+	feeEstDecay      = 0.998 // per block (half-life of about 350 blocks)
+	feeEstMinSamples = 0.1 / (1 - feeEstDecay)
+)
+
+type feeEstTx struct {
+	height uint32
+	bucket int
+	spkb   uint64
+}
+
+var (
+	// Txs from the pool that we keep track of
+	feeEstTracked map[[btc.Uint256IdxLen]byte]feeEstTx = make(map[[btc.Uint256IdxLen]byte]feeEstTx)
+
+	feeEstBuckets []float64                  // lower boundaries, in satoshis per 1000 vbytes
+	feeEstOK      [FeeEstMaxBlocks][]float64 // [blocks-1][bucket] - txs confirmed within so many blocks
+	feeEstFail    [FeeEstMaxBlocks][]float64 // [blocks-1][bucket] - txs not confirmed within so many blocks
+	feeEstSum     []float64                  // sum of fee rates of the confirmed txs (for the average)
+	feeEstCnt     []float64                  // number of the confirmed txs
+	feeEstHeight  uint32                     // the stats are decayed up to this block
+)
+
+func init() {
+	for b := float64(feeEstMinSPKB); b <= feeEstMaxSPKB; b *= feeEstSpacing {
+		feeEstBuckets = append(feeEstBuckets, b)
+	}
+	for i := range feeEstOK {
+		feeEstOK[i] = make([]float64, len(feeEstBuckets))
+		feeEstFail[i] = make([]float64, len(feeEstBuckets))
+	}
+	feeEstSum = make([]float64, len(feeEstBuckets))
+	feeEstCnt = make([]float64, len(feeEstBuckets))
+}
+
+// Returns the bucket for the given fee rate, or -1 if it is below the lowest one
+func feeEstBucket(spkb uint64) int {
+	return sort.SearchFloat64s(feeEstBuckets, float64(spkb)+0.5) - 1
+}
+
+func lastBlockHeight() (h uint32) {
+	common.Last.Mutex.Lock()
+	h = common.Last.Block.Height
+	common.Last.Mutex.Unlock()
+	return
+}
+
+// Applies the decay for the blocks that came since the last update
+func feeEstDecayTo(height uint32) {
+	if height <= feeEstHeight {
+		return
+	}
+	if feeEstHeight != 0 {
+		f := math.Pow(feeEstDecay, float64(height-feeEstHeight))
+		for b := range feeEstBuckets {
+			for i := range feeEstOK {
+				feeEstOK[i][b] *= f
+				feeEstFail[i][b] *= f
+			}
+			feeEstSum[b] *= f
+			feeEstCnt[b] *= f
+		}
+	}
+	feeEstHeight = height
+}
+
+// Starts tracking the tx that has just entered the pool
+func feeEstSeen(rec *OneTxToSend) {
+	if len(rec.parents) > 0 {
+		return
+	}
+	spkb := rec.Fee * 1000 / uint64(rec.vsize)
+	if b := feeEstBucket(spkb); b >= 0 {
+		feeEstTracked[rec.Hash.BIdx()] = feeEstTx{height: lastBlockHeight(), bucket: b, spkb: spkb}
+	}
+}
+
+// Records the tx that got mined in a block with the given height
+func feeEstMined(rec *OneTxToSend, height uint32) {
+	t, ok := feeEstTracked[rec.Hash.BIdx()]
+	if !ok {
+		return
+	}
+	delete(feeEstTracked, rec.Hash.BIdx())
+	feeEstDecayTo(height)
+	blocks := 1
+	if height > t.height {
+		blocks = int(height - t.height)
+	}
+	for i := range feeEstOK {
+		if i+1 >= blocks {
+			feeEstOK[i][t.bucket]++
+		} else {
+			feeEstFail[i][t.bucket]++
+		}
+	}
+	feeEstSum[t.bucket] += float64(t.spkb)
+	feeEstCnt[t.bucket]++
+	common.CountSafe("FeeEstMined")
+}
+
+// Records the tx that has been removed from the pool, without getting mined
+func feeEstRemoved(rec *OneTxToSend) {
+	t, ok := feeEstTracked[rec.Hash.BIdx()]
+	if !ok {
+		return
+	}
+	delete(feeEstTracked, rec.Hash.BIdx())
+	height := lastBlockHeight()
+	feeEstDecayTo(height)
+	// We only know that it has not been confirmed within the blocks it has waited
+	for i := 0; i < len(feeEstFail) && height > t.height+uint32(i+1); i++ {
+		feeEstFail[i][t.bucket]++
+	}
+}
+
+// Returns the fee rate (satoshis per 1000 vbytes) needed for a tx to get confirmed
+// within the given number of blocks, or zero if there is not enough data yet.
+// Make sure to call it with locked TxMutex.
+func EstimateFee(blocks int) (spkb uint64) {
+	if blocks < 1 {
+		blocks = 1
+	} else if blocks > FeeEstMaxBlocks {
+		blocks = FeeEstMaxBlocks
+	}
+
+	// Txs from the pool that have already waited longer than the target count as failed
+	height := lastBlockHeight()
+	waiting := make([]float64, len(feeEstBuckets))
+	for _, t := range feeEstTracked {
+		if height > t.height && int(height-t.height) > blocks {
+			waiting[t.bucket]++
+		}
+	}
+
+	// Go from the highest fee rates down, grouping the buckets until there are enough samples.
+	// The result is the average fee rate of the lowest group that still gets confirmed in time.
+	var ok, tot, sum, cnt float64
+	for b := len(feeEstBuckets) - 1; b >= 0; b-- {
+		ok += feeEstOK[blocks-1][b]
+		tot += feeEstOK[blocks-1][b] + feeEstFail[blocks-1][b] + waiting[b]
+		sum += feeEstSum[b]
+		cnt += feeEstCnt[b]
+		if tot < feeEstMinSamples {
+			continue
+		}
+		if ok/tot < FeeEstSuccess {
+			break
+		}
+		if cnt > 0 {
+			spkb = uint64(math.Ceil(sum / cnt))
+		} else {
+			spkb = uint64(math.Ceil(feeEstBuckets[b]))
+		}
+		ok, tot, sum, cnt = 0, 0, 0, 0
+	}
+	if spkb != 0 {
+		if min := MinFeeSPKB(); spkb < min {
+			spkb = min
+		}
+	}
+	return
+}
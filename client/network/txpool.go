@@ -28,6 +28,14 @@ const (
 	TX_REJECTED_SCRIPT_FAIL  = 206
 	TX_REJECTED_BAD_INPUT    = 207
 	TX_REJECTED_NOT_MINED    = 208
+	TX_REJECTED_SIGOPS       = 209
+	TX_REJECTED_POOL_FULL    = 210
+	TX_REJECTED_PACKAGE      = 211
+	TX_REJECTED_RBF          = 212
+	TX_REJECTED_NOT_FINAL    = 213
+
+	// Relay policy: no single tx may take more than a fifth of the block's sigops
+	MAX_STANDARD_TX_SIGOPS_COST = btc.MAX_BLOCK_SIGOPS_COST / 5
 )
 
 var (
@@ -58,8 +66,17 @@ type OneTxToSend struct {
 	Own                 byte     // 0-not own, 1-own and OK, 2-own but with UNKNOWN input
 	Spent               []uint64 // Which records in SpentOutputs this TX added
 	Volume, Fee, Minout uint64
+	SigopsCost          int // as counted for the block's limit (BIP-141)
 	*btc.Tx
-	Blocked byte // if non-zero, it gives you the reason why this tx nas not been routed
+	Blocked byte   // if non-zero, it gives you the reason why this tx nas not been routed
+	spkb    uint64 // fee per 1000 vbytes (see TxsByFeeRate)
+
+	// Totals for the tx with its in-pool ancestors / descendants (see txpool_pkg.go)
+	AncestorCnt, DescendantCnt   int
+	AncestorSize, DescendantSize int // in vbytes
+	AncestorFee, DescendantFee   uint64
+	vsize                        int
+	parents, children            map[[btc.Uint256IdxLen]byte]*OneTxToSend
 }
 
 type Wait4Input struct {
@@ -129,15 +146,27 @@ func RejectTx(id *btc.Uint256, size int, why byte) *OneTxRejected {
 
 // Handle incoming "tx" msg
 func (c *OneConnection) ParseTxNet(pl []byte) {
-	tid := btc.NewSha2Hash(pl)
-	NeedThisTx(tid, func() {
-		// This body is called with a locked TxMutex
-		if uint32(len(pl)) > atomic.LoadUint32(&common.CFG.TXPool.MaxTxSize) {
+	if uint32(len(pl)) > atomic.LoadUint32(&common.CFG.TXPool.MaxTxSize) {
+		// Do not even decode it (for a segwit tx, this hash is not its TxID)
+		tid := btc.NewSha2Hash(pl)
+		NeedThisTx(tid, func() {
 			common.CountSafe("TxRejectedBig")
 			RejectTx(tid, len(pl), TX_REJECTED_TOO_BIG)
-			return
-		}
-		tx, le := btc.NewTx(pl)
+		})
+		return
+	}
+
+	// TxID of a segwit transaction does not cover the witness data, so decode it first
+	tx, le := btc.NewTx(pl)
+	var tid *btc.Uint256
+	if tx != nil {
+		tx.SetHash(pl)
+		tid = tx.Hash
+	} else {
+		tid = btc.NewSha2Hash(pl)
+	}
+	NeedThisTx(tid, func() {
+		// This body is called with a locked TxMutex
 		if tx == nil {
 			RejectTx(tid, len(pl), TX_REJECTED_FORMAT)
 			c.DoS("TxRejectedBroken")
@@ -154,7 +183,13 @@ func (c *OneConnection) ParseTxNet(pl []byte) {
 			return
 		}
 
-		tx.Hash = tid
+		tx.Size = uint32(le)
+		if tx.CheckTransaction() != nil {
+			RejectTx(tid, len(pl), TX_REJECTED_FORMAT)
+			c.DoS("TxRejectedCheck")
+			return
+		}
+
 		select {
 		case NetTxs <- &TxRcvd{conn: c, tx: tx, raw: pl}:
 			TransactionsPending[tid.BIdx()] = true
@@ -195,16 +230,24 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 
 	pos := make([]*btc.TxOut, len(tx.TxIn))
 	spent := make([]uint64, len(tx.TxIn))
+	height := common.BlockChain.BlockTreeEnd.Height + 1 // the next block's
+	inheight := make([]uint32, len(tx.TxIn))
+	conflicts := make(map[[btc.Uint256IdxLen]byte]*OneTxToSend)
 
 	// Check if all the inputs exist in the chain
 	for i := range tx.TxIn {
 		spent[i] = tx.TxIn[i].Input.UIdx()
 
-		if _, ok := SpentOutputs[spent[i]]; ok {
-			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_DOUBLE_SPEND)
-			TxMutex.Unlock()
-			common.CountSafe("TxRejectedDoubleSpnd")
-			return
+		if val, ok := SpentOutputs[spent[i]]; ok {
+			// It may be a replacement - checked below, once we know the fee
+			c := spendingTx(val, &tx.TxIn[i].Input)
+			if c == nil {
+				RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_DOUBLE_SPEND)
+				TxMutex.Unlock()
+				common.CountSafe("TxRejectedDoubleSpnd")
+				return
+			}
+			conflicts[val] = c
 		}
 
 		inptx := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
@@ -216,6 +259,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 				return
 			}
 			pos[i] = txinmem.TxOut[tx.TxIn[i].Input.Vout]
+			inheight[i] = height
 			common.CountSafe("TxInputInMemory")
 			frommem = true
 		} else {
@@ -256,10 +300,23 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 				}
 				return
 			}
+			inheight[i] = pos[i].BlockHeight
 		}
 		totinp += pos[i].Value
 	}
 
+	// Check if it could get into the next block: absolute and relative (BIP-68) lock times
+	final := tx.IsFinal(height, common.BlockChain.BlockTreeEnd.MedianTimePast())
+	for i := 0; final && i < len(tx.TxIn); i++ {
+		final = common.BlockChain.CheckSequenceLock(tx, i, inheight[i], height)
+	}
+	if !final {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_NOT_FINAL)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedNotFinal")
+		return
+	}
+
 	// Check if total output value does not exceed total input
 	minout := uint64(btc.MAX_MONEY)
 	for i := range tx.TxOut {
@@ -278,34 +335,85 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 	if totout > totinp {
 		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_OVERSPEND)
 		TxMutex.Unlock()
-		ntx.conn.DoS("TxOverspend")
+		if ntx.conn != nil { // nil for txs loaded from disk (see MempoolLoad)
+			ntx.conn.DoS("TxOverspend")
+		}
 		return
 	}
 
 	// Check for a proper fee
 	fee := totinp - totout
-	if fee < (uint64(len(ntx.raw)) * atomic.LoadUint64(&common.CFG.TXPool.FeePerByte)) {
+	if fee*1000 < uint64(tx.VSize())*MinFeeSPKB() {
 		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_LOW_FEE)
 		TxMutex.Unlock()
 		common.CountSafe("TxRejectedLowFee")
 		return
 	}
 
+	// Check if it can replace the txs it conflicts with
+	var evicted map[*OneTxToSend]bool
+	if len(conflicts) > 0 {
+		var why byte
+		if evicted, why = checkReplacement(tx, fee, conflicts); why != 0 {
+			RejectTx(ntx.tx.Hash, len(ntx.raw), why)
+			TxMutex.Unlock()
+			if why == TX_REJECTED_RBF {
+				common.CountSafe("TxRejectedRBF")
+			} else {
+				common.CountSafe("TxRejectedDoubleSpnd")
+			}
+			return
+		}
+	}
+
+	// Check the limits of unconfirmed chains
+	if frommem && !packageLimitsOK(poolParents(tx), tx.VSize()) {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_PACKAGE)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedPackage")
+		return
+	}
+
+	// Check the signature operations
+	sigops := script.GetSigOpCost(tx, pos, script.STANDARD_VERIFY_FLAGS)
+	if sigops > MAX_STANDARD_TX_SIGOPS_COST {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_SIGOPS)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedSigops")
+		return
+	}
+
 	// Verify scripts
 	for i := range tx.TxIn {
-		if !script.VerifyTxScript(tx.TxIn[i].ScriptSig, pos[i].Pk_script, i, tx, script.VER_P2SH|script.VER_DERSIG) {
+		if !script.VerifyTxScript(tx.TxIn[i].ScriptSig, pos[i].Pk_script, pos[i].Value, i, tx, script.STANDARD_VERIFY_FLAGS) {
 			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_SCRIPT_FAIL)
 			TxMutex.Unlock()
-			ntx.conn.DoS("TxScriptFail")
+			if ntx.conn != nil {
+				ntx.conn.DoS("TxScriptFail")
+			}
 			return
 		}
 	}
 
-	rec := &OneTxToSend{Data: ntx.raw, Spent: spent, Volume: totinp, Fee: fee, Firstseen: time.Now(), Tx: tx, Minout: minout}
-	TransactionsToSend[tx.Hash.BIdx()] = rec
-	TransactionsToSendSize += uint64(len(rec.Data))
-	for i := range spent {
-		SpentOutputs[spent[i]] = tx.Hash.BIdx()
+	rec := &OneTxToSend{Data: ntx.raw, Spent: spent, Volume: totinp, Fee: fee, Firstseen: time.Now(), Tx: tx, Minout: minout, SigopsCost: sigops}
+	if len(evicted) > 0 {
+		// Do not remove the txs it replaces, if it would not stay in the pool anyway
+		if wouldBeEvicted(rec, evicted) {
+			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_POOL_FULL)
+			TxMutex.Unlock()
+			common.CountSafe("TxRejectedPoolFull")
+			return
+		}
+		replaceTxs(evicted, conflicts, tx.Hash)
+	}
+
+	AddToSend(rec)
+	limitPoolSize()
+	if _, ok := TransactionsToSend[tx.Hash.BIdx()]; !ok {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_POOL_FULL)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedPoolFull")
+		return
 	}
 
 	wtg := WaitingForInputs[tx.Hash.BIdx()]
@@ -340,7 +448,7 @@ func isRoutable(rec *OneTxToSend) bool {
 		rec.Blocked = TX_REJECTED_TOO_BIG
 		return false
 	}
-	if rec.Fee < (uint64(len(rec.Data)) * atomic.LoadUint64(&common.CFG.TXRoute.FeePerByte)) {
+	if rec.Fee < (uint64(rec.VSize()) * atomic.LoadUint64(&common.CFG.TXRoute.FeePerByte)) {
 		common.CountSafe("TxRouteLowFee")
 		rec.Blocked = TX_REJECTED_LOW_FEE
 		return false
@@ -370,6 +478,24 @@ func RetryWaitingForInput(wtg *OneWaitingList) {
 	}
 }
 
+// Adds the tx to the memory pool. Make sure to call it with locked TxMutex.
+func AddToSend(rec *OneTxToSend) {
+	linkToSend(rec)
+	TransactionsToSend[rec.Tx.Hash.BIdx()] = rec
+	TransactionsToSendSize += uint64(len(rec.Data))
+	for i := range rec.Spent {
+		SpentOutputs[rec.Spent[i]] = rec.Tx.Hash.BIdx()
+	}
+	feeIndexAdd(rec)
+	feeEstSeen(rec)
+}
+
+// Removes the tx from the memory pool, along with the txs spending its outputs.
+// Make sure to call it with locked TxMutex.
+func DeleteToSend(rec *OneTxToSend) {
+	deleteWithDescendants(rec)
+}
+
 // Make sure to call it with locked TxMutex
 func deleteToSend(rec *OneTxToSend) {
 	for i := range rec.Spent {
@@ -377,14 +503,18 @@ func deleteToSend(rec *OneTxToSend) {
 	}
 	TransactionsToSendSize -= uint64(len(rec.Data))
 	delete(TransactionsToSend, rec.Tx.Hash.BIdx())
+	unlinkToSend(rec)
+	feeIndexDel(rec)
+	feeEstRemoved(rec)
 }
 
-// This function is called for each tx mined in a new block
-func TxMined(tx *btc.Tx) {
+// This function is called for each tx mined in a new block (at the given height)
+func TxMined(tx *btc.Tx, height uint32) {
 	h := tx.Hash
 	TxMutex.Lock()
 	if rec, ok := TransactionsToSend[h.BIdx()]; ok {
 		common.CountSafe("TxMinedToSend")
+		feeEstMined(rec, height)
 		deleteToSend(rec)
 	}
 	if _, ok := TransactionsRejected[h.BIdx()]; ok {
@@ -407,7 +537,7 @@ func TxMined(tx *btc.Tx) {
 				} else {
 					common.CountSafe("TxMinedOtherSpend")
 				}
-				deleteToSend(rec)
+				common.CountSafeAdd("TxMinedDescendants", uint64(deleteWithDescendants(rec)-1))
 			} else {
 				common.CountSafe("TxMinedSpentERROR")
 				NetAlerts <- fmt.Sprint("WTF? Input from ", rec.Tx.Hash.String(), " in mem-spent, but tx not in the mem-pool")
@@ -476,12 +606,13 @@ func ExpireTxs() {
 
 	TxMutex.Lock()
 	for _, v := range TransactionsToSend {
-		if v.Own == 0 && v.Firstseen.Before(expireTime(len(v.Data))) { // Do not expire own txs
-			deleteToSend(v)
+		// Do not expire own txs, nor their ancestors
+		if v.Own == 0 && v.Firstseen.Before(expireTime(len(v.Data))) && !hasOwnDescendant(v) {
+			n := uint64(deleteWithDescendants(v))
 			if v.Blocked == 0 {
-				cnt1a++
+				cnt1a += n
 			} else {
-				cnt1b++
+				cnt1b += n
 			}
 		}
 	}
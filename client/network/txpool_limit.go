@@ -0,0 +1,166 @@
+package network
+
+import (
+	"bytes"
+	"github.com/wchh/gocoin/client/common"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	The memory pool's transactions are also kept in TxsByFeeRate, sorted by their fee rate
+	(or by the fee rate of the tx with its descendants, if higher - see txpool_pkg.go).
+	When the size of the pool goes above CFG.TXPool.MaxSizeMB, the ones paying the least
+	(together with their descendants from the pool) get evicted, and the minimum fee required
+	from new transactions rises above the evicted fee rate. Then it decays, halving every
+	MinFeeHalfLife, until it gets back to CFG.TXPool.FeePerByte.
+	Own transactions (and their ancestors) are never evicted.
+*/
+
+const MinFeeHalfLife = 12 * time.Hour
+
+var (
+	// Transactions from TransactionsToSend - the highest fee rate (as described above) first
+	TxsByFeeRate []*OneTxToSend
+
+	dynMinFeeSPKB uint64 // fee per 1000 vbytes after the last eviction
+	dynMinFeeTime time.Time
+)
+
+// Returns true if a should be before b in TxsByFeeRate
+func feeRateBefore(a, b *OneTxToSend) bool {
+	if a.spkb != b.spkb {
+		return a.spkb > b.spkb
+	}
+	return bytes.Compare(a.Hash.Hash[:], b.Hash.Hash[:]) < 0
+}
+
+// Returns the position of the record in TxsByFeeRate, or where it would be inserted
+func feeIndexPos(rec *OneTxToSend) int {
+	return sort.Search(len(TxsByFeeRate), func(i int) bool {
+		return !feeRateBefore(TxsByFeeRate[i], rec)
+	})
+}
+
+func feeIndexAdd(rec *OneTxToSend) {
+	rec.spkb = rec.Fee * 1000 / uint64(rec.vsize)
+	if dspkb := rec.DescendantSPKB(); dspkb > rec.spkb {
+		rec.spkb = dspkb
+	}
+	i := feeIndexPos(rec)
+	TxsByFeeRate = append(TxsByFeeRate, nil)
+	copy(TxsByFeeRate[i+1:], TxsByFeeRate[i:])
+	TxsByFeeRate[i] = rec
+}
+
+func feeIndexDel(rec *OneTxToSend) {
+	if i := feeIndexPos(rec); i < len(TxsByFeeRate) && TxsByFeeRate[i] == rec {
+		copy(TxsByFeeRate[i:], TxsByFeeRate[i+1:])
+		TxsByFeeRate[len(TxsByFeeRate)-1] = nil
+		TxsByFeeRate = TxsByFeeRate[:len(TxsByFeeRate)-1]
+	}
+}
+
+// Returns fee per 1000 vbytes that a new tx must pay to get into the memory pool.
+// Make sure to call it with locked TxMutex.
+func MinFeeSPKB() (res uint64) {
+	res = atomic.LoadUint64(&common.CFG.TXPool.FeePerByte) * 1000
+	if dynMinFeeSPKB > 0 {
+		halves := float64(time.Now().Sub(dynMinFeeTime)) / float64(MinFeeHalfLife)
+		if dyn := uint64(float64(dynMinFeeSPKB) * math.Pow(0.5, halves)); dyn > res {
+			res = dyn
+		}
+	}
+	return
+}
+
+// After evicting a tx, new ones must pay more than it did
+func raiseMinFee(spkb uint64) {
+	spkb += atomic.LoadUint64(&common.CFG.TXPool.FeePerByte) * 1000
+	if spkb > MinFeeSPKB() {
+		dynMinFeeSPKB = spkb
+		dynMinFeeTime = time.Now()
+	}
+}
+
+// Returns own txs from the pool, together with their in-pool ancestors
+func ownPackages() (res map[*OneTxToSend]bool) {
+	res = make(map[*OneTxToSend]bool)
+	for _, t := range TransactionsToSend {
+		if t.Own != 0 && !res[t] {
+			res[t] = true
+			addAncestors(res, t.parents)
+		}
+	}
+	return
+}
+
+// Checks if the new tx (not added yet) would get evicted by limitPoolSize right after being
+// added, once the removed txs are gone. Make sure to call it with locked TxMutex.
+func wouldBeEvicted(nrec *OneTxToSend, removed map[*OneTxToSend]bool) bool {
+	max := uint64(atomic.LoadUint32(&common.CFG.TXPool.MaxSizeMB)) << 20
+	if max == 0 {
+		return false
+	}
+	total := TransactionsToSendSize + uint64(len(nrec.Data))
+	gone := make(map[*OneTxToSend]bool, len(removed))
+	for r := range removed {
+		gone[r] = true
+		total -= uint64(len(r.Data))
+	}
+	if total <= max {
+		return false
+	}
+	keep := ownPackages()
+	ancestors := make(map[*OneTxToSend]bool)
+	addAncestors(ancestors, poolParents(nrec.Tx))
+	tmp := &OneTxToSend{Tx: nrec.Tx, spkb: nrec.Fee * 1000 / uint64(nrec.VSize())}
+	for i := len(TxsByFeeRate) - 1; i >= 0 && total > max; i-- {
+		rec := TxsByFeeRate[i]
+		if keep[rec] || gone[rec] {
+			continue
+		}
+		if feeRateBefore(rec, tmp) || ancestors[rec] {
+			return true // the new one would go before it (or together with it)
+		}
+		pkg := map[*OneTxToSend]bool{rec: true}
+		addDescendants(pkg, rec.children)
+		for d := range pkg {
+			if !gone[d] {
+				gone[d] = true
+				total -= uint64(len(d.Data))
+			}
+		}
+	}
+	return total > max
+}
+
+// Evicts the transactions paying the lowest fee rate, until the pool fits in its size limit.
+// Make sure to call it with locked TxMutex.
+func limitPoolSize() {
+	max := uint64(atomic.LoadUint32(&common.CFG.TXPool.MaxSizeMB)) << 20
+	if max == 0 {
+		return
+	}
+	var keep map[*OneTxToSend]bool
+	for TransactionsToSendSize > max {
+		if keep == nil {
+			// Evicting the others does not change this set, as none of them has an own descendant
+			keep = ownPackages()
+		}
+		var rec *OneTxToSend
+		for i := len(TxsByFeeRate) - 1; i >= 0; i-- {
+			if !keep[TxsByFeeRate[i]] {
+				rec = TxsByFeeRate[i]
+				break
+			}
+		}
+		if rec == nil {
+			break // only own txs (and their ancestors) left
+		}
+		raiseMinFee(rec.spkb)
+		common.CountSafeAdd("TxPoolEvicted", uint64(deleteWithDescendants(rec)))
+	}
+}
@@ -0,0 +1,193 @@
+package network
+
+import (
+	"github.com/wchh/gocoin/lib/btc"
+	"sort"
+)
+
+/*
+	Each tx in the memory pool knows its parents and children from the pool (the txs whose
+	outputs it spends, and the ones spending its outputs). For the tx with all its in-pool
+	ancestors, as well as for the tx with all its descendants, the pool keeps the totals of
+	count, vsize and fees. The ancestor totals tell the fee rate of mining the tx (CPFP),
+	while the descendant ones tell how much the pool would lose by evicting it.
+*/
+
+const (
+	// Relay policy: limits of a tx with all its in-pool ancestors, or descendants (same as Core's)
+	MAX_PACKAGE_COUNT = 25
+	MAX_PACKAGE_VSIZE = 101000
+)
+
+// Returns fee per 1000 vbytes of the tx with all its in-pool ancestors
+func (rec *OneTxToSend) AncestorSPKB() uint64 {
+	return rec.AncestorFee * 1000 / uint64(rec.AncestorSize)
+}
+
+// Returns fee per 1000 vbytes of the tx with all its in-pool descendants
+func (rec *OneTxToSend) DescendantSPKB() uint64 {
+	return rec.DescendantFee * 1000 / uint64(rec.DescendantSize)
+}
+
+// Returns the parents and children of the tx, from the memory pool
+func (rec *OneTxToSend) Relatives() (parents, children []*OneTxToSend) {
+	for _, p := range rec.parents {
+		parents = append(parents, p)
+	}
+	for _, c := range rec.children {
+		children = append(children, c)
+	}
+	return
+}
+
+type txsByAncestors []*OneTxToSend
+
+func (t txsByAncestors) Len() int {
+	return len(t)
+}
+
+func (t txsByAncestors) Less(i, j int) bool {
+	// A parent always has less ancestors than its child
+	return t[i].AncestorCnt < t[j].AncestorCnt
+}
+
+func (t txsByAncestors) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// Returns all the in-pool ancestors of the tx, parents before their children.
+// Make sure to call it with locked TxMutex.
+func (rec *OneTxToSend) Ancestors() (res []*OneTxToSend) {
+	set := make(map[*OneTxToSend]bool)
+	addAncestors(set, rec.parents)
+	for a := range set {
+		res = append(res, a)
+	}
+	sort.Sort(txsByAncestors(res))
+	return
+}
+
+// Returns the pool's txs whose outputs the tx spends
+func poolParents(tx *btc.Tx) (res map[[btc.Uint256IdxLen]byte]*OneTxToSend) {
+	res = make(map[[btc.Uint256IdxLen]byte]*OneTxToSend)
+	for _, in := range tx.TxIn {
+		bidx := btc.NewUint256(in.Input.Hash[:]).BIdx()
+		if p := TransactionsToSend[bidx]; p != nil && p.Hash.Hash == in.Input.Hash {
+			res[bidx] = p
+		}
+	}
+	return
+}
+
+// Adds all the in-pool ancestors of the given parents to the set
+func addAncestors(set map[*OneTxToSend]bool, parents map[[btc.Uint256IdxLen]byte]*OneTxToSend) {
+	for _, p := range parents {
+		if !set[p] {
+			set[p] = true
+			addAncestors(set, p.parents)
+		}
+	}
+}
+
+// Adds all the in-pool descendants of the given children to the set
+func addDescendants(set map[*OneTxToSend]bool, children map[[btc.Uint256IdxLen]byte]*OneTxToSend) {
+	for _, c := range children {
+		if !set[c] {
+			set[c] = true
+			addDescendants(set, c.children)
+		}
+	}
+}
+
+// Checks if a tx with the given parents and vsize would not exceed the package limits.
+// Make sure to call it with locked TxMutex.
+func packageLimitsOK(parents map[[btc.Uint256IdxLen]byte]*OneTxToSend, vsize int) bool {
+	ancestors := make(map[*OneTxToSend]bool)
+	addAncestors(ancestors, parents)
+	cnt, size := 1, vsize
+	for a := range ancestors {
+		cnt++
+		size += a.vsize
+		if a.DescendantCnt+1 > MAX_PACKAGE_COUNT || a.DescendantSize+vsize > MAX_PACKAGE_VSIZE {
+			return false
+		}
+	}
+	return cnt <= MAX_PACKAGE_COUNT && size <= MAX_PACKAGE_VSIZE
+}
+
+// Links the new tx with its relatives and updates their totals
+func linkToSend(rec *OneTxToSend) {
+	rec.vsize = rec.VSize()
+	rec.parents = poolParents(rec.Tx)
+	rec.children = make(map[[btc.Uint256IdxLen]byte]*OneTxToSend)
+	rec.AncestorCnt, rec.AncestorSize, rec.AncestorFee = 1, rec.vsize, rec.Fee
+	rec.DescendantCnt, rec.DescendantSize, rec.DescendantFee = 1, rec.vsize, rec.Fee
+
+	ancestors := make(map[*OneTxToSend]bool)
+	addAncestors(ancestors, rec.parents)
+	for a := range ancestors {
+		rec.AncestorCnt++
+		rec.AncestorSize += a.vsize
+		rec.AncestorFee += a.Fee
+		feeIndexDel(a)
+		a.DescendantCnt++
+		a.DescendantSize += rec.vsize
+		a.DescendantFee += rec.Fee
+		feeIndexAdd(a)
+	}
+	for _, p := range rec.parents {
+		p.children[rec.Hash.BIdx()] = rec
+	}
+}
+
+// Unlinks the tx being removed from its relatives and updates their totals
+func unlinkToSend(rec *OneTxToSend) {
+	ancestors := make(map[*OneTxToSend]bool)
+	addAncestors(ancestors, rec.parents)
+	for a := range ancestors {
+		feeIndexDel(a)
+		a.DescendantCnt--
+		a.DescendantSize -= rec.vsize
+		a.DescendantFee -= rec.Fee
+		feeIndexAdd(a)
+	}
+	descendants := make(map[*OneTxToSend]bool)
+	addDescendants(descendants, rec.children)
+	for d := range descendants {
+		d.AncestorCnt--
+		d.AncestorSize -= rec.vsize
+		d.AncestorFee -= rec.Fee
+	}
+	for _, p := range rec.parents {
+		delete(p.children, rec.Hash.BIdx())
+	}
+	for _, c := range rec.children {
+		delete(c.parents, rec.Hash.BIdx())
+	}
+}
+
+// Returns true if the tx or any of its in-pool descendants is own
+func hasOwnDescendant(rec *OneTxToSend) bool {
+	if rec.Own != 0 {
+		return true
+	}
+	for _, c := range rec.children {
+		if hasOwnDescendant(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the tx from the pool, together with all its in-pool descendants.
+// Returns the number of removed txs. Make sure to call it with locked TxMutex.
+func deleteWithDescendants(rec *OneTxToSend) (cnt int) {
+	for _, c := range rec.children {
+		if _, ok := TransactionsToSend[c.Hash.BIdx()]; ok {
+			cnt += deleteWithDescendants(c)
+		}
+	}
+	deleteToSend(rec)
+	cnt++
+	return
+}
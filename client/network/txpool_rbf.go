@@ -0,0 +1,138 @@
+package network
+
+import (
+	"github.com/wchh/gocoin/client/common"
+	"github.com/wchh/gocoin/lib/btc"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Replace-by-fee (BIP-125): a tx that spends the same outputs as some txs from the memory pool
+	replaces them (along with their descendants), if each of them signals replaceability,
+	and the new tx pays more - see checkReplacement() for the rules.
+*/
+
+const (
+	MAX_RBF_EVICTED      = 100 // Replacement must not evict more txs than this
+	MaxReplacedListItems = 100
+)
+
+type OneTxReplaced struct {
+	Id, By *btc.Uint256
+	time.Time
+	Fee        uint64
+	Size       uint32
+	Descendant bool // evicted as a descendant of a tx replaced by By
+}
+
+var (
+	// The most recently replaced txs (the oldest first)
+	TransactionsReplaced    []*OneTxReplaced
+	TransactionsReplacedCnt uint64
+)
+
+// Returns the pool's tx (with the given index) that spends the given output, if there is one
+func spendingTx(bidx [btc.Uint256IdxLen]byte, out *btc.TxPrevOut) *OneTxToSend {
+	if rec := TransactionsToSend[bidx]; rec != nil {
+		for _, in := range rec.TxIn {
+			if in.Input == *out {
+				return rec
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the tx (or any of its in-pool ancestors) signals replaceability
+func signalsRBF(rec *OneTxToSend) bool {
+	for _, in := range rec.TxIn {
+		if in.Sequence < 0xfffffffe {
+			return true
+		}
+	}
+	for _, a := range rec.Ancestors() {
+		for _, in := range a.TxIn {
+			if in.Sequence < 0xfffffffe {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks whether the new tx can replace the pool's txs it conflicts with.
+// Returns the txs that would get evicted, or the reason of rejection.
+// Make sure to call it with locked TxMutex.
+func checkReplacement(tx *btc.Tx, fee uint64, conflicts map[[btc.Uint256IdxLen]byte]*OneTxToSend) (evicted map[*OneTxToSend]bool, reason byte) {
+	if !common.CFG.TXPool.AllowRBF {
+		return nil, TX_REJECTED_DOUBLE_SPEND
+	}
+	evicted = make(map[*OneTxToSend]bool)
+	for _, c := range conflicts {
+		// We do not let others replace our own txs
+		if c.Own != 0 || !signalsRBF(c) {
+			return nil, TX_REJECTED_DOUBLE_SPEND
+		}
+		evicted[c] = true
+		addDescendants(evicted, c.children)
+	}
+	if len(evicted) > MAX_RBF_EVICTED {
+		return nil, TX_REJECTED_RBF
+	}
+
+	vsize := uint64(tx.VSize())
+	var evicted_fee uint64
+	for e := range evicted {
+		if e.Own != 0 {
+			return nil, TX_REJECTED_DOUBLE_SPEND
+		}
+		evicted_fee += e.Fee
+	}
+
+	// The replacement must pay more than what it replaces - and for its own bandwidth
+	if fee <= evicted_fee || fee-evicted_fee < vsize*atomic.LoadUint64(&common.CFG.TXPool.FeePerByte) {
+		return nil, TX_REJECTED_RBF
+	}
+	// ... and have a higher fee rate than each of the txs it directly conflicts with
+	for _, c := range conflicts {
+		if fee*uint64(c.vsize) <= c.Fee*vsize {
+			return nil, TX_REJECTED_RBF
+		}
+	}
+
+	// It must not spend outputs of the txs being evicted, nor add new unconfirmed inputs
+	for bidx, p := range poolParents(tx) {
+		if evicted[p] {
+			return nil, TX_REJECTED_RBF
+		}
+		var known bool
+		for _, c := range conflicts {
+			if _, known = c.parents[bidx]; known {
+				break
+			}
+		}
+		if !known {
+			return nil, TX_REJECTED_RBF
+		}
+	}
+	return
+}
+
+// Removes the txs replaced by the given one (the conflicting ones and their descendants).
+// Make sure to call it with locked TxMutex.
+func replaceTxs(evicted map[*OneTxToSend]bool, conflicts map[[btc.Uint256IdxLen]byte]*OneTxToSend, by *btc.Uint256) {
+	now := time.Now()
+	for e := range evicted {
+		if _, ok := TransactionsToSend[e.Hash.BIdx()]; ok {
+			deleteToSend(e)
+		}
+		TransactionsReplaced = append(TransactionsReplaced, &OneTxReplaced{Id: e.Hash, By: by, Time: now,
+			Fee: e.Fee, Size: uint32(len(e.Data)), Descendant: conflicts[e.Hash.BIdx()] != e})
+		TransactionsReplacedCnt++
+	}
+	if len(TransactionsReplaced) > MaxReplacedListItems {
+		TransactionsReplaced = append([]*OneTxReplaced{}, TransactionsReplaced[len(TransactionsReplaced)-MaxReplacedListItems:]...)
+	}
+	common.CountSafeAdd("TxReplaced", uint64(len(evicted)))
+}
@@ -0,0 +1,265 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wchh/gocoin/client/common"
+	"github.com/wchh/gocoin/lib/btc"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+	On exit, the memory pool is saved to MEMPOOL_FILE (if CFG.TXPool.SaveOnDisk is set).
+	On the next start, each tx from the file goes through HandleNetTx again, unless it has
+	expired, or any of its inputs is not there anymore (it got mined or double spent) - own txs too.
+	Own txs keep their flag and never expire. If one does not pass HandleNetTx (e.g. its fee is
+	too low), it gets back to the pool the same way as with load_tx.
+
+	File format (all LSB):
+		[4] - version (MEMPOOL_FILE_VERSION)
+		var_int - number of txs, each one being:
+			[8] - first seen time (unix nano)
+			[1] - own flag
+			var_int - length + raw tx
+		[32] - SHA256 of all the above
+*/
+
+const (
+	MEMPOOL_FILE         = "mempool.dat"
+	MEMPOOL_FILE_VERSION = 1
+)
+
+// Saves the memory pool to disk. Call it when the client is about to exit.
+func MempoolSave() {
+	if !common.CFG.TXPool.SaveOnDisk {
+		return
+	}
+
+	TxMutex.Lock()
+	txs := make([]*OneTxToSend, 0, len(TransactionsToSend))
+	for _, v := range TransactionsToSend {
+		txs = append(txs, v)
+	}
+	sort.Sort(txsByAncestors(txs)) // parents must go first
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(MEMPOOL_FILE_VERSION))
+	btc.WriteVlen(buf, uint64(len(txs)))
+	for _, v := range txs {
+		binary.Write(buf, binary.LittleEndian, v.Firstseen.UnixNano())
+		buf.WriteByte(v.Own)
+		btc.WriteVlen(buf, uint64(len(v.Data)))
+		buf.Write(v.Data)
+	}
+	TxMutex.Unlock()
+
+	sh := sha256.Sum256(buf.Bytes())
+	buf.Write(sh[:])
+
+	fn := common.GocoinHomeDir + MEMPOOL_FILE
+	if e := ioutil.WriteFile(fn+".tmp", buf.Bytes(), 0600); e != nil {
+		println("MempoolSave:", e.Error())
+		return
+	}
+	if e := os.Rename(fn+".tmp", fn); e != nil {
+		println("MempoolSave:", e.Error())
+		return
+	}
+	fmt.Println(len(txs), "transactions from the memory pool saved to", fn)
+}
+
+type savedTx struct {
+	firstseen time.Time
+	own       byte
+	raw       []byte
+}
+
+func readMempoolFile(fn string) (res []savedTx, e error) {
+	d, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return
+	}
+	if len(d) < 4+1+32 {
+		e = errors.New("file too short")
+		return
+	}
+	if sh := sha256.Sum256(d[:len(d)-32]); !bytes.Equal(sh[:], d[len(d)-32:]) {
+		e = errors.New("checksum mismatch")
+		return
+	}
+	if ver := binary.LittleEndian.Uint32(d[:4]); ver != MEMPOOL_FILE_VERSION {
+		e = errors.New(fmt.Sprint("unsupported version ", ver))
+		return
+	}
+
+	rd := bytes.NewReader(d[4 : len(d)-32])
+	cnt, e := btc.ReadVLen(rd)
+	if e != nil {
+		return
+	}
+	for ; cnt > 0; cnt-- {
+		var st savedTx
+		var ns int64
+		var le uint64
+		if e = binary.Read(rd, binary.LittleEndian, &ns); e != nil {
+			return
+		}
+		if st.own, e = rd.ReadByte(); e != nil {
+			return
+		}
+		if le, e = btc.ReadVLen(rd); e != nil {
+			return
+		}
+		if le > uint64(rd.Len()) {
+			e = errors.New("broken record")
+			return
+		}
+		st.raw = make([]byte, le)
+		rd.Read(st.raw)
+		st.firstseen = time.Unix(0, ns)
+		res = append(res, st)
+	}
+	return
+}
+
+// Checks if all the inputs of the tx are still unspent (in the chain or in the pool).
+// Returns their total value. Make sure to call it with locked TxMutex.
+func savedTxInputs(tx *btc.Tx) (totinp uint64, ok bool) {
+	for i := range tx.TxIn {
+		if _, spent := SpentOutputs[tx.TxIn[i].Input.UIdx()]; spent {
+			return
+		}
+		if txinmem, inmem := TransactionsToSend[btc.NewUint256(tx.TxIn[i].Input.Hash[:]).BIdx()]; inmem {
+			if int(tx.TxIn[i].Input.Vout) >= len(txinmem.TxOut) {
+				return
+			}
+			totinp += txinmem.TxOut[tx.TxIn[i].Input.Vout].Value
+		} else if out, _ := common.BlockChain.Unspent.UnspentGet(&tx.TxIn[i].Input); out != nil {
+			totinp += out.Value
+		} else {
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// Returns true if the tx has been rejected only by our policy (or for its unknown inputs),
+// but not for being invalid, so an own tx can still be put into the pool.
+// Make sure to call it with locked TxMutex.
+func policyRejected(bidx [btc.Uint256IdxLen]byte) bool {
+	if rec := TransactionsRejected[bidx]; rec != nil {
+		switch rec.Reason {
+		case TX_REJECTED_DISABLED, TX_REJECTED_TOO_BIG, TX_REJECTED_NO_TXOU, TX_REJECTED_DUST,
+			TX_REJECTED_LOW_FEE, TX_REJECTED_NOT_MINED, TX_REJECTED_SIGOPS, TX_REJECTED_POOL_FULL,
+			TX_REJECTED_PACKAGE:
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any of the tx's inputs is already spent by a tx in the pool.
+// Make sure to call it with locked TxMutex.
+func spentInPool(tx *btc.Tx) bool {
+	for i := range tx.TxIn {
+		if _, spent := SpentOutputs[tx.TxIn[i].Input.UIdx()]; spent {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads the memory pool saved by MempoolSave. Must be called from the chain's thread.
+func MempoolLoad() {
+	if !common.CFG.TXPool.SaveOnDisk {
+		return
+	}
+
+	fn := common.GocoinHomeDir + MEMPOOL_FILE
+	txs, e := readMempoolFile(fn)
+	if e != nil {
+		if !os.IsNotExist(e) {
+			println("MempoolLoad:", fn, e.Error())
+		}
+		return
+	}
+
+	var cnt_ok, cnt_own, cnt_mined, cnt_expired, cnt_rejected uint64
+	for _, st := range txs {
+		tx, le := btc.NewTx(st.raw)
+		if tx == nil || le != len(st.raw) {
+			common.CountSafe("TxPoolLoadRejected")
+			cnt_rejected++
+			continue
+		}
+		tx.SetHash(st.raw)
+		bidx := tx.Hash.BIdx()
+
+		if st.own == 0 && (!common.CFG.TXPool.Enabled || st.firstseen.Before(expireTime(len(st.raw)))) {
+			common.CountSafe("TxPoolLoadExpired")
+			cnt_expired++
+			continue
+		}
+
+		TxMutex.Lock()
+		_, present := TransactionsToSend[bidx]
+		totinp, inpok := savedTxInputs(tx)
+		TxMutex.Unlock()
+		if present {
+			continue
+		}
+		if !inpok && st.own == 0 {
+			common.CountSafe("TxPoolLoadMined")
+			cnt_mined++
+			continue
+		}
+
+		if HandleNetTx(&TxRcvd{tx: tx, raw: st.raw}, true) {
+			TxMutex.Lock()
+			if rec := TransactionsToSend[bidx]; rec != nil {
+				rec.Firstseen = st.firstseen
+				rec.Own = st.own
+			}
+			delete(feeEstTracked, bidx) // we do not know at which height it came
+			TxMutex.Unlock()
+			common.CountSafe("TxPoolLoadOK")
+			cnt_ok++
+			continue
+		}
+
+		TxMutex.Lock()
+		if st.own == 0 || !policyRejected(bidx) || spentInPool(tx) {
+			TxMutex.Unlock()
+			common.CountSafe("TxPoolLoadRejected")
+			cnt_rejected++
+			continue
+		}
+
+		// Own tx that does not meet our policy (or with unknown inputs) - put it back as load_tx does
+		deleteRejected(bidx)
+		rec := &OneTxToSend{Tx: tx, Data: st.raw, Own: st.own, Firstseen: st.firstseen}
+		for i := range tx.TxOut {
+			rec.Volume += tx.TxOut[i].Value
+		}
+		if inpok && totinp >= rec.Volume {
+			rec.Fee = totinp - rec.Volume
+			rec.Volume = totinp
+		} else {
+			rec.Own = 2
+		}
+		AddToSend(rec)
+		delete(feeEstTracked, bidx)
+		TxMutex.Unlock()
+		common.CountSafe("TxPoolLoadOwn")
+		cnt_own++
+	}
+	fmt.Println(cnt_ok+cnt_own, "transactions restored to the memory pool from", fn, "-",
+		cnt_mined, "mined,", cnt_expired, "expired,", cnt_rejected, "rejected")
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/wchh/gocoin/client/common"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/chain"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Returns a pool record of a tx spending the given output
+func saveTestTx(in *btc.TxPrevOut, fee uint64, own byte) *OneTxToSend {
+	return saveTestTxScr(in, fee, own, []byte{0x51})
+}
+
+// Returns a pool record of a tx spending the given output with the given scriptSig
+func saveTestTxScr(in *btc.TxPrevOut, fee uint64, own byte, scr []byte) *OneTxToSend {
+	tx := new(btc.Tx)
+	tx.Version = 1
+	tx.TxIn = []*btc.TxIn{&btc.TxIn{Input: *in, ScriptSig: scr, Sequence: 0xffffffff}}
+	tx.TxOut = []*btc.TxOut{&btc.TxOut{Value: 100000 - fee, Pk_script: []byte{0x51}}}
+	raw := tx.Serialize()
+	tx, _ = btc.NewTx(raw)
+	tx.SetHash(raw)
+	return &OneTxToSend{Tx: tx, Data: raw, Spent: []uint64{in.UIdx()}, Fee: fee, Own: own,
+		Firstseen: time.Unix(1500000000, int64(fee))}
+}
+
+// Writes the file with the given content, followed by its checksum
+func writeMempoolFile(t *testing.T, fn string, d []byte) {
+	sh := sha256.Sum256(d)
+	if e := ioutil.WriteFile(fn, append(d, sh[:]...), 0600); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// Writes the file with the given txs, as MempoolSave would
+func writeSavedTxs(t *testing.T, fn string, recs ...*OneTxToSend) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(MEMPOOL_FILE_VERSION))
+	btc.WriteVlen(buf, uint64(len(recs)))
+	for _, rec := range recs {
+		binary.Write(buf, binary.LittleEndian, time.Now().UnixNano())
+		buf.WriteByte(rec.Own)
+		btc.WriteVlen(buf, uint64(len(rec.Data)))
+		buf.Write(rec.Data)
+	}
+	writeMempoolFile(t, fn, buf.Bytes())
+}
+
+func TestMempoolFile(t *testing.T) {
+	dir, e := ioutil.TempDir("", "mempool")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	// Restore all the globals that the test changes
+	defer func(tts map[[btc.Uint256IdxLen]byte]*OneTxToSend, ttss uint64, so map[uint64][btc.Uint256IdxLen]byte,
+		bfr []*OneTxToSend, tr map[[btc.Uint256IdxLen]byte]*OneTxRejected, trs uint64,
+		wfi map[[btc.Uint256IdxLen]byte]*OneWaitingList, home string, last *chain.BlockTreeNode, bch *chain.Chain) {
+		TransactionsToSend, TransactionsToSendSize, SpentOutputs, TxsByFeeRate = tts, ttss, so, bfr
+		TransactionsRejected, TransactionsRejectedSize, WaitingForInputs = tr, trs, wfi
+		common.GocoinHomeDir, common.Last.Block, common.BlockChain = home, last, bch
+	}(TransactionsToSend, TransactionsToSendSize, SpentOutputs, TxsByFeeRate, TransactionsRejected,
+		TransactionsRejectedSize, WaitingForInputs, common.GocoinHomeDir, common.Last.Block, common.BlockChain)
+	txpcfg := common.CFG.TXPool
+	defer func() { common.CFG.TXPool = txpcfg }()
+	defer func(maxexp, perkb time.Duration) {
+		common.MaxExpireTime, common.ExpirePerKB = maxexp, perkb
+	}(common.MaxExpireTime, common.ExpirePerKB)
+
+	common.GocoinHomeDir = dir + string(os.PathSeparator)
+	common.BlockChain = chain.NewChainExt(common.GocoinHomeDir, &btc.RegTestParams, false, nil)
+	defer common.BlockChain.Close()
+	common.Last.Block = common.BlockChain.BlockTreeEnd
+	c := &common.CFG.TXPool
+	c.Enabled, c.AllowMemInputs, c.SaveOnDisk = true, true, true
+	c.FeePerByte, c.MaxTxSize, c.MaxSizeMB = 1, 10e3, 100
+	common.MaxExpireTime, common.ExpirePerKB = 12*time.Hour, 180*time.Minute
+	fn := common.GocoinHomeDir + MEMPOOL_FILE
+
+	// The pool: a tx, its child (own) and an unrelated one
+	TransactionsToSend = make(map[[btc.Uint256IdxLen]byte]*OneTxToSend)
+	SpentOutputs = make(map[uint64][btc.Uint256IdxLen]byte)
+	TxsByFeeRate = nil
+	TransactionsToSendSize = 0
+	TransactionsRejected = make(map[[btc.Uint256IdxLen]byte]*OneTxRejected)
+	TransactionsRejectedSize = 0
+	WaitingForInputs = make(map[[btc.Uint256IdxLen]byte]*OneWaitingList)
+	parent := saveTestTx(&btc.TxPrevOut{Hash: [32]byte{1}}, 1000, 0)
+	child := saveTestTx(&btc.TxPrevOut{Hash: parent.Hash.Hash}, 2000, 1)
+	other := saveTestTx(&btc.TxPrevOut{Hash: [32]byte{2}, Vout: 3}, 3000, 0)
+	TxMutex.Lock()
+	AddToSend(parent)
+	AddToSend(child)
+	AddToSend(other)
+	TxMutex.Unlock()
+
+	MempoolSave()
+	txs, e := readMempoolFile(fn)
+	if e != nil {
+		t.Fatal("readMempoolFile:", e)
+	}
+	if len(txs) != 3 {
+		t.Fatal("Bad number of txs", len(txs))
+	}
+	pos := make(map[*OneTxToSend]int)
+	for _, rec := range []*OneTxToSend{parent, child, other} {
+		pos[rec] = -1
+		for i := range txs {
+			if bytes.Equal(txs[i].raw, rec.Data) {
+				pos[rec] = i
+				if txs[i].own != rec.Own || !txs[i].firstseen.Equal(rec.Firstseen) {
+					t.Error("Bad record", i, txs[i].own, txs[i].firstseen)
+				}
+			}
+		}
+		if pos[rec] < 0 {
+			t.Error("Tx not saved", rec.Hash.String())
+		}
+	}
+	if pos[parent] > pos[child] {
+		t.Error("Parent saved after its child")
+	}
+
+	d, _ := ioutil.ReadFile(fn)
+	body := append([]byte{}, d[:len(d)-32]...)
+
+	// Checksum
+	d[10] ^= 0x01
+	ioutil.WriteFile(fn, d, 0600)
+	if _, e = readMempoolFile(fn); e == nil || e.Error() != "checksum mismatch" {
+		t.Error("Corrupt file not detected", e)
+	}
+
+	// Version
+	binary.LittleEndian.PutUint32(body[:4], MEMPOOL_FILE_VERSION+1)
+	writeMempoolFile(t, fn, body)
+	if _, e = readMempoolFile(fn); e == nil || e.Error() != "unsupported version 2" {
+		t.Error("Bad version not detected", e)
+	}
+
+	// Truncated record
+	binary.LittleEndian.PutUint32(body[:4], MEMPOOL_FILE_VERSION)
+	writeMempoolFile(t, fn, body[:len(body)-1])
+	if _, e = readMempoolFile(fn); e == nil || e.Error() != "broken record" {
+		t.Error("Truncated record not detected", e)
+	}
+
+	// More records declared than there are
+	body[4]++
+	writeMempoolFile(t, fn, body)
+	if _, e = readMempoolFile(fn); e == nil {
+		t.Error("Missing record not detected")
+	}
+
+	// Own txs: one with unknown inputs gets loaded (as Own=2), but not the invalid ones:
+	// spending an output already spent in the pool or failing its script
+	dbl := saveTestTx(&other.TxIn[0].Input, 0, 2)
+	badscr := saveTestTxScr(&btc.TxPrevOut{Hash: other.Hash.Hash}, 5000, 1, []byte{btc.OP_RETURN})
+	unknown := saveTestTx(&btc.TxPrevOut{Hash: [32]byte{3}}, 4000, 1)
+	mined := saveTestTx(&btc.TxPrevOut{Hash: [32]byte{4}}, 4000, 0)
+	writeSavedTxs(t, fn, dbl, badscr, unknown, mined)
+	MempoolLoad()
+	for _, rec := range []*OneTxToSend{dbl, badscr, mined} {
+		if _, ok := TransactionsToSend[rec.Hash.BIdx()]; ok {
+			t.Error("Tx loaded", rec.Hash.String())
+		}
+	}
+	if rec := TransactionsToSend[unknown.Hash.BIdx()]; rec == nil || rec.Own != 2 {
+		t.Error("Own tx with unknown inputs not loaded", rec)
+	}
+	if SpentOutputs[other.TxIn[0].Input.UIdx()] != other.Hash.BIdx() {
+		t.Error("Spending tx of the output changed")
+	}
+}
@@ -0,0 +1,202 @@
+package usif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/wchh/gocoin/client/common"
+	"github.com/wchh/gocoin/client/network"
+	"github.com/wchh/gocoin/client/wallet"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/chain"
+	"github.com/wchh/gocoin/lib/script"
+	"sort"
+	"time"
+)
+
+// Set by the main package. Processes a locally generated block, as if it came from the network.
+var ProcessLocalBlock func(bl *btc.Block) error
+
+type txsByFee []*network.OneTxToSend
+
+func (t txsByFee) Len() int {
+	return len(t)
+}
+
+func (t txsByFee) Less(i, j int) bool {
+	// Higher fee per byte first (counting the tx together with its unconfirmed ancestors)
+	return t[i].AncestorSPKB() > t[j].AncestorSPKB()
+}
+
+func (t txsByFee) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// Picks transactions from the memory pool for a new block, parents before children.
+// Each tx comes with its unconfirmed ancestors, so a child can pay for its parents (CPFP).
+// With csv set, txs must also meet their relative lock times (BIP-68), as checked by the chain.
+func blockTxs(height, locktime_cutoff uint32, csv bool) (res []*btc.Tx, fees uint64) {
+	network.TxMutex.Lock()
+	defer network.TxMutex.Unlock()
+
+	pool := make(txsByFee, 0, len(network.TransactionsToSend))
+	for _, t := range network.TransactionsToSend {
+		pool = append(pool, t)
+	}
+	sort.Sort(pool)
+
+	weight := 4000 // reserved for the header and the coinbase
+	sigops := 400
+	in_block := make(map[[32]byte]bool)
+	for _, t := range pool {
+		if in_block[t.Hash.Hash] {
+			continue // already in as someone's ancestor
+		}
+		var pkg []*network.OneTxToSend
+		for _, a := range t.Ancestors() {
+			if !in_block[a.Hash.Hash] {
+				pkg = append(pkg, a)
+			}
+		}
+		pkg = append(pkg, t)
+
+		pkg_weight, pkg_sigops := 0, 0
+		in_pkg := make(map[[32]byte]bool, len(pkg))
+		ok := true
+		for _, p := range pkg {
+			if !p.IsFinal(height, locktime_cutoff) {
+				ok = false
+				break
+			}
+			for j, inp := range p.TxIn {
+				inheight := height
+				if !in_block[inp.Input.Hash] && !in_pkg[inp.Input.Hash] {
+					o := common.BlockChain.PickUnspent(&inp.Input)
+					if o == nil || o.WasCoinbase && height-o.BlockHeight < chain.COINBASE_MATURITY {
+						ok = false // not available (yet)
+						break
+					}
+					inheight = o.BlockHeight
+				}
+				if csv && !common.BlockChain.CheckSequenceLock(p.Tx, j, inheight, height) {
+					ok = false // relative lock time not reached
+					break
+				}
+			}
+			if !ok {
+				break
+			}
+			pkg_weight += p.Weight()
+			pkg_sigops += p.SigopsCost
+			in_pkg[p.Hash.Hash] = true
+		}
+		if !ok || weight+pkg_weight > btc.MAX_BLOCK_WEIGHT || sigops+pkg_sigops > btc.MAX_BLOCK_SIGOPS_COST {
+			continue
+		}
+		for _, p := range pkg {
+			res = append(res, p.Tx)
+			fees += p.Fee
+			in_block[p.Hash.Hash] = true
+		}
+		weight += pkg_weight
+		sigops += pkg_sigops
+	}
+	return
+}
+
+// Builds a new block on top of the current chain, with transactions from the memory pool
+// and the coinbase paying to pkscr. Then it mines it, which only makes sense at the regtest difficulty.
+// Call it from the blockchain thread.
+func GenerateBlock(pkscr []byte) (bl *btc.Block, e error) {
+	ch := common.BlockChain
+	last := ch.BlockTreeEnd
+	height := last.Height + 1
+
+	mtp := last.MedianTimePast()
+	tim := uint32(time.Now().Unix())
+	if tim <= mtp {
+		tim = mtp + 1
+	}
+	flags := ch.GetBlockFlags(last, tim)
+	locktime_cutoff := tim
+	if (flags & script.VER_CSV) != 0 {
+		locktime_cutoff = mtp
+	}
+
+	txs, fees := blockTxs(height, locktime_cutoff, (flags&script.VER_CSV) != 0)
+
+	cb := new(btc.Tx)
+	cb.Version = 1
+	cb.TxIn = []*btc.TxIn{&btc.TxIn{Input: btc.TxPrevOut{Vout: 0xffffffff}, Sequence: 0xffffffff}}
+	cb.TxIn[0].ScriptSig = append(btc.CoinbaseHeight(height), 8, '/', 'G', 'o', 'c', 'o', 'i', 'n', '/')
+	cb.TxOut = []*btc.TxOut{&btc.TxOut{Value: common.Params.BlockReward(height) + fees, Pk_script: pkscr}}
+	txs = append([]*btc.Tx{cb}, txs...)
+	if (flags & script.VER_WITNESS) != 0 {
+		cb.TxIn[0].Witness = [][]byte{make([]byte, 32)}
+		h := btc.Sha2Sum(append(btc.GetWitnessMerkle(txs), cb.TxIn[0].Witness[0]...))
+		cb.TxOut = append(cb.TxOut, &btc.TxOut{Pk_script: append(append([]byte{}, btc.WitnessCommitmentHeader...), h[:]...)})
+	}
+	cb.SetHash(nil)
+
+	bits := ch.GetNextWorkRequired(last, tim)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(chain.VERSIONBITS_TOP_BITS))
+	buf.Write(last.BlockHash.Hash[:])
+	buf.Write(btc.GetMerkel(txs))
+	binary.Write(buf, binary.LittleEndian, tim)
+	binary.Write(buf, binary.LittleEndian, bits)
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	btc.WriteVlen(buf, uint64(len(txs)))
+	for i := range txs {
+		buf.Write(txs[i].Serialize())
+	}
+	raw := buf.Bytes()
+
+	target := btc.SetCompact(bits)
+	for nonce := uint32(1); btc.NewSha2Hash(raw[:80]).BigInt().Cmp(target) > 0; nonce++ {
+		if nonce == 0 {
+			return nil, errors.New("GenerateBlock: nonce space exhausted")
+		}
+		binary.LittleEndian.PutUint32(raw[76:80], nonce)
+	}
+
+	return btc.NewBlock(raw)
+}
+
+// Generates n blocks paying to the given address, or to the first one of the current wallet.
+// Returns hashes of the blocks that have been accepted. Call it from the blockchain thread.
+func GenerateBlocks(n int, addr string) (res []*btc.Uint256, e error) {
+	if common.Params != &btc.RegTestParams {
+		e = errors.New("Blocks can only be generated in regtest mode")
+		return
+	}
+
+	var ad *btc.BtcAddr
+	if addr != "" {
+		if ad, e = btc.NewAddrFromString(addr); e != nil {
+			return
+		}
+	} else if wallet.MyWallet != nil && len(wallet.MyWallet.Addrs) > 0 {
+		ad = wallet.MyWallet.Addrs[0]
+	} else {
+		e = errors.New("No address given and no wallet loaded")
+		return
+	}
+	if ad.StealthAddr != nil {
+		e = errors.New("Cannot generate coins to a stealth address")
+		return
+	}
+	pkscr := ad.OutScript()
+
+	for i := 0; i < n; i++ {
+		var bl *btc.Block
+		if bl, e = GenerateBlock(pkscr); e != nil {
+			return
+		}
+		if e = ProcessLocalBlock(bl); e != nil {
+			return
+		}
+		res = append(res, bl.Hash)
+	}
+	return
+}
@@ -77,7 +77,7 @@ func list_unspent(addr string) {
 					uo.TxPrevOut.Vout = uint32(i + 1)
 					uo.Value = out.Value
 					uo.MinedAt = tx.InBlock
-					uo.BtcAddr = btc.NewAddrFromHash160(h160[:], btc.AddrVerPubkey(common.CFG.Testnet))
+					uo.BtcAddr = btc.NewAddrFromHash160(h160[:], common.Params.AddrVerPubkey)
 					uo.FixDestString()
 					uo.BtcAddr.StealthAddr = sa
 					uo.BtcAddr.Extra = ad.Extra
@@ -185,7 +185,7 @@ func do_scan_stealth(p string, ignore_prefix bool) {
 		fmt.Println("Specify base58 encoded stealth address")
 		return
 	}
-	if sa.Version != btc.StealthAddressVersion(common.Testnet) {
+	if sa.Version != common.Params.AddrVerStealth {
 		fmt.Println("Incorrect version of the stealth address")
 		return
 	}
@@ -236,7 +236,7 @@ func do_scan_stealth(p string, ignore_prefix bool) {
 				uo.TxPrevOut.Vout = uint32(i + 1)
 				uo.Value = out.Value
 				uo.MinedAt = tx.InBlock
-				uo.BtcAddr = btc.NewAddrFromHash160(h160[:], btc.AddrVerPubkey(common.CFG.Testnet))
+				uo.BtcAddr = btc.NewAddrFromHash160(h160[:], common.Params.AddrVerPubkey)
 				uo.FixDestString()
 				uo.BtcAddr.StealthAddr = sa
 				uo.BtcAddr.Extra = ad.Extra
@@ -312,7 +312,7 @@ func listarmkeys(p string) {
 				pk := btc.PublicFromPrivate(wallet.StealthSecrets[i], true)
 				fmt.Print(" #", i, "  ", hex.EncodeToString(pk))
 				if p == "addr" {
-					fmt.Print("  ", btc.NewAddrFromPubkey(pk, btc.AddrVerPubkey(common.Testnet)).String())
+					fmt.Print("  ", btc.NewAddrFromPubkey(pk, common.Params.AddrVerPubkey).String())
 				}
 				fmt.Println()
 			}
@@ -327,7 +327,7 @@ func listarmkeys(p string) {
 				pk := btc.PublicFromPrivate(wallet.ArmedStealthSecrets[i], true)
 				fmt.Print(" #", i, "  ", hex.EncodeToString(pk))
 				if p == "addr" {
-					fmt.Print("  ", btc.NewAddrFromPubkey(pk, btc.AddrVerPubkey(common.Testnet)).String())
+					fmt.Print("  ", btc.NewAddrFromPubkey(pk, common.Params.AddrVerPubkey).String())
 				}
 				if p == "save" {
 					fn := common.GocoinHomeDir + "wallet/stealth/" + hex.EncodeToString(pk)
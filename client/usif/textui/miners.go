@@ -5,9 +5,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/wchh/gocoin/client/common"
+	"github.com/wchh/gocoin/client/usif"
 	"github.com/wchh/gocoin/lib/btc"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -126,7 +128,32 @@ func set_miner(p string) {
 	common.UnlockCfg()
 }
 
+func generate_blocks(p string) {
+	ps := strings.Fields(p)
+	if len(ps) < 1 || len(ps) > 2 {
+		fmt.Println("Specify number of blocks and optionally the address to pay to")
+		return
+	}
+	n, e := strconv.ParseUint(ps[0], 10, 32)
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+	var addr string
+	if len(ps) > 1 {
+		addr = ps[1]
+	}
+	hashes, e := usif.GenerateBlocks(int(n), addr)
+	for i := range hashes {
+		fmt.Println(hashes[i].String())
+	}
+	if e != nil {
+		fmt.Println("Generate failed:", e.Error())
+	}
+}
+
 func init() {
+	newUi("generate gen", true, generate_blocks, "Mine N blocks in regtest mode. Optionally specify address for the coinbase (default: first one in the wallet)")
 	newUi("minerset mid", false, set_miner, "Setup the mining monitor with the given ID, or off to disable the monitor")
 	newUi("minerstat m", false, do_mining, "Look for the miner ID in recent blocks (optionally specify number of hours)")
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/wchh/gocoin/client/usif"
 	"github.com/wchh/gocoin/lib"
 	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/chain"
 	"github.com/wchh/gocoin/lib/others/peersdb"
 	"github.com/wchh/gocoin/lib/others/sys"
 	"github.com/wchh/gocoin/lib/qdb"
@@ -138,8 +139,16 @@ func show_info(par string) {
 		common.Last.Block.Height,
 		time.Unix(int64(common.Last.Block.Timestamp()), 0).Format("2006/01/02 15:04:05"),
 		btc.GetDifficulty(common.Last.Block.Bits()), time.Now().Sub(common.Last.Time).String())
+	last := common.Last.Block
 	common.Last.Mutex.Unlock()
 
+	for i := range common.BlockChain.Params.Deployments {
+		d := &common.BlockChain.Params.Deployments[i]
+		st, sig, cnt := common.BlockChain.DeploymentStats(last, i)
+		fmt.Printf("Deployment %s (bit %d): %s,  signalled by %d of %d blocks in this period\n",
+			d.Name, d.Bit, chain.VBStateNames[st], sig, cnt)
+	}
+
 	network.Mutex_net.Lock()
 	fmt.Printf("BlocksCached: %d,  NetQueueSize: %d,  NetConns: %d,  Peers: %d\n",
 		len(network.CachedBlocks), len(network.NetBlocks), len(network.OpenCons), peersdb.PeerDB.Count())
@@ -151,6 +160,8 @@ func show_info(par string) {
 		len(network.TransactionsPending), len(network.NetTxs))
 	fmt.Printf("WaitingForInputs:%d,  SpentOutputs:%d,  Hashrate:%s\n",
 		len(network.WaitingForInputs), len(network.SpentOutputs), usif.GetNetworkHashRate())
+	fmt.Printf("TransactionsToSendSize:%d/%dMB,  MinFee:%.3f SPB\n", network.TransactionsToSendSize>>20,
+		common.CFG.TXPool.MaxSizeMB, float64(network.MinFeeSPKB())/1000)
 	network.TxMutex.Unlock()
 
 	common.PrintStats()
@@ -283,6 +294,22 @@ func dump_block(s string) {
 	fmt.Println("Block saved to file:", fn)
 }
 
+func save_utxo(par string) {
+	fn := strings.TrimSpace(par)
+	if fn == "" {
+		fn = fmt.Sprint("utxo-", common.BlockChain.Unspent.LastBlockHeight, ".snap")
+	}
+	fmt.Println("Saving UTXO snapshot to", fn, "...")
+	hdr, e := common.BlockChain.Unspent.ExportSnapshot(fn)
+	if e != nil {
+		println(e.Error())
+		return
+	}
+	fmt.Println(hdr.Records, "records of block", hdr.Height, hdr.BlockHash.String(), "saved")
+	fmt.Println("Snapshot's hash:", hdr.Hash.String())
+	fmt.Println("To load it, set UtxoSnapshotHash to this value and run the node with -loadutxo=<file>")
+}
+
 func ui_quit(par string) {
 	usif.Exit_now = true
 }
@@ -445,6 +472,20 @@ func coins_age(s string) {
 	common.BlockChain.Unspent.PrintCoinAge()
 }
 
+func utxo_info(s string) {
+	st := common.BlockChain.Unspent.GetUtxoStats()
+	fmt.Println("Height:", st.Height)
+	if st.BlockHash != nil {
+		fmt.Println("Best block:", st.BlockHash.String())
+	}
+	fmt.Println("Transactions:", st.Transactions)
+	fmt.Println("Outputs:", st.Outputs)
+	fmt.Println("Total amount:", btc.UintToBtc(st.TotalAmount), "BTC")
+	fmt.Println("Bogo size:", st.BogoSize)
+	fmt.Println("Serialized size:", st.SerializedSize, "bytes")
+	fmt.Println("MuHash:", st.MuHash.String())
+}
+
 func init() {
 	newUi("age", true, coins_age, "Show age of records in UTXO database")
 	newUi("alerts a", false, list_alerst, "Show received alerts")
@@ -465,4 +506,6 @@ func init() {
 	newUi("quit q", true, ui_quit, "Exit nicely, saving all files. Otherwise use Ctrl+C")
 	newUi("savebl", false, dump_block, "Saves a block with a given hash to a binary file")
 	newUi("ulimit ul", false, set_ulmax, "Set maximum upload speed. The value is in KB/second - 0 for unlimited")
+	newUi("utxoinfo", true, utxo_info, "Show statistics of the UTXO set, with its MuHash (like gettxoutsetinfo)")
+	newUi("utxosave", true, save_utxo, "Save the UTXO set to a snapshot file (optionally specify its name)")
 }
@@ -2,10 +2,13 @@ package textui
 
 import (
 	"fmt"
+	"github.com/wchh/gocoin/client/common"
 	"github.com/wchh/gocoin/client/network"
 	"github.com/wchh/gocoin/client/usif"
 	"github.com/wchh/gocoin/lib/btc"
+	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -77,13 +80,14 @@ func del_tx(par string) {
 		return
 	}
 	network.TxMutex.Lock()
-	if _, ok := network.TransactionsToSend[txid.BIdx()]; !ok {
+	ptx, ok := network.TransactionsToSend[txid.BIdx()]
+	if !ok {
 		network.TxMutex.Unlock()
 		fmt.Println("No such transaction ID in the memory pool.")
 		list_txs("")
 		return
 	}
-	delete(network.TransactionsToSend, txid.BIdx())
+	network.DeleteToSend(ptx)
 	network.TxMutex.Unlock()
 	fmt.Println("Transaction", txid.String(), "removed from the memory pool")
 }
@@ -103,6 +107,30 @@ func dec_tx(par string) {
 	}
 }
 
+func find_tx(par string) {
+	ps := strings.SplitN(par, " ", 2)
+	txid := btc.NewUint256FromString(ps[0])
+	if txid == nil {
+		fmt.Println("You must specify a valid transaction ID for this command.")
+		return
+	}
+	tx, raw, height, e := common.BlockChain.GetTx(txid)
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+	fmt.Println("Transaction", txid.String(), "confirmed in block", height)
+	s, _, _, _, _ := usif.DecodeTx(tx)
+	fmt.Println(s)
+	if len(ps) == 2 {
+		if e = ioutil.WriteFile(ps[1], raw, 0600); e != nil {
+			fmt.Println(e.Error())
+		} else {
+			fmt.Println("Raw transaction saved to", ps[1])
+		}
+	}
+}
+
 func list_txs(par string) {
 	fmt.Println("Transactions in the memory pool:")
 	cnt := 0
@@ -124,7 +152,7 @@ func list_txs(par string) {
 			snt = fmt.Sprintf("TX sent %d times, last %s ago", v.SentCnt,
 				time.Now().Sub(v.Lastsent).String())
 		}
-		fmt.Printf("%5d) %s - %d bytes - %s%s\n", cnt, v.Tx.Hash.String(), len(v.Data), snt, oe)
+		fmt.Printf("%5d) %s - %d bytes - %d sigops - %s%s\n", cnt, v.Tx.Hash.String(), len(v.Data), v.SigopsCost, snt, oe)
 	}
 	network.TxMutex.Unlock()
 }
@@ -160,6 +188,7 @@ func init() {
 	newUi("txsendall stxa", true, send_all_tx, "Broadcast all the transactions (what you see after ltx)")
 	newUi("txdel dtx", true, del_tx, "Remove a transaction from memory pool (identified by a given <txid>)")
 	newUi("txdecode td", true, dec_tx, "Decode a transaction from memory pool (identified by a given <txid>)")
+	newUi("txfind ftx", true, find_tx, "Find a transaction in the chain (needs -txindex) by its <txid> and decode it. Optionally save it to a given file")
 	newUi("txlist ltx", true, list_txs, "List all the transaction loaded into memory pool")
 	newUi("txlistban ltxb", true, baned_txs, "List the transaction that we have rejected")
 }
@@ -49,7 +49,7 @@ func DecodeTx(tx *btc.Tx) (s string, missinginp bool, totinp, totout uint64, e e
 			}
 		}
 		if po != nil {
-			ok := script.VerifyTxScript(tx.TxIn[i].ScriptSig, po.Pk_script, i, tx, script.VER_P2SH|script.VER_DERSIG)
+			ok := script.VerifyTxScript(tx.TxIn[i].ScriptSig, po.Pk_script, po.Value, i, tx, script.STANDARD_VERIFY_FLAGS)
 			if !ok {
 				s += fmt.Sprintln("\nERROR: The transacion does not have a valid signature.")
 				e = errors.New("Invalid signature")
@@ -58,7 +58,7 @@ func DecodeTx(tx *btc.Tx) (s string, missinginp bool, totinp, totout uint64, e e
 			totinp += po.Value
 
 			ads := "???"
-			if ad := btc.NewAddrFromPkScript(po.Pk_script, common.Testnet); ad != nil {
+			if ad := btc.NewAddrFromPkScript(po.Pk_script, common.Params); ad != nil {
 				ads = ad.String()
 			}
 			s += fmt.Sprintf(" %15.8f BTC @ %s\n", float64(po.Value)/1e8, ads)
@@ -70,7 +70,7 @@ func DecodeTx(tx *btc.Tx) (s string, missinginp bool, totinp, totout uint64, e e
 	s += fmt.Sprintln(len(tx.TxOut), "Output(s):")
 	for i := range tx.TxOut {
 		totout += tx.TxOut[i].Value
-		adr := btc.NewAddrFromPkScript(tx.TxOut[i].Pk_script, common.Testnet)
+		adr := btc.NewAddrFromPkScript(tx.TxOut[i].Pk_script, common.Params)
 		if adr != nil {
 			s += fmt.Sprintf(" %15.8f BTC to adr %s\n", float64(tx.TxOut[i].Value)/1e8, adr.String())
 		} else {
@@ -99,7 +99,7 @@ func LoadRawTx(buf []byte) (s string) {
 		s += fmt.Sprintln("Could not decode transaction file or it has some extra data")
 		return
 	}
-	tx.Hash = btc.NewSha2Hash(txd)
+	tx.SetHash(txd)
 
 	network.TxMutex.Lock()
 	defer network.TxMutex.Unlock()
@@ -116,11 +116,11 @@ func LoadRawTx(buf []byte) (s string) {
 	}
 
 	if missinginp {
-		network.TransactionsToSend[tx.Hash.BIdx()] = &network.OneTxToSend{Tx: tx, Data: txd, Own: 2, Firstseen: time.Now(),
-			Volume: totout}
+		network.AddToSend(&network.OneTxToSend{Tx: tx, Data: txd, Own: 2, Firstseen: time.Now(),
+			Volume: totout})
 	} else {
-		network.TransactionsToSend[tx.Hash.BIdx()] = &network.OneTxToSend{Tx: tx, Data: txd, Own: 1, Firstseen: time.Now(),
-			Volume: totinp, Fee: totinp - totout}
+		network.AddToSend(&network.OneTxToSend{Tx: tx, Data: txd, Own: 1, Firstseen: time.Now(),
+			Volume: totinp, Fee: totinp - totout})
 	}
 	s += fmt.Sprintln("Transaction added to the memory pool. Please double check its details above.")
 	s += fmt.Sprintln("If it does what you intended, you can send it the network.\nUse TxID:", tx.Hash.String())
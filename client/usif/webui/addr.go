@@ -0,0 +1,89 @@
+package webui
+
+import (
+	"encoding/json"
+	"github.com/wchh/gocoin/client/common"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/chain"
+	"html"
+	"net/http"
+	"strings"
+)
+
+func p_addr(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+	s := load_template("addr.html")
+	var addr string
+	if len(r.Form["addr"]) > 0 {
+		addr = strings.TrimSpace(r.Form["addr"][0])
+	}
+	s = strings.Replace(s, "{ADDR}", html.EscapeString(addr), 1)
+	write_html_head(w, r)
+	w.Write([]byte(s))
+	write_html_tail(w)
+}
+
+func json_addr(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+
+	type one_out struct {
+		Txid         string
+		Vout         uint32
+		Height       uint32
+		Value        uint64
+		Spent_by     string `json:",omitempty"`
+		Spent_height uint32 `json:",omitempty"`
+	}
+
+	var out struct {
+		Addr     string
+		Height   uint32
+		Balance  uint64
+		Received uint64
+		Unspent  int
+		Outs     []one_out
+		Error    string `json:",omitempty"`
+	}
+
+	if len(r.Form["addr"]) > 0 {
+		out.Addr = strings.TrimSpace(r.Form["addr"][0])
+	}
+
+	var recs []*chain.AddrOut
+	if common.BlockChain.AddrIndex == nil {
+		out.Error = "Address index is not enabled (see -addrindex)"
+	} else if ad, e := btc.NewAddrFromString(out.Addr); e != nil {
+		out.Error = e.Error()
+	} else {
+		recs, out.Height = common.BlockChain.AddrIndex.Get(ad.OutScript())
+	}
+
+	out.Outs = make([]one_out, len(recs))
+	for i, rec := range recs {
+		o := &out.Outs[i]
+		o.Txid = btc.NewUint256(rec.Hash[:]).String()
+		o.Vout = rec.Vout
+		o.Height = rec.Height
+		o.Value = rec.Value
+		out.Received += rec.Value
+		if rec.SpentBy != nil {
+			o.Spent_by = rec.SpentBy.String()
+			o.Spent_height = rec.SpentHeight
+		} else {
+			out.Balance += rec.Value
+			out.Unspent++
+		}
+	}
+
+	bx, er := json.Marshal(out)
+	if er == nil {
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(bx)
+	} else {
+		println(er.Error())
+	}
+}
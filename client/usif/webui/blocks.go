@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"github.com/wchh/gocoin/client/common"
 	"github.com/wchh/gocoin/client/network"
+	"github.com/wchh/gocoin/client/usif"
 	"github.com/wchh/gocoin/lib/btc"
+	"html"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -19,6 +22,32 @@ func p_blocks(w http.ResponseWriter, r *http.Request) {
 	blks := load_template("blocks.html")
 	onerow := load_template("blocks_row.html")
 
+	if common.Params == &btc.RegTestParams {
+		blks = strings.Replace(blks, "{REGTEST}", "true", 1)
+		if checksid(r) && len(r.Form["generate"]) > 0 {
+			var e error
+			n, _ := strconv.ParseUint(r.Form["generate"][0], 10, 32)
+			req := &usif.OneUiReq{}
+			req.Done.Add(1)
+			req.Handler = func(string) {
+				var addr string
+				if len(r.Form["genaddr"]) > 0 {
+					addr = strings.TrimSpace(r.Form["genaddr"][0])
+				}
+				_, e = usif.GenerateBlocks(int(n), addr)
+			}
+			usif.UiChannel <- req
+			req.Done.Wait()
+			if e == nil {
+				http.Redirect(w, r, "blocks", http.StatusFound)
+				return
+			}
+			blks = strings.Replace(blks, "<!--GENERATE_ERROR-->", html.EscapeString(e.Error()), 1)
+		}
+	} else {
+		blks = strings.Replace(blks, "{REGTEST}", "false", 1)
+	}
+
 	common.Last.Mutex.Lock()
 	end := common.Last.Block
 	common.Last.Mutex.Unlock()
@@ -8,6 +8,7 @@ import (
 	"github.com/wchh/gocoin/client/usif"
 	"github.com/wchh/gocoin/client/wallet"
 	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/chain"
 	"github.com/wchh/gocoin/lib/others/peersdb"
 	"github.com/wchh/gocoin/lib/others/sys"
 	"github.com/wchh/gocoin/lib/qdb"
@@ -45,6 +46,18 @@ func p_home(w http.ResponseWriter, r *http.Request) {
 
 	s = strings.Replace(s, "<--NETWORK_HASHRATE-->", usif.GetNetworkHashRate(), 1)
 
+	common.Last.Mutex.Lock()
+	last := common.Last.Block
+	common.Last.Mutex.Unlock()
+	var deps string
+	for i := range common.BlockChain.Params.Deployments {
+		d := &common.BlockChain.Params.Deployments[i]
+		st, sig, cnt := common.BlockChain.DeploymentStats(last, i)
+		deps += fmt.Sprintf("<tr><td>%s<td>bit %d<td><b>%s</b><td>%d / %d blocks signalled in this period\n",
+			d.Name, d.Bit, chain.VBStateNames[st], sig, cnt)
+	}
+	s = strings.Replace(s, "<!--DEPLOYMENTS-->", deps, 1)
+
 	common.LockCfg()
 	dat, _ := json.Marshal(&common.CFG)
 	common.UnlockCfg()
@@ -102,7 +102,7 @@ func p_miners(w http.ResponseWriter, r *http.Request) {
 		for o := range cbasetx.TxOut {
 			rew += cbasetx.TxOut[o].Value
 		}
-		om.fees += rew - btc.GetBlockReward(end.Height)
+		om.fees += rew - common.Params.BlockReward(end.Height)
 
 		// bip-100
 		res := bip100x.Find(cbasetx.TxIn[0].ScriptSig)
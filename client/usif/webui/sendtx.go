@@ -105,7 +105,7 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 						}
 						pay_cmd += addr.Enc58str + "=" + btc.UintToBtc(am)
 
-						outs, er := btc.NewSpendOutputs(addr, am, common.CFG.Testnet)
+						outs, er := btc.NewSpendOutputs(addr, am, common.Params)
 						if er != nil {
 							err = er.Error()
 							goto error
@@ -150,7 +150,7 @@ func dl_payment(w http.ResponseWriter, r *http.Request) {
 
 		if totalinput > spentsofar {
 			// Add change output
-			outs, er := btc.NewSpendOutputs(change_addr, totalinput-spentsofar, common.CFG.Testnet)
+			outs, er := btc.NewSpendOutputs(change_addr, totalinput-spentsofar, common.Params)
 			if er != nil {
 				err = er.Error()
 				goto error
@@ -283,6 +283,13 @@ func p_snd(w http.ResponseWriter, r *http.Request) {
 
 		wal = strings.Replace(wal, "/*WALLET_ENTRY_JS*/", "const ADDR_LIST_SIZE = "+fmt.Sprint(common.CFG.WebUI.AddrListLen), 1)
 
+		// Fee estimates, to prefill the transaction fee
+		for _, fe := range feeEstimates(FeeEstTargets) {
+			if fe.Fee_spkb > 0 {
+				wal = templ_add(wal, "/*FEE_ESTIMATES_JS*/", fmt.Sprint("fee_est.push({'blocks':", fe.Blocks, ", 'spkb':", fe.Fee_spkb, "})\n"))
+			}
+		}
+
 		s = strings.Replace(s, "<!--WALLET-->", wal, 1)
 	} else {
 		if wallet.MyWallet == nil {
@@ -2,6 +2,7 @@ package webui
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/wchh/gocoin/client/common"
 	"github.com/wchh/gocoin/client/network"
@@ -10,8 +11,10 @@ import (
 	"github.com/wchh/gocoin/lib/script"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -90,7 +93,7 @@ func output_tx_xml(w http.ResponseWriter, id string) {
 				po, _ = common.BlockChain.Unspent.UnspentGet(&tx.TxIn[i].Input)
 			}
 			if po != nil {
-				ok := script.VerifyTxScript(tx.TxIn[i].ScriptSig, po.Pk_script, i, tx, script.VER_P2SH|script.VER_DERSIG)
+				ok := script.VerifyTxScript(tx.TxIn[i].ScriptSig, po.Pk_script, po.Value, i, tx, script.STANDARD_VERIFY_FLAGS)
 				if !ok {
 					w.Write([]byte("<status>Script FAILED</status>"))
 				} else {
@@ -98,7 +101,7 @@ func output_tx_xml(w http.ResponseWriter, id string) {
 				}
 				fmt.Fprint(w, "<value>", po.Value, "</value>")
 				ads := "???"
-				if ad := btc.NewAddrFromPkScript(po.Pk_script, common.Testnet); ad != nil {
+				if ad := btc.NewAddrFromPkScript(po.Pk_script, common.Params); ad != nil {
 					ads = ad.String()
 				}
 				fmt.Fprint(w, "<addr>", ads, "</addr>")
@@ -114,7 +117,7 @@ func output_tx_xml(w http.ResponseWriter, id string) {
 		for i := range tx.TxOut {
 			w.Write([]byte("<output>"))
 			fmt.Fprint(w, "<value>", tx.TxOut[i].Value, "</value>")
-			adr := btc.NewAddrFromPkScript(tx.TxOut[i].Pk_script, common.Testnet)
+			adr := btc.NewAddrFromPkScript(tx.TxOut[i].Pk_script, common.Params)
 			if adr != nil {
 				fmt.Fprint(w, "<addr>", adr.String(), "</addr>")
 			} else {
@@ -139,7 +142,9 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 			tid := btc.NewUint256FromString(r.Form["del"][0])
 			if tid != nil {
 				network.TxMutex.Lock()
-				delete(network.TransactionsToSend, tid.BIdx())
+				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok {
+					network.DeleteToSend(ptx)
+				}
 				network.TxMutex.Unlock()
 			}
 		}
@@ -202,6 +207,7 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "<sentlast>", v.Lastsent.Unix(), "</sentlast>")
 		fmt.Fprint(w, "<volume>", v.Volume, "</volume>")
 		fmt.Fprint(w, "<fee>", v.Fee, "</fee>")
+		fmt.Fprint(w, "<sigops>", v.SigopsCost, "</sigops>")
 		fmt.Fprint(w, "<blocked>", v.Blocked, "</blocked>")
 		w.Write([]byte("</tx>"))
 	}
@@ -229,6 +235,28 @@ func xml_txsre(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("</txbanned>"))
 }
 
+func xml_txrbf(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+
+	w.Header()["Content-Type"] = []string{"text/xml"}
+	w.Write([]byte("<txreplaced>"))
+	network.TxMutex.Lock()
+	for _, v := range network.TransactionsReplaced {
+		w.Write([]byte("<tx>"))
+		fmt.Fprint(w, "<id>", v.Id.String(), "</id>")
+		fmt.Fprint(w, "<time>", v.Time.Unix(), "</time>")
+		fmt.Fprint(w, "<len>", v.Size, "</len>")
+		fmt.Fprint(w, "<fee>", v.Fee, "</fee>")
+		fmt.Fprint(w, "<by>", v.By.String(), "</by>")
+		fmt.Fprint(w, "<descendant>", v.Descendant, "</descendant>")
+		w.Write([]byte("</tx>"))
+	}
+	network.TxMutex.Unlock()
+	w.Write([]byte("</txreplaced>"))
+}
+
 func xml_txw4i(w http.ResponseWriter, r *http.Request) {
 	if !ipchecker(r) {
 		return
@@ -277,9 +305,40 @@ func raw_tx(w http.ResponseWriter, r *http.Request) {
 	}
 
 	txid := btc.NewUint256FromString(r.Form["id"][0])
+	if txid == nil {
+		fmt.Fprintln(w, "Invalid TxID")
+		return
+	}
+
+	var tx *btc.Tx
+	var raw []byte
+	var inblock string
+	network.TxMutex.Lock()
+	if t2s, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+		tx, raw = t2s.Tx, t2s.Data
+	}
+	network.TxMutex.Unlock()
+	if tx == nil {
+		// Not in the memory pool - check the transaction index
+		if t, rtx, height, e := common.BlockChain.GetTx(txid); e == nil {
+			tx, raw = t, rtx
+			inblock = fmt.Sprint("Confirmed in block: ", height)
+		}
+	}
+
+	if len(r.Form["hex"]) > 0 {
+		if tx != nil {
+			fmt.Fprintln(w, hex.EncodeToString(raw))
+		}
+		return
+	}
+
 	fmt.Fprintln(w, "TxID:", txid.String())
-	if tx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
-		s, _, _, _, _ := usif.DecodeTx(tx.Tx)
+	if tx != nil {
+		if inblock != "" {
+			fmt.Fprintln(w, inblock)
+		}
+		s, _, _, _, _ := usif.DecodeTx(tx)
 		w.Write([]byte(s))
 	} else {
 		fmt.Fprintln(w, "Not found")
@@ -297,8 +356,11 @@ func json_txstat(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte(fmt.Sprint("\"t2s_cnt\":", len(network.TransactionsToSend), ",")))
 	w.Write([]byte(fmt.Sprint("\"t2s_size\":", network.TransactionsToSendSize, ",")))
+	w.Write([]byte(fmt.Sprint("\"t2s_max_size\":", uint64(atomic.LoadUint32(&common.CFG.TXPool.MaxSizeMB))<<20, ",")))
+	w.Write([]byte(fmt.Sprint("\"min_fee_spkb\":", network.MinFeeSPKB(), ",")))
 	w.Write([]byte(fmt.Sprint("\"tre_cnt\":", len(network.TransactionsRejected), ",")))
 	w.Write([]byte(fmt.Sprint("\"tre_size\":", network.TransactionsRejectedSize, ",")))
+	w.Write([]byte(fmt.Sprint("\"replaced_cnt\":", network.TransactionsReplacedCnt, ",")))
 	w.Write([]byte(fmt.Sprint("\"ptr1_cnt\":", len(network.TransactionsPending), ",")))
 	w.Write([]byte(fmt.Sprint("\"ptr2_cnt\":", len(network.NetTxs), ",")))
 	w.Write([]byte(fmt.Sprint("\"spent_outs_cnt\":", len(network.SpentOutputs), ",")))
@@ -308,3 +370,54 @@ func json_txstat(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte("}\n"))
 }
+
+// Targets (in blocks) for which the fee estimates are shown by default
+var FeeEstTargets = []int{1, 2, 3, 6, 12, 24, network.FeeEstMaxBlocks}
+
+type oneFeeEst struct {
+	Blocks   int
+	Fee_spkb uint64 // satoshis per 1000 vbytes, 0 if not known yet
+}
+
+func feeEstimates(targets []int) (res []oneFeeEst) {
+	network.TxMutex.Lock()
+	for _, n := range targets {
+		res = append(res, oneFeeEst{Blocks: n, Fee_spkb: network.EstimateFee(n)})
+	}
+	network.TxMutex.Unlock()
+	return
+}
+
+func json_feeest(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+
+	var out struct {
+		Height    uint32
+		Estimates []oneFeeEst
+	}
+
+	targets := FeeEstTargets
+	if len(r.Form["blocks"]) > 0 {
+		n, er := strconv.ParseUint(r.Form["blocks"][0], 10, 32)
+		if er != nil || n < 1 || n > network.FeeEstMaxBlocks {
+			http.Error(w, "Bad number of blocks", http.StatusBadRequest)
+			return
+		}
+		targets = []int{int(n)}
+	}
+
+	common.Last.Mutex.Lock()
+	out.Height = common.Last.Block.Height
+	common.Last.Mutex.Unlock()
+	out.Estimates = feeEstimates(targets)
+
+	bx, er := json.Marshal(out)
+	if er == nil {
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(bx)
+	} else {
+		println(er.Error())
+	}
+}
@@ -185,7 +185,7 @@ func p_wal(w http.ResponseWriter, r *http.Request) {
 				ad = strings.Replace(ad, "<!--WAL_MULTISIG-->", "No", 1)
 			}
 
-			rec := wallet.CachedAddrs[wallet.MyWallet.Addrs[i].Hash160]
+			rec := wallet.CachedAddrs[wallet.AddrKey(wallet.MyWallet.Addrs[i])]
 			if rec == nil {
 				ad = strings.Replace(ad, "<!--WAL_BALANCE-->", "?", 1)
 				ad = strings.Replace(ad, "<!--WAL_OUTCNT-->", "?", 1)
@@ -7,6 +7,7 @@ import (
 	"github.com/wchh/gocoin/client/common"
 	"github.com/wchh/gocoin/client/wallet"
 	"github.com/wchh/gocoin/lib"
+	"github.com/wchh/gocoin/lib/btc"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -22,6 +23,7 @@ var webuimenu = [][2]string{
 	{"/net", "Network"},
 	{"/txs", "Transactions"},
 	{"/blocks", "Blocks"},
+	{"/addr", "Address"},
 	{"/miners", "Miners"},
 	{"/counts", "Counters"},
 }
@@ -141,8 +143,8 @@ func write_html_head(w http.ResponseWriter, r *http.Request) {
 	} else {
 		s = strings.Replace(s, "{HELPURL}", "help", 1)
 	}
-	if common.Testnet {
-		s = strings.Replace(s, "{TESTNET}", "Testnet ", 1)
+	if common.Params != &btc.MainNetParams {
+		s = strings.Replace(s, "{TESTNET}", strings.Title(common.Params.Name)+" ", 1)
 	} else {
 		s = strings.Replace(s, "{TESTNET}", "", 1)
 	}
@@ -219,6 +221,7 @@ func ServerThread(iface string) {
 	http.HandleFunc("/net", p_net)
 	http.HandleFunc("/txs", p_txs)
 	http.HandleFunc("/blocks", p_blocks)
+	http.HandleFunc("/addr", p_addr)
 	http.HandleFunc("/miners", p_miners)
 	http.HandleFunc("/counts", p_counts)
 	http.HandleFunc("/cfg", p_cfg)
@@ -226,6 +229,7 @@ func ServerThread(iface string) {
 
 	http.HandleFunc("/txs2s.xml", xml_txs2s)
 	http.HandleFunc("/txsre.xml", xml_txsre)
+	http.HandleFunc("/txrbf.xml", xml_txrbf)
 	http.HandleFunc("/txw4i.xml", xml_txw4i)
 	http.HandleFunc("/raw_tx", raw_tx)
 	http.HandleFunc("/balance.xml", xml_balance)
@@ -242,7 +246,9 @@ func ServerThread(iface string) {
 	http.HandleFunc("/system.json", json_system)
 	http.HandleFunc("/bwidth.json", json_bwidth)
 	http.HandleFunc("/txstat.json", json_txstat)
+	http.HandleFunc("/feeest.json", json_feeest)
 	http.HandleFunc("/netcon.json", json_netcon)
+	http.HandleFunc("/addr.json", json_addr)
 
 	http.ListenAndServe(iface, nil)
 }
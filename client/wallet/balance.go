@@ -2,7 +2,6 @@ package wallet
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"github.com/wchh/gocoin/client/common"
 	"github.com/wchh/gocoin/lib/btc"
@@ -22,7 +21,7 @@ var (
 	BalanceChanged bool
 	BalanceInvalid bool = true
 
-	CachedAddrs     map[[20]byte]*OneCachedAddrBalance = make(map[[20]byte]*OneCachedAddrBalance)
+	CachedAddrs     map[CachedAddrKey]*OneCachedAddrBalance = make(map[CachedAddrKey]*OneCachedAddrBalance)
 	CacheUnspent    []*OneCachedUnspent
 	CacheUnspentIdx map[uint64]*OneCachedUnspentIdx = make(map[uint64]*OneCachedUnspentIdx)
 )
@@ -37,6 +36,28 @@ type OneCachedUnspent struct {
 	chain.AllUnspentTx // a cache for unspent outputs (from different wallets)
 }
 
+// P2PKH, P2SH and P2WPKH addresses of the same key share Hash160, so the type is a part of the key
+type CachedAddrKey struct {
+	Hash160 [20]byte
+	Version byte // address version (witness version for segwit)
+	ProgLen byte // length of witness program (zero if not segwit)
+}
+
+func AddrKey(a *btc.BtcAddr) (k CachedAddrKey) {
+	if a.StealthAddr != nil {
+		copy(k.Hash160[:], a.StealthAddr.Hash160())
+		k.Version = a.StealthAddr.Version
+	} else if a.SegwitProg != nil {
+		k.Hash160 = a.Hash160
+		k.Version = byte(a.SegwitProg.Version)
+		k.ProgLen = byte(len(a.SegwitProg.Program))
+	} else {
+		k.Hash160 = a.Hash160
+		k.Version = a.Version
+	}
+	return
+}
+
 type OneCachedAddrBalance struct {
 	InWallet   bool
 	CacheIndex uint
@@ -75,13 +96,13 @@ check_next_address:
 						uo.TxPrevOut.Vout = uint32(idx)
 						uo.Value = out.Value
 						uo.MinedAt = tx.InBlock
-						uo.BtcAddr = btc.NewAddrFromHash160(h160[:], btc.AddrVerPubkey(common.CFG.Testnet))
+						uo.BtcAddr = btc.NewAddrFromHash160(h160[:], common.Params.AddrVerPubkey)
 						uo.FixDestString()
 						uo.BtcAddr.StealthAddr = sa
 						uo.BtcAddr.Extra = ad.addr.Extra
 						uo.StealthC = c
 
-						carec := CachedAddrs[ad.h160]
+						carec := CachedAddrs[AddrKey(ad.addr)]
 						carec.Value += uo.Value
 						CacheUnspent[carec.CacheIndex].AllUnspentTx = append(CacheUnspent[carec.CacheIndex].AllUnspentTx, uo)
 						CacheUnspentIdx[uo.TxPrevOut.UIdx()] = &OneCachedUnspentIdx{Index: carec.CacheIndex, Record: uo}
@@ -96,9 +117,9 @@ check_next_address:
 
 	not_stealth:
 		// Extract hash160 from pkscript
-		adr := btc.NewAddrFromPkScript(out.PKScr, common.Testnet)
+		adr := btc.NewAddrFromPkScript(out.PKScr, common.Params)
 		if adr != nil {
-			if carec, ok := CachedAddrs[adr.Hash160]; ok {
+			if carec, ok := CachedAddrs[AddrKey(adr)]; ok {
 				carec.Value += out.Value
 				utxo := new(chain.OneUnspentTx)
 				utxo.TxPrevOut.Hash = tx.TxID
@@ -143,7 +164,7 @@ func TxNotifyDel(txid []byte, outs []bool) {
 			ii := uidx.UIdx()
 			if ab, present := CacheUnspentIdx[ii]; present {
 				adrec := CacheUnspent[ab.Index]
-				rec := CachedAddrs[adrec.BtcAddr.Hash160]
+				rec := CachedAddrs[AddrKey(adrec.BtcAddr)]
 				if rec == nil {
 					panic("rec not found for " + adrec.BtcAddr.String())
 				}
@@ -174,15 +195,7 @@ func sync_wallet() {
 	if MyWallet != nil {
 		MyBalance = nil
 		for i := range MyWallet.Addrs {
-			var rec *OneCachedAddrBalance
-			if MyWallet.Addrs[i].StealthAddr != nil {
-				var h160 [20]byte
-				copy(h160[:], MyWallet.Addrs[i].StealthAddr.Hash160())
-				rec = CachedAddrs[h160]
-			} else {
-				rec = CachedAddrs[MyWallet.Addrs[i].Hash160]
-			}
-			if rec != nil {
+			if rec := CachedAddrs[AddrKey(MyWallet.Addrs[i])]; rec != nil {
 				MyBalance = append(MyBalance, CacheUnspent[rec.CacheIndex].AllUnspentTx...)
 			} else {
 				if MyWallet.Addrs[i].Extra.Wallet != AddrBookFileName {
@@ -305,7 +318,7 @@ func UpdateBalance() {
 func update_balance() {
 	var tofetch_stealh []*btc.BtcAddr
 	var tofetch_secrets [][]byte
-	tofetch_regular := make(map[uint64]*btc.BtcAddr)
+	tofetch_regular := make(map[CachedAddrKey]*btc.BtcAddr)
 
 	MyBalance = nil
 
@@ -316,7 +329,7 @@ func update_balance() {
 	FetchStealthKeys()
 
 	for i := range MyWallet.Addrs {
-		if rec, pres := CachedAddrs[MyWallet.Addrs[i].Hash160]; pres {
+		if rec, pres := CachedAddrs[AddrKey(MyWallet.Addrs[i])]; pres {
 			rec.InWallet = true
 			cu := CacheUnspent[rec.CacheIndex]
 			cu.BtcAddr = MyWallet.Addrs[i]
@@ -329,7 +342,7 @@ func update_balance() {
 			add_it := true
 			// Add a new address to the balance cache
 			if MyWallet.Addrs[i].StealthAddr == nil {
-				tofetch_regular[MyWallet.Addrs[i].AIdx()] = MyWallet.Addrs[i]
+				tofetch_regular[AddrKey(MyWallet.Addrs[i])] = MyWallet.Addrs[i]
 			} else {
 				sa := MyWallet.Addrs[i].StealthAddr
 				if ssecret := FindStealthSecret(sa); ssecret != nil {
@@ -348,7 +361,7 @@ func update_balance() {
 				}
 			}
 			if add_it {
-				CachedAddrs[MyWallet.Addrs[i].Hash160] = &OneCachedAddrBalance{InWallet: true, CacheIndex: uint(len(CacheUnspent))}
+				CachedAddrs[AddrKey(MyWallet.Addrs[i])] = &OneCachedAddrBalance{InWallet: true, CacheIndex: uint(len(CacheUnspent))}
 				CacheUnspent = append(CacheUnspent, &OneCachedUnspent{BtcAddr: MyWallet.Addrs[i]})
 			}
 		}
@@ -362,17 +375,28 @@ func update_balance() {
 		var out *chain.QdbTxOut
 		var h160 [20]byte
 
+		var k CachedAddrKey
 		common.BlockChain.Unspent.BrowseUTXO(true, func(tx *chain.QdbRec) {
 			for idx, rec := range tx.Outs {
 				if rec == nil {
 					continue
 				}
 				if rec.IsP2KH() {
-					if ad, ok := tofetch_regular[binary.LittleEndian.Uint64(rec.PKScr[3:3+8])]; ok {
+					copy(k.Hash160[:], rec.PKScr[3:23])
+					k.Version, k.ProgLen = common.Params.AddrVerPubkey, 0
+					if ad, ok := tofetch_regular[k]; ok {
 						new_addrs = append(new_addrs, tx.ToUnspent(uint32(idx), ad))
 					}
 				} else if rec.IsP2SH() {
-					if ad, ok := tofetch_regular[binary.LittleEndian.Uint64(rec.PKScr[2:2+8])]; ok {
+					copy(k.Hash160[:], rec.PKScr[2:22])
+					k.Version, k.ProgLen = common.Params.AddrVerScript, 0
+					if ad, ok := tofetch_regular[k]; ok {
+						new_addrs = append(new_addrs, tx.ToUnspent(uint32(idx), ad))
+					}
+				} else if ver, prog := btc.IsWitnessProgram(rec.PKScr); prog != nil {
+					copy(k.Hash160[:], prog)
+					k.Version, k.ProgLen = byte(ver), byte(len(prog))
+					if ad, ok := tofetch_regular[k]; ok && ad.Owns(rec.PKScr) {
 						new_addrs = append(new_addrs, tx.ToUnspent(uint32(idx), ad))
 					}
 				} else if idx < len(tx.Outs)-1 {
@@ -397,7 +421,7 @@ func update_balance() {
 									uo.TxPrevOut.Vout = uint32(idx + 1)
 									uo.Value = out.Value
 									uo.MinedAt = tx.InBlock
-									uo.BtcAddr = btc.NewAddrFromHash160(h160[:], btc.AddrVerPubkey(common.CFG.Testnet))
+									uo.BtcAddr = btc.NewAddrFromHash160(h160[:], common.Params.AddrVerPubkey)
 									uo.FixDestString()
 									uo.BtcAddr.StealthAddr = sa
 									uo.BtcAddr.Extra = ad.Extra
@@ -419,16 +443,9 @@ func update_balance() {
 				continue
 			}
 
-			var rec *OneCachedAddrBalance
-			if new_addrs[i].BtcAddr.StealthAddr != nil {
-				var h160 [20]byte
-				copy(h160[:], new_addrs[i].BtcAddr.StealthAddr.Hash160())
-				rec = CachedAddrs[h160]
-			} else {
-				rec = CachedAddrs[new_addrs[i].BtcAddr.Hash160]
-			}
+			rec := CachedAddrs[AddrKey(new_addrs[i].BtcAddr)]
 			if rec == nil {
-				println("Hash160 not in CachedAddrs for", new_addrs[i].BtcAddr.String())
+				println("Address not in CachedAddrs for", new_addrs[i].BtcAddr.String())
 				continue
 			}
 			rec.Value += new_addrs[i].Value
@@ -489,7 +506,7 @@ func LoadAllWallets() {
 					for an := range tmp.Addrs {
 						var fnd bool
 						for ao := range MyWallet.Addrs {
-							if MyWallet.Addrs[ao].Hash160 == tmp.Addrs[an].Hash160 {
+							if AddrKey(MyWallet.Addrs[ao]) == AddrKey(tmp.Addrs[an]) {
 								fnd = true
 								break
 							}
@@ -507,7 +524,7 @@ func LoadAllWallets() {
 
 	// All wallets loaded - setup the cache structures
 	for i := range MyWallet.Addrs {
-		if rec, pres := CachedAddrs[MyWallet.Addrs[i].Hash160]; pres {
+		if rec, pres := CachedAddrs[AddrKey(MyWallet.Addrs[i])]; pres {
 			cu := CacheUnspent[rec.CacheIndex]
 			cu.BtcAddr = MyWallet.Addrs[i]
 			for j := range cu.AllUnspentTx {
@@ -533,7 +550,7 @@ func LoadAllWallets() {
 				}
 			}
 			if add_it {
-				CachedAddrs[MyWallet.Addrs[i].Hash160] = &OneCachedAddrBalance{CacheIndex: uint(len(CacheUnspent))}
+				CachedAddrs[AddrKey(MyWallet.Addrs[i])] = &OneCachedAddrBalance{CacheIndex: uint(len(CacheUnspent))}
 				CacheUnspent = append(CacheUnspent, &OneCachedUnspent{BtcAddr: MyWallet.Addrs[i]})
 			}
 		}
@@ -17,7 +17,7 @@ type MultisigAddr struct {
 }
 
 func IsMultisig(ad *btc.BtcAddr) (yes bool, rec *MultisigAddr) {
-	yes = ad.Version == btc.AddrVerScript(common.Testnet)
+	yes = ad.Version == common.Params.AddrVerScript
 	if !yes {
 		return
 	}
@@ -53,8 +53,11 @@ func LoadWalfile(fn string, included int) (addrs []*btc.BtcAddr) {
 				var s string
 				if l[0] != '#' {
 					s = l
-				} else if !PrecachingComplete && len(l) > 10 && l[1] == '1' {
-					s = l[1:] // While pre-caching addresses, include ones that are commented out
+				} else if !PrecachingComplete && len(l) > 10 {
+					// While pre-caching addresses, include ones that are commented out
+					if _, er := btc.NewAddrFromString(strings.SplitN(l[1:], " ", 2)[0]); er == nil {
+						s = l[1:]
+					}
 				}
 				if s != "" {
 					ls := strings.SplitN(s, " ", 2)
@@ -82,7 +85,7 @@ func LoadWalfile(fn string, included int) (addrs []*btc.BtcAddr) {
 	// remove duplicated addresses
 	for i := 0; i < len(addrs)-1; i++ {
 		for j := i + 1; j < len(addrs); {
-			if addrs[i].Hash160 == addrs[j].Hash160 {
+			if AddrKey(addrs[i]) == AddrKey(addrs[j]) {
 				if addrs[i].StealthAddr != nil && !bytes.Equal(addrs[i].Prefix, addrs[j].Prefix) {
 					fmt.Println("WARNING: duplicate stealth addresses with different prefixes. Merging them into one with null-prefix")
 					fmt.Println(" -", addrs[i].PrefixLen(), addrs[i].String())
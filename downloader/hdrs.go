@@ -8,6 +8,7 @@ import (
 	"github.com/wchh/gocoin/lib/btc"
 	"github.com/wchh/gocoin/lib/chain"
 	"github.com/wchh/gocoin/lib/others/peersdb"
+	"math/big"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -68,7 +69,7 @@ func chkblock(bl *btc.Block) (er error) {
 	// Check proof of work
 	gnwr := MemBlockChain.GetNextWorkRequired(prevblk, bl.BlockTime())
 	if bl.Bits() != gnwr {
-		if !Testnet || ((prevblk.Height+1)%2016) != 0 {
+		if !Params.PowAllowMinDifficulty || ((prevblk.Height+1)%2016) != 0 {
 			MemBlockChainMutex.Unlock()
 			er = errors.New(fmt.Sprint("CheckBlock: Incorrect proof of work at block", prevblk.Height+1))
 			return
@@ -81,12 +82,13 @@ func chkblock(bl *btc.Block) (er error) {
 	cur.Height = prevblk.Height + 1
 	cur.TxCount = uint32(bl.TxCount)
 	copy(cur.BlockHeader[:], bl.Raw[:80])
+	cur.SumWork = new(big.Int).Add(prevblk.SumWork, chain.BlockWork(cur.Bits()))
 	prevblk.Childs = append(prevblk.Childs, cur)
 	MemBlockChain.BlockIndex[cur.BlockHash.BIdx()] = cur
 	MemBlockChainMutex.Unlock()
 
 	LastBlock.Mutex.Lock()
-	if cur.Height > LastBlock.node.Height {
+	if cur.SumWork.Cmp(LastBlock.node.SumWork) > 0 {
 		LastBlock.node = cur
 	}
 	LastBlock.Mutex.Unlock()
@@ -179,10 +181,12 @@ func get_headers() {
 
 func download_headers() {
 	os.RemoveAll("tmp/")
-	MemBlockChain = chain.NewChain("tmp/", TheBlockChain.BlockTreeEnd.BlockHash, false)
+	// The in-memory chain is rooted at the last block we have
+	params := *Params
+	params.Genesis = TheBlockChain.BlockTreeEnd.BlockHash
+	MemBlockChain = chain.NewChain("tmp/", &params, false)
 	defer os.RemoveAll("tmp/")
 
-	MemBlockChain.Genesis = GenesisBlock
 	*MemBlockChain.BlockTreeRoot = *TheBlockChain.BlockTreeEnd
 	fmt.Println("Loaded chain has height", MemBlockChain.BlockTreeRoot.Height,
 		MemBlockChain.BlockTreeRoot.BlockHash.String())
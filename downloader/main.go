@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -21,13 +22,12 @@ import (
 )
 
 var (
-	Magic         [4]byte = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
+	Params        *btc.ChainParams
 	StartTime     time.Time
 	TheBlockChain *chain.Chain
 
-	GenesisBlock *btc.Uint256 = btc.NewUint256FromString("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
-	TrustUpTo    uint32
-	globalexit   uint32
+	TrustUpTo  uint32
+	globalexit uint32
 
 	// CommandLineSwitches
 	LastTrustedBlock string // -trust
@@ -38,6 +38,9 @@ var (
 	SeedNode         string // -s
 	MemForBlocks     uint   // -m (in megabytes)
 	Testnet          bool   // -t
+	Regtest          bool   // -regtest
+	Signet           bool   // -signet
+	SignetChallenge  string // -signetchallenge
 )
 
 func GlobalExit() bool {
@@ -50,8 +53,11 @@ func Exit() {
 
 func parse_command_line() {
 	var CFG struct { // Options that can come from either command line or common file
-		Testnet bool
-		Datadir string
+		Testnet         bool
+		Regtest         bool
+		Signet          bool
+		SignetChallenge string
+		Datadir         string
 	}
 
 	GocoinHomeDir = sys.BitcoinHome() + "gocoin" + string(os.PathSeparator)
@@ -70,6 +76,9 @@ func parse_command_line() {
 
 	flag.BoolVar(&OnlyStoreBlocks, "b", false, "Only store blocks, without parsing them into UTXO database")
 	flag.BoolVar(&Testnet, "t", CFG.Testnet, "Use Testnet3")
+	flag.BoolVar(&Regtest, "regtest", CFG.Regtest, "Use Regtest")
+	flag.BoolVar(&Signet, "signet", CFG.Signet, "Use Signet")
+	flag.StringVar(&SignetChallenge, "signetchallenge", CFG.SignetChallenge, "Hex encoded block challenge script of a custom signet")
 	flag.StringVar(&GocoinHomeDir, "d", GocoinHomeDir, "Specify the home directory")
 	flag.StringVar(&LastTrustedBlock, "trust", "auto", "Specify the highest trusted block hash (use \"all\" for all)")
 	flag.StringVar(&SeedNode, "s", "", "Specify IP of the node to fetch headers from")
@@ -107,7 +116,7 @@ func open_blockchain() (abort bool) {
 			}
 		}
 	}()
-	TheBlockChain = chain.NewChain(GocoinHomeDir, GenesisBlock, false)
+	TheBlockChain = chain.NewChain(GocoinHomeDir, Params, false)
 	__exit <- true
 	return
 }
@@ -129,20 +138,31 @@ func main() {
 	if len(GocoinHomeDir) > 0 && GocoinHomeDir[len(GocoinHomeDir)-1] != os.PathSeparator {
 		GocoinHomeDir += string(os.PathSeparator)
 	}
-	if Testnet {
-		GocoinHomeDir += "tstnet" + string(os.PathSeparator)
-		Magic = [4]byte{0x0B, 0x11, 0x09, 0x07}
-		GenesisBlock = btc.NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
-		fmt.Println("Using testnet3")
+	if Regtest {
+		Params = &btc.RegTestParams
+	} else if Signet {
+		Params = &btc.SigNetParams
+		if SignetChallenge != "" {
+			chal, e := hex.DecodeString(SignetChallenge)
+			if e != nil {
+				println("Invalid signet challenge:", e.Error())
+				os.Exit(1)
+			}
+			Params = btc.NewSignetParams(chal)
+		}
 	} else {
-		GocoinHomeDir += "btcnet" + string(os.PathSeparator)
+		Params = btc.GetChainParams(Testnet)
+	}
+	GocoinHomeDir += Params.DataSubdir + string(os.PathSeparator)
+	if Params != &btc.MainNetParams {
+		fmt.Println("Using", Params.Name)
 	}
 	fmt.Println("GocoinHomeDir:", GocoinHomeDir)
 
 	sys.LockDatabaseDir(GocoinHomeDir)
 	defer sys.UnlockDatabaseDir()
 
-	peersdb.Testnet = Testnet
+	peersdb.Params = Params
 	peersdb.InitPeers(GocoinHomeDir)
 
 	StartTime = time.Now()
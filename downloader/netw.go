@@ -120,7 +120,7 @@ func (c *one_net_conn) sendmsg(cmd string, pl []byte) (e error) {
 	sbuf := make([]byte, 24+len(pl))
 
 	binary.LittleEndian.PutUint32(sbuf[0:4], Version)
-	copy(sbuf[0:4], Magic[:])
+	copy(sbuf[0:4], Params.Magic[:])
 	copy(sbuf[4:16], cmd)
 	binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
 
@@ -180,7 +180,7 @@ func (c *one_net_conn) readmsg() *one_net_cmd {
 			c.Unlock()
 			c.recv.hdr_len += n
 			if c.recv.hdr_len >= 4 {
-				if !bytes.Equal(c.recv.hdr[:4], Magic[:]) {
+				if !bytes.Equal(c.recv.hdr[:4], Params.Magic[:]) {
 					fmt.Println(c.Ip(), "NetBadMagic")
 					c.setbroken(true)
 					return nil
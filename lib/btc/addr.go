@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"bytes"
 	"errors"
+	"strings"
 	"math/big"
 	"encoding/hex"
 	"encoding/binary"
@@ -15,10 +16,12 @@ type BtcAddr struct {
 	Hash160 [20]byte // For a stealth address: it's HASH160
 	Checksum []byte  // Unused for a stealth address
 	Pubkey []byte    // Unused for a stealth address
-	Enc58str string
+	Enc58str string  // For a segwit address: it's the bech32 string
 
 	*StealthAddr // if this is not nil, means that this is a stealth address
 
+	SegwitProg *SegwitProg // if this is not nil, means that this is a native segwit address
+
 	// This is used only by the client
 	Extra struct {
 		Label string
@@ -28,6 +31,18 @@ type BtcAddr struct {
 }
 
 func NewAddrFromString(hs string) (a *BtcAddr, e error) {
+	lhs := strings.ToLower(hs)
+	for _, p := range AllChainParams {
+		if strings.HasPrefix(lhs, p.Bech32HRP+"1") {
+			var sw *SegwitProg
+			if sw, e = NewSegwitProgFromString(hs); e!=nil {
+				return
+			}
+			a = NewAddrFromSegwitProg(sw)
+			a.Enc58str = lhs
+			return
+		}
+	}
 	dec := Decodeb58(hs)
 	if dec == nil {
 		e = errors.New("Cannot decode b58 string *"+hs+"*")
@@ -73,6 +88,15 @@ func NewAddrFromHash160(in []byte, ver byte) (a *BtcAddr) {
 }
 
 
+// For a segwit address, Hash160 keeps the first 20 bytes of the witness program
+func NewAddrFromSegwitProg(sw *SegwitProg) (a *BtcAddr) {
+	a = new(BtcAddr)
+	a.SegwitProg = sw
+	copy(a.Hash160[:], sw.Program)
+	return
+}
+
+
 func NewAddrFromPubkey(in []byte, ver byte) (a *BtcAddr) {
 	a = new(BtcAddr)
 	a.Pubkey = make([]byte, len(in))
@@ -84,41 +108,37 @@ func NewAddrFromPubkey(in []byte, ver byte) (a *BtcAddr) {
 
 
 func AddrVerPubkey(testnet bool) byte {
-	if testnet {
-		return 111
-	} else {
-		return 0
-	}
+	return GetChainParams(testnet).AddrVerPubkey
 }
 
 
 func AddrVerScript(testnet bool) byte {
-	if testnet {
-		return 196
-	} else {
-		return 5
-	}
+	return GetChainParams(testnet).AddrVerScript
 }
 
 
-func NewAddrFromPkScript(scr []byte, testnet bool) (*BtcAddr) {
+func NewAddrFromPkScript(scr []byte, p *ChainParams) (*BtcAddr) {
 	if len(scr)==25 && scr[0]==0x76 && scr[1]==0xa9 && scr[2]==0x14 && scr[23]==0x88 && scr[24]==0xac {
-		return NewAddrFromHash160(scr[3:23], AddrVerPubkey(testnet))
+		return NewAddrFromHash160(scr[3:23], p.AddrVerPubkey)
 	} else if len(scr)==67 && scr[0]==0x41 && scr[66]==0xac {
-		return NewAddrFromPubkey(scr[1:66], AddrVerPubkey(testnet))
+		return NewAddrFromPubkey(scr[1:66], p.AddrVerPubkey)
 	} else if len(scr)==35 && scr[0]==0x21 && scr[34]==0xac {
-		return NewAddrFromPubkey(scr[1:34], AddrVerPubkey(testnet))
+		return NewAddrFromPubkey(scr[1:34], p.AddrVerPubkey)
 	} else if len(scr)==23 && scr[0]==0xa9 && scr[1]==0x14 && scr[22]==0x87 {
-		return NewAddrFromHash160(scr[2:22], AddrVerScript(testnet))
+		return NewAddrFromHash160(scr[2:22], p.AddrVerScript)
+	} else if ver, prog := IsWitnessProgram(scr); prog!=nil {
+		return NewAddrFromSegwitProg(&SegwitProg{HRP:p.Bech32HRP, Version:ver, Program:append([]byte{}, prog...)})
 	}
 	return nil
 }
 
 
-// Base58 encoded address
+// Base58 encoded address (bech32 for segwit ones)
 func (a *BtcAddr) String() string {
 	if a.Enc58str=="" {
-		if a.StealthAddr!=nil {
+		if a.SegwitProg!=nil {
+			a.Enc58str = a.SegwitProg.String()
+		} else if a.StealthAddr!=nil {
 			a.Enc58str = a.StealthAddr.String()
 		} else {
 			var ad [25]byte
@@ -162,6 +182,11 @@ func (a *BtcAddr) Label() (s string) {
 
 // Check if a pk_script send coins to this address
 func (a *BtcAddr) Owns(scr []byte) (yes bool) {
+	if a.SegwitProg!=nil {
+		yes = bytes.Equal(scr, a.SegwitProg.OutScript())
+		return
+	}
+
 	// The most common spend script
 	if len(scr)==25 && scr[0]==0x76 && scr[1]==0xa9 && scr[2]==0x14 && scr[23]==0x88 && scr[24]==0xac {
 		yes = bytes.Equal(scr[3:23], a.Hash160[:])
@@ -203,7 +228,9 @@ func (a *BtcAddr) Owns(scr []byte) (yes bool) {
 
 
 func (a *BtcAddr) OutScript() (res []byte) {
-	if a.Version==AddrVerPubkey(false) || a.Version==AddrVerPubkey(true) || a.Version==48 /*Litecoin*/ {
+	if a.SegwitProg!=nil {
+		res = a.SegwitProg.OutScript()
+	} else if a.isVersion(func(p *ChainParams) byte {return p.AddrVerPubkey}) || a.Version==48 /*Litecoin*/ {
 		res = make([]byte, 25)
 		res[0] = 0x76
 		res[1] = 0xa9
@@ -211,7 +238,7 @@ func (a *BtcAddr) OutScript() (res []byte) {
 		copy(res[3:23], a.Hash160[:])
 		res[23] = 0x88
 		res[24] = 0xac
-	} else if a.Version==AddrVerScript(false) || a.Version==AddrVerScript(true) {
+	} else if a.isVersion(func(p *ChainParams) byte {return p.AddrVerScript}) {
 		res = make([]byte, 23)
 		res[0] = 0xa9
 		res[1] = 20
@@ -224,6 +251,17 @@ func (a *BtcAddr) OutScript() (res []byte) {
 }
 
 
+// Returns true if the address version is the one returned by ver for any of the known chains
+func (a *BtcAddr) isVersion(ver func(*ChainParams) byte) bool {
+	for _, p := range AllChainParams {
+		if a.Version==ver(p) {
+			return true
+		}
+	}
+	return false
+}
+
+
 func (a *BtcAddr) AIdx() (uint64) {
 	return binary.LittleEndian.Uint64(a.Hash160[:8])
 }
@@ -0,0 +1,201 @@
+package btc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// BIP-173 (bech32) and BIP-350 (bech32m) encoding of segwit addresses
+
+const (
+	BECH32_CONST = 1
+	BECH32M_CONST = 0x2bc830a3
+)
+
+var bech32set string = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+
+// A native segwit output (witness version with its program)
+type SegwitProg struct {
+	HRP string
+	Version int
+	Program []byte
+}
+
+
+// Returns the human readable part used for segwit addresses
+func SegwitHRP(testnet bool) string {
+	return GetChainParams(testnet).Bech32HRP
+}
+
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk & 0x1ffffff) << 5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b >> uint(i)) & 1 != 0 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) (res []byte) {
+	res = make([]byte, 2*len(hrp)+1)
+	for i := 0; i < len(hrp); i++ {
+		res[i] = hrp[i] >> 5
+		res[i+len(hrp)+1] = hrp[i] & 31
+	}
+	return
+}
+
+
+// Encodes 5-bit data with the given human readable part
+func Bech32Encode(hrp string, data []byte, bech32m bool) string {
+	cnst := uint32(BECH32_CONST)
+	if bech32m {
+		cnst = BECH32M_CONST
+	}
+	values := append(bech32HrpExpand(hrp), data...)
+	mod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ cnst
+	res := new(bytes.Buffer)
+	res.WriteString(hrp)
+	res.WriteByte('1')
+	for _, d := range data {
+		res.WriteByte(bech32set[d])
+	}
+	for i := 0; i < 6; i++ {
+		res.WriteByte(bech32set[(mod >> uint(5*(5-i))) & 31])
+	}
+	return res.String()
+}
+
+
+// Decodes a bech32 or bech32m string, returning the 5-bit data without the checksum
+func Bech32Decode(s string) (hrp string, data []byte, bech32m bool, e error) {
+	if len(s)>90 {
+		e = errors.New("Bech32 string too long")
+		return
+	}
+	if strings.ToLower(s)!=s && strings.ToUpper(s)!=s {
+		e = errors.New("Bech32 string has mixed case")
+		return
+	}
+	s = strings.ToLower(s)
+	for i := 0; i < len(s); i++ {
+		if s[i]<33 || s[i]>126 {
+			e = errors.New("Bech32 string has an invalid character")
+			return
+		}
+	}
+	pos := strings.LastIndex(s, "1")
+	if pos<1 || pos+7>len(s) {
+		e = errors.New("Bech32 separator misplaced")
+		return
+	}
+	hrp = s[:pos]
+	data = make([]byte, len(s)-pos-1)
+	for i := range data {
+		d := strings.IndexByte(bech32set, s[pos+1+i])
+		if d<0 {
+			e = errors.New("Bech32 string has an invalid data character")
+			return
+		}
+		data[i] = byte(d)
+	}
+	switch bech32Polymod(append(bech32HrpExpand(hrp), data...)) {
+		case BECH32_CONST:
+		case BECH32M_CONST:
+			bech32m = true
+		default:
+			e = errors.New("Bech32 checksum error")
+			return
+	}
+	data = data[:len(data)-6]
+	return
+}
+
+
+// Regroups bits of the data (i.e. from 8 to 5 bits per byte and the other way around)
+func convertBits(data []byte, frombits, tobits uint, pad bool) (res []byte) {
+	var acc uint32
+	var bits uint
+	maxv := uint32(1<<tobits) - 1
+	for _, v := range data {
+		if uint32(v) >> frombits != 0 {
+			return nil
+		}
+		acc = acc << frombits | uint32(v)
+		bits += frombits
+		for bits >= tobits {
+			bits -= tobits
+			res = append(res, byte((acc >> bits) & maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			res = append(res, byte((acc << (tobits - bits)) & maxv))
+		}
+	} else if bits >= frombits || (acc << (tobits - bits)) & maxv != 0 {
+		return nil
+	}
+	if res==nil {
+		res = []byte{}
+	}
+	return
+}
+
+
+// Decodes a segwit address, checking it against BIP-173 and BIP-350 rules
+func NewSegwitProgFromString(s string) (sw *SegwitProg, e error) {
+	var hrp string
+	var data []byte
+	var bech32m bool
+	hrp, data, bech32m, e = Bech32Decode(s)
+	if e!=nil {
+		return
+	}
+	if len(data)<1 || data[0]>16 {
+		e = errors.New("Invalid witness version")
+		return
+	}
+	prog := convertBits(data[1:], 5, 8, false)
+	if prog==nil || len(prog)<2 || len(prog)>40 {
+		e = errors.New("Invalid witness program")
+		return
+	}
+	if data[0]==0 && len(prog)!=20 && len(prog)!=32 {
+		e = errors.New("Invalid witness v0 program length")
+		return
+	}
+	if bech32m != (data[0]!=0) {
+		e = errors.New("Wrong bech32 variant for the witness version")
+		return
+	}
+	sw = &SegwitProg{HRP:hrp, Version:int(data[0]), Program:prog}
+	return
+}
+
+
+// Bech32 (for version 0) or bech32m (for higher versions) encoded address
+func (sw *SegwitProg) String() string {
+	data := append([]byte{byte(sw.Version)}, convertBits(sw.Program, 8, 5, true)...)
+	return Bech32Encode(sw.HRP, data, sw.Version!=0)
+}
+
+
+// The pk_script paying to this witness program
+func (sw *SegwitProg) OutScript() (res []byte) {
+	res = make([]byte, 2+len(sw.Program))
+	if sw.Version!=0 {
+		res[0] = byte(OP_1 - 1 + sw.Version)
+	}
+	res[1] = byte(len(sw.Program))
+	copy(res[2:], sw.Program)
+	return
+}
@@ -74,10 +74,10 @@ func (bl *Block) BuildTxList() (e error) {
 		}
 		bl.Txs[i].Size = uint32(n)
 		_ = <-done // wait here, if we have too many threads already
-		go func(h **Uint256, b []byte) {
-			*h = NewSha2Hash(b) // Calculate tx hash in a background
-			done <- true        // indicate mission completed
-		}(&bl.Txs[i].Hash, bl.Raw[offs:offs+n])
+		go func(tx *Tx, b []byte) {
+			tx.SetHash(b) // Calculate tx hash in a background
+			done <- true  // indicate mission completed
+		}(bl.Txs[i], bl.Raw[offs:offs+n])
 		offs += n
 	}
 
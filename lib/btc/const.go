@@ -4,7 +4,15 @@ const(
 	COIN = 1e8
 	MAX_MONEY = 21000000 * COIN
 	MAX_BLOCK_SIZE = 1e6
+	MAX_BLOCK_SIGOPS = MAX_BLOCK_SIZE/50
 	MessageMagic = "Bitcoin Signed Message:\n"
 	LOCKTIME_THRESHOLD = 500000000
 	MAX_SCRIPT_ELEMENT_SIZE = 520
+	MAX_SCRIPT_SIZE = 10000
+
+	// BIP-68 relative lock time, encoded in TxIn.Sequence
+	SEQUENCE_LOCKTIME_DISABLE_FLAG = 1<<31
+	SEQUENCE_LOCKTIME_TYPE_FLAG = 1<<22
+	SEQUENCE_LOCKTIME_MASK = 0x0000ffff
+	SEQUENCE_LOCKTIME_GRANULARITY = 9 // time based locks are in units of 512 seconds
 )
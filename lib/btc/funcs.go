@@ -100,8 +100,14 @@ func GetMerkel(txs []*Tx) ([]byte) {
 	for i := range txs {
 		mtr[i] = txs[i].Hash.Hash[:]
 	}
+	return merkleRoot(mtr)
+}
+
+
+// Calculates merkle root of the given hashes. Extends the slice in the process.
+func merkleRoot(mtr [][]byte) ([]byte) {
 	var j, i2 int
-	for siz:=len(txs); siz>1; siz=(siz+1)/2 {
+	for siz:=len(mtr); siz>1; siz=(siz+1)/2 {
 		for i := 0; i < siz; i += 2 {
 			if i+1 < siz-1 {
 				i2 = i+1
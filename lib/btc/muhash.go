@@ -0,0 +1,165 @@
+package btc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+/*
+MuHash3072 - rolling hash of a set of byte strings, as used by Bitcoin Core for the UTXO set.
+Each element is mapped to a 3072-bit number (ChaCha20 keystream keyed with its SHA256)
+and the hash is the product of all of them, modulo 2^3072 - 1103717.
+Removed elements are multiplied into a separate denominator, so the order does not matter.
+*/
+type MuHash struct {
+	num, den *big.Int
+}
+
+const (
+	MuHashStateSize = 2 * muhashBytes
+
+	muhashBytes = 384
+)
+
+var (
+	muhashPrime *big.Int
+	muhashC     = big.NewInt(1103717)
+	muhashMask  *big.Int
+)
+
+func init() {
+	one := big.NewInt(1)
+	muhashMask = new(big.Int).Lsh(one, 8*muhashBytes)
+	muhashPrime = new(big.Int).Sub(muhashMask, muhashC)
+	muhashMask.Sub(muhashMask, one)
+}
+
+// Returns the hash of an empty set
+func NewMuHash() *MuHash {
+	return &MuHash{num: big.NewInt(1), den: big.NewInt(1)}
+}
+
+// Restores the hash from the state returned by Bytes()
+func NewMuHashFromBytes(b []byte) (m *MuHash, e error) {
+	if len(b) != MuHashStateSize {
+		e = errors.New("MuHash state must be 768 bytes long")
+		return
+	}
+	m = &MuHash{num: leToInt(b[:muhashBytes]), den: leToInt(b[muhashBytes:])}
+	return
+}
+
+// Makes an independent copy of the hash
+func (m *MuHash) Copy() *MuHash {
+	return &MuHash{num: new(big.Int).Set(m.num), den: new(big.Int).Set(m.den)}
+}
+
+// Adds the element to the set
+func (m *MuHash) Insert(data []byte) {
+	muhashMul(m.num, muhashElement(data))
+}
+
+// Removes the element from the set
+func (m *MuHash) Remove(data []byte) {
+	muhashMul(m.den, muhashElement(data))
+}
+
+// Returns the state (numerator and denominator), so it can be stored
+func (m *MuHash) Bytes() (b []byte) {
+	b = make([]byte, MuHashStateSize)
+	intToLe(m.num, b[:muhashBytes])
+	intToLe(m.den, b[muhashBytes:])
+	return
+}
+
+// Returns the final hash of the set, as shown by Bitcoin Core
+func (m *MuHash) Finalize() *Uint256 {
+	x := new(big.Int).ModInverse(m.den, muhashPrime)
+	muhashMul(x, m.num)
+	var b [muhashBytes]byte
+	intToLe(x, b[:])
+	sh := sha256.Sum256(b[:])
+	return NewUint256(sh[:])
+}
+
+// x = x * y mod 2^3072 - 1103717
+func muhashMul(x, y *big.Int) {
+	x.Mul(x, y)
+	for x.BitLen() > 8*muhashBytes {
+		hi := new(big.Int).Rsh(x, 8*muhashBytes)
+		x.And(x, muhashMask)
+		x.Add(x, hi.Mul(hi, muhashC))
+	}
+	if x.Cmp(muhashPrime) >= 0 {
+		x.Sub(x, muhashPrime)
+	}
+}
+
+func muhashElement(data []byte) *big.Int {
+	key := sha256.Sum256(data)
+	var ks [muhashBytes]byte
+	chacha20Keystream(key[:], ks[:])
+	return leToInt(ks[:])
+}
+
+func leToInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+func intToLe(x *big.Int, b []byte) {
+	be := x.Bytes()
+	for i := range b {
+		b[i] = 0
+	}
+	for i := range be {
+		b[len(be)-1-i] = be[i]
+	}
+}
+
+// Fills out with ChaCha20 keystream, for the given 256-bit key and a zero nonce
+func chacha20Keystream(key []byte, out []byte) {
+	var in, x [16]uint32
+	in[0], in[1], in[2], in[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		in[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	qr := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] ^= x[a]
+		x[d] = x[d]<<16 | x[d]>>16
+		x[c] += x[d]
+		x[b] ^= x[c]
+		x[b] = x[b]<<12 | x[b]>>20
+		x[a] += x[b]
+		x[d] ^= x[a]
+		x[d] = x[d]<<8 | x[d]>>24
+		x[c] += x[d]
+		x[b] ^= x[c]
+		x[b] = x[b]<<7 | x[b]>>25
+	}
+	for off := 0; off < len(out); off += 64 {
+		x = in
+		for i := 0; i < 10; i++ {
+			qr(0, 4, 8, 12)
+			qr(1, 5, 9, 13)
+			qr(2, 6, 10, 14)
+			qr(3, 7, 11, 15)
+			qr(0, 5, 10, 15)
+			qr(1, 6, 11, 12)
+			qr(2, 7, 8, 13)
+			qr(3, 4, 9, 14)
+		}
+		var blk [64]byte
+		for i := range x {
+			binary.LittleEndian.PutUint32(blk[4*i:], x[i]+in[i])
+		}
+		copy(out[off:], blk[:])
+		in[12]++ // block counter
+	}
+}
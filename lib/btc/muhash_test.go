@@ -0,0 +1,61 @@
+package btc
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func muhashFromInt(i byte) *MuHash {
+	var tmp [32]byte
+	tmp[0] = i
+	m := NewMuHash()
+	m.Insert(tmp[:])
+	return m
+}
+
+func TestChaCha20(t *testing.T) {
+	// RFC 7539, A.1 test vector #1 (all zero key and nonce)
+	var out [64]byte
+	chacha20Keystream(make([]byte, 32), out[:])
+	exp := "76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7da41597c5157488d7724e03fb8d84a376a43b8f41518a11cc387b669b2ee6586"
+	if hex.EncodeToString(out[:]) != exp {
+		t.Error("ChaCha20 keystream mismatch", hex.EncodeToString(out[:]))
+	}
+}
+
+func TestMuHash(t *testing.T) {
+	// Test vector from Bitcoin Core's crypto_tests.cpp
+	var tmp [32]byte
+	acc := muhashFromInt(0)
+	tmp[0] = 1
+	acc.Insert(tmp[:])
+	tmp[0] = 2
+	acc.Remove(tmp[:])
+	if res := acc.Finalize().String(); res != "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863" {
+		t.Error("MuHash mismatch", res)
+	}
+
+	// The order of operations must not matter
+	a, b := NewMuHash(), NewMuHash()
+	for i := byte(0); i < 8; i++ {
+		tmp[0] = i
+		a.Insert(tmp[:])
+		tmp[0] = 7 - i
+		b.Insert(tmp[:])
+	}
+	tmp[0] = 9
+	a.Insert(tmp[:])
+	a.Remove(tmp[:])
+	if !a.Finalize().Equal(b.Finalize()) {
+		t.Error("MuHash depends on the order")
+	}
+	if NewMuHash().Finalize().Equal(b.Finalize()) {
+		t.Error("MuHash of a non empty set equals the empty one")
+	}
+
+	// Restoring from the state
+	c, e := NewMuHashFromBytes(a.Bytes())
+	if e != nil || !c.Finalize().Equal(a.Finalize()) {
+		t.Error("MuHash state not restored", e)
+	}
+}
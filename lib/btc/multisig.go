@@ -159,8 +159,8 @@ func (ms *MultiSig) PkScript() (pkscr []byte) {
 	return
 }
 
-func (ms *MultiSig) BtcAddr(testnet bool) *BtcAddr {
+func (ms *MultiSig) BtcAddr(p *ChainParams) *BtcAddr {
 	var h [20]byte
 	RimpHash(ms.P2SH(), h[:])
-	return NewAddrFromHash160(h[:], AddrVerScript(testnet))
+	return NewAddrFromHash160(h[:], p.AddrVerScript)
 }
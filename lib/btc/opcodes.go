@@ -26,6 +26,7 @@ const (
 	OP_15 = 0x5f
 	OP_16 = 0x60
 
+	OP_RETURN = 0x6a
 	OP_EQUAL = 0x87
 	OP_HASH160 = 0xa9
 	OP_CHECKMULTISIG = 0xae
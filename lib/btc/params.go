@@ -0,0 +1,287 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+// Everything that makes one bitcoin network different from another one.
+// The same binaries can run any chain (i.e. an altcoin fork) given its parameters.
+type ChainParams struct {
+	Name string
+	Magic [4]byte // network messages start with it
+	Genesis *Uint256
+	GenesisTime uint32
+	DefaultPort uint16
+	DataSubdir string // folder, within Gocoin's data dir, for this chain's databases
+
+	// Addresses
+	AddrVerPubkey byte
+	AddrVerScript byte
+	AddrVerStealth byte
+	Bech32HRP string // human readable part of segwit addresses
+	HDPublic, HDPrivate uint32 // first 32 bits of serialized HD keys
+
+	// Difficulty rules
+	PowLimitBits uint32 // minimal difficulty, also used by the genesis block
+	PowAllowMinDifficulty bool // a block can have PowLimitBits if it comes 20 minutes after its parent
+	PowNoRetargeting bool
+	SubsidyHalvingInterval uint32 // in blocks
+
+	// Soft forks enforced by the super-majority of block versions (BIP-34, BIP-66, BIP-65)
+	MajorityWindow, MajorityEnforceUpgrade, MajorityRejectBlock uint
+	BIP16Time uint32 // P2SH active for blocks with this or a later timestamp
+	CSVHeight uint32 // BIP-68, BIP-112 and BIP-113 active from this block
+	SegWitHeight uint32 // BIP-141 and BIP-143 active from this block
+
+	// BIP-9 version bits
+	MinerConfirmationWindow uint32 // period, in blocks
+	RuleChangeActivationThreshold uint32 // signalling blocks within a period to lock in
+	Deployments []Deployment
+
+	BIP30Exceptions map[uint32]string // the only blocks allowed to overwrite not fully spent transactions
+	Checkpoints map[uint32]string // block hashes that must be found at the given heights
+
+	DNSSeeds []string
+	FixedSeeds []string // IP addresses used in addition to the DNS seeds
+
+	SignetChallenge []byte // if set, each block must be signed to satisfy this script (BIP-325)
+}
+
+// A soft fork deployed with BIP-9 version bits
+type Deployment struct {
+	Name string
+	Bit uint
+	StartTime uint32 // median time past, from which the bit is being counted
+	Timeout uint32 // median time past, when the deployment fails if not locked in
+	VerifyFlags uint32 // script verification flags (lib/script's VER_*) enabled once it is active
+}
+
+// Values of lib/script's verification flags, that the deployments switch on
+const (
+	deploymentVerCSV = 1<<10 // script.VER_CSV
+	deploymentVerWitness = 1<<11 // script.VER_WITNESS
+)
+
+
+var MainNetParams = ChainParams{
+	Name: "mainnet",
+	Magic: [4]byte{0xF9, 0xBE, 0xB4, 0xD9},
+	Genesis: NewUint256FromString("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"),
+	GenesisTime: 1231006505,
+	DefaultPort: 8333,
+	DataSubdir: "btcnet",
+
+	AddrVerPubkey: 0,
+	AddrVerScript: 5,
+	AddrVerStealth: 42,
+	Bech32HRP: "bc",
+	HDPublic: 0x0488B21E,
+	HDPrivate: 0x0488ADE4,
+
+	PowLimitBits: 0x1d00ffff,
+	SubsidyHalvingInterval: 210000,
+
+	MajorityWindow: 1000,
+	MajorityEnforceUpgrade: 750,
+	MajorityRejectBlock: 950,
+	BIP16Time: 1333238400, // BIP16 didn't become active until Apr 1 2012
+	CSVHeight: 419328,
+	SegWitHeight: 481824,
+
+	MinerConfirmationWindow: 2016,
+	RuleChangeActivationThreshold: 1916,
+	Deployments: []Deployment{
+		{Name: "csv", Bit: 0, StartTime: 1462060800, Timeout: 1493596800, VerifyFlags: deploymentVerCSV},
+		{Name: "segwit", Bit: 1, StartTime: 1479168000, Timeout: 1510704000, VerifyFlags: deploymentVerWitness},
+	},
+
+	BIP30Exceptions: map[uint32]string {
+		91842: "00000000000a4d0a398161ffc163c503763b1f4360639393e0e4c8e300e0caec",
+		91880: "00000000000743f190a18c5577a3c2d2a1f610ae9601ac046a38084ccb7cd721",
+	},
+	Checkpoints: map[uint32]string {
+		11111: "0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d",
+		33333: "000000002dd5588a74784eaa7ab0507a18ad16a236e7b1ce69f00d7ddfb5d0a6",
+		74000: "0000000000573993a3c9e41ce34471c079dcf5f52a0e824a81e7f953b8661a20",
+		105000: "00000000000291ce28027faea320c8d2b054b2e0fe44a773f3eefb151d6bdc97",
+		134444: "00000000000005b12ffd4cd315cd34ffd4a594f430ac814c91184a0d42d2b0fe",
+		168000: "000000000000099e61ea72015e79632f216fe6cb33d7899acb35b75c8303b763",
+		193000: "000000000000059f452a5f7340de6682a977387c17010ff6e6c3bd83ca8b1317",
+		210000: "000000000000048b95347e83192f69cf0366076336c639f9b7228e9ba171342e",
+		216116: "00000000000001b4f4b433e81ee46494af945cf96014816a4e2370f11b23df4e",
+		225430: "00000000000001c108384350f74090433e7fcf79a606b8e797f065b130575932",
+		250000: "000000000000003887df1f29024b06fc2200b55f8af8f35453d7be294df2d214",
+		279000: "0000000000000001ae8c72a0b0c301f67e3afca10e819efa9041e458e9bd7e40",
+		295000: "00000000000000004d9b4ef50f0f9d686fd69db2e03af35a100370c64632a983",
+	},
+
+	DNSSeeds: []string{
+		"seed.bitcoin.sipa.be",
+		"dnsseed.bluematt.me",
+		"seed.bitcoinstats.com",
+		"seed.bitnodes.io",
+		"bitseed.xf2.org",
+	},
+}
+
+
+var TestNet3Params = ChainParams{
+	Name: "testnet3",
+	Magic: [4]byte{0x0B, 0x11, 0x09, 0x07},
+	Genesis: NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943"),
+	GenesisTime: 1296688602,
+	DefaultPort: 18333,
+	DataSubdir: "tstnet",
+
+	AddrVerPubkey: 111,
+	AddrVerScript: 196,
+	AddrVerStealth: 43,
+	Bech32HRP: "tb",
+	HDPublic: 0x043587CF,
+	HDPrivate: 0x04358394,
+
+	PowLimitBits: 0x1d00ffff,
+	PowAllowMinDifficulty: true,
+	SubsidyHalvingInterval: 210000,
+
+	MajorityWindow: 100,
+	MajorityEnforceUpgrade: 51,
+	MajorityRejectBlock: 75,
+	BIP16Time: 1333238400,
+	CSVHeight: 770112,
+	SegWitHeight: 834624,
+
+	MinerConfirmationWindow: 2016,
+	RuleChangeActivationThreshold: 1512,
+	Deployments: []Deployment{
+		{Name: "csv", Bit: 0, StartTime: 1456790400, Timeout: 1493596800, VerifyFlags: deploymentVerCSV},
+		{Name: "segwit", Bit: 1, StartTime: 1462060800, Timeout: 1493596800, VerifyFlags: deploymentVerWitness},
+	},
+
+	Checkpoints: map[uint32]string {
+		546: "000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70",
+	},
+
+	DNSSeeds: []string{
+		//"testnet-seed.bitcoin.petertodd.org",
+		"testnet-seed.bluematt.me",
+	},
+	FixedSeeds: testnet3FixedSeeds,
+}
+
+
+// A private chain for testing, where blocks are generated locally at the minimal difficulty
+var RegTestParams = ChainParams{
+	Name: "regtest",
+	Magic: [4]byte{0xFA, 0xBF, 0xB5, 0xDA},
+	Genesis: NewUint256FromString("0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206"),
+	GenesisTime: 1296688602,
+	DefaultPort: 18444,
+	DataSubdir: "regtest",
+
+	AddrVerPubkey: 111,
+	AddrVerScript: 196,
+	AddrVerStealth: 43,
+	Bech32HRP: "bcrt",
+	HDPublic: 0x043587CF,
+	HDPrivate: 0x04358394,
+
+	PowLimitBits: 0x207fffff,
+	PowAllowMinDifficulty: true,
+	PowNoRetargeting: true,
+	SubsidyHalvingInterval: 150,
+
+	MajorityWindow: 1000,
+	MajorityEnforceUpgrade: 750,
+	MajorityRejectBlock: 950,
+	// P2SH, CSV and SegWit are active from the beginning, while BIP-34, BIP-66 and BIP-65
+	// follow the block versions - so only after 750 blocks of version 4 (as "generate" makes)
+	BIP16Time: 0,
+	CSVHeight: 0,
+	SegWitHeight: 0,
+
+	MinerConfirmationWindow: 144,
+	RuleChangeActivationThreshold: 108,
+}
+
+
+// The default, public signet (BIP-325)
+var SigNetParams = ChainParams{
+	Name: "signet",
+	Magic: [4]byte{0x0A, 0x03, 0xCF, 0x40},
+	Genesis: NewUint256FromString("00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6"),
+	GenesisTime: 1598918400,
+	DefaultPort: 38333,
+	DataSubdir: "signet",
+
+	AddrVerPubkey: 111,
+	AddrVerScript: 196,
+	AddrVerStealth: 43,
+	Bech32HRP: "tb",
+	HDPublic: 0x043587CF,
+	HDPrivate: 0x04358394,
+
+	PowLimitBits: 0x1e0377ae,
+	SubsidyHalvingInterval: 210000,
+
+	MajorityWindow: 100,
+	MajorityEnforceUpgrade: 51,
+	MajorityRejectBlock: 75,
+	BIP16Time: 0,
+	CSVHeight: 0,
+	SegWitHeight: 0,
+
+	MinerConfirmationWindow: 2016,
+	RuleChangeActivationThreshold: 1815,
+
+	DNSSeeds: []string{
+		"seed.signet.bitcoin.sprovoost.nl",
+	},
+
+	SignetChallenge: signetDefaultChallenge,
+}
+
+var signetDefaultChallenge, _ = hex.DecodeString("512103ad5e0edad18cb1f0fc0d28a3d4f1f3e445640337489abb10404f2d1e086be43021" +
+	"0359ef5021964fe22d6f8e05b2463c9540ce96883fe3b278760f048f5189f2e6c452ae")
+
+
+// Returns parameters of a custom signet, whose blocks are signed to satisfy the given challenge script.
+// It shares the genesis block with the default signet, but has its own magic and data folder.
+func NewSignetParams(challenge []byte) *ChainParams {
+	p := SigNetParams
+	buf := new(bytes.Buffer)
+	WriteVlen(buf, uint64(len(challenge)))
+	buf.Write(challenge)
+	h := Sha2Sum(buf.Bytes())
+	copy(p.Magic[:], h[:4])
+	p.DataSubdir = "signet_" + hex.EncodeToString(p.Magic[:])
+	p.DNSSeeds = nil
+	p.SignetChallenge = challenge
+	return &p
+}
+
+
+// All the chains known to the library (i.e. whose addresses can be decoded).
+// Add your own parameters here, to support them.
+var AllChainParams = []*ChainParams{&MainNetParams, &TestNet3Params, &RegTestParams, &SigNetParams}
+
+
+// Returns the coinbase reward (not including fees) for a block at the given height
+func (p *ChainParams) BlockReward(height uint32) uint64 {
+	halvings := height / p.SubsidyHalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return 50e8 >> halvings
+}
+
+
+// Returns parameters of Testnet3 or of the main network
+func GetChainParams(testnet bool) *ChainParams {
+	if testnet {
+		return &TestNet3Params
+	} else {
+		return &MainNetParams
+	}
+}
@@ -0,0 +1,21 @@
+package btc
+
+import (
+	"testing"
+)
+
+func TestSignetMagic(t *testing.T) {
+	// The default signet's magic must follow from its challenge
+	p := NewSignetParams(SigNetParams.SignetChallenge)
+	if p.Magic != SigNetParams.Magic {
+		t.Errorf("Signet magic %x, expected %x", p.Magic, SigNetParams.Magic)
+	}
+	if p.DataSubdir != "signet_0a03cf40" {
+		t.Error("Custom signet data folder", p.DataSubdir)
+	}
+
+	// OP_TRUE challenge
+	if p = NewSignetParams([]byte{0x51}); p.Magic == SigNetParams.Magic || p.Genesis != SigNetParams.Genesis {
+		t.Error("Custom signet params", p.Magic, p.Genesis.String())
+	}
+}
@@ -72,6 +72,12 @@ func int2scr(v int64) ([]byte) {
 }
 
 
+// Returns the block height serialized the way it must begin the coinbase's script (BIP-34)
+func CoinbaseHeight(height uint32) []byte {
+	return int2scr(int64(height))
+}
+
+
 func DecodeScript(pk string) (out []byte, e error) {
 	xx := strings.Split(pk, " ")
 	for i := range xx {
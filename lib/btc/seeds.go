@@ -1,7 +1,7 @@
-package peersdb
+package btc
 
 // we have a fixed list of testnet seeds since the actual seeds dont seem to work ATM
-var testnet_seeds = []string {
+var testnet3FixedSeeds = []string {
 	"107.170.104.227",
 	"188.230.215.236",
 	"95.85.39.28",
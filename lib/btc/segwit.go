@@ -0,0 +1,179 @@
+package btc
+
+import (
+	"hash"
+	"io"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	WITNESS_SCALE_FACTOR = 4
+	MAX_BLOCK_WEIGHT = 4e6
+	MAX_BLOCK_SIGOPS_COST = 80000
+)
+
+// Coinbase output script prefix, marking the witness commitment
+var WitnessCommitmentHeader = []byte{OP_RETURN, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+
+// Checks if the given script is a witness program (BIP-141).
+// Returns the witness version and the program, or nil if it is not one.
+func IsWitnessProgram(scr []byte) (version int, program []byte) {
+	if len(scr) < 4 || len(scr) > 42 {
+		return
+	}
+	if scr[0] != OP_0 && (scr[0] < OP_1 || scr[0] > OP_16) {
+		return
+	}
+	if int(scr[1])+2 != len(scr) {
+		return
+	}
+	if scr[0] != OP_0 {
+		version = int(scr[0]) - OP_1 + 1
+	}
+	program = scr[2:]
+	return
+}
+
+
+// Returns merkle root of the block's WTxIDs (the coinbase's one is taken as zero)
+func GetWitnessMerkle(txs []*Tx) ([]byte) {
+	mtr := make([][]byte, len(txs))
+	mtr[0] = make([]byte, 32)
+	for i := 1; i < len(txs); i++ {
+		mtr[i] = txs[i].WTxID().Hash[:]
+	}
+	return merkleRoot(mtr)
+}
+
+
+// Returns size of the block, not counting the witness data. Call BuildTxList() first.
+func (bl *Block) NoWitnessSize() (siz int) {
+	siz = bl.TxOffset
+	for i := range bl.Txs {
+		siz += int(bl.Txs[i].NoWitSize)
+	}
+	return
+}
+
+
+// Returns the block's weight, as defined by BIP-141. Call BuildTxList() first.
+func (bl *Block) Weight() int {
+	return bl.NoWitnessSize()*(WITNESS_SCALE_FACTOR-1) + len(bl.Raw)
+}
+
+
+// Returns true if any of the inputs has the witness data
+func (t *Tx) HasWitness() bool {
+	for i := range t.TxIn {
+		if len(t.TxIn[i].Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Returns the hash of the transaction including the witness data (BIP-141).
+// For transactions without witness it is the same as the TxID.
+func (t *Tx) WTxID() *Uint256 {
+	return NewSha2Hash(t.Serialize())
+}
+
+
+// Returns the transaction's weight, as defined by BIP-141.
+// It is calculated from the current content, so it stays right if the tx gets modified.
+func (t *Tx) Weight() int {
+	return len(t.SerializeNoWitness())*(WITNESS_SCALE_FACTOR-1) + len(t.Serialize())
+}
+
+
+// Returns the virtual size of the transaction (weight divided by 4, rounded up)
+func (t *Tx) VSize() int {
+	return (t.Weight() + WITNESS_SCALE_FACTOR - 1) / WITNESS_SCALE_FACTOR
+}
+
+
+// Return the transaction's hash, that is about to get signed/verified,
+// for an input spending a witness v0 program (BIP-143).
+func (t *Tx) WitnessSigHash(scriptCode []byte, nIn int, amount uint64, hashType int32) ([]byte) {
+	var buf [9]byte
+	var hashPrevouts, hashSequence, hashOutputs [32]byte
+
+	ht := hashType&0x1f
+	sha := sha256.New()
+
+	if (hashType&SIGHASH_ANYONECANPAY)==0 {
+		for i := range t.TxIn {
+			sha.Write(t.TxIn[i].Input.Hash[:])
+			binary.LittleEndian.PutUint32(buf[:4], t.TxIn[i].Input.Vout)
+			sha.Write(buf[:4])
+		}
+		hashPrevouts = dblSha(sha)
+
+		if ht!=SIGHASH_SINGLE && ht!=SIGHASH_NONE {
+			for i := range t.TxIn {
+				binary.LittleEndian.PutUint32(buf[:4], t.TxIn[i].Sequence)
+				sha.Write(buf[:4])
+			}
+			hashSequence = dblSha(sha)
+		}
+	}
+
+	if ht!=SIGHASH_SINGLE && ht!=SIGHASH_NONE {
+		for i := range t.TxOut {
+			writeTxOut(sha, t.TxOut[i])
+		}
+		hashOutputs = dblSha(sha)
+	} else if ht==SIGHASH_SINGLE && nIn<len(t.TxOut) {
+		writeTxOut(sha, t.TxOut[nIn])
+		hashOutputs = dblSha(sha)
+	}
+
+	binary.LittleEndian.PutUint32(buf[:4], t.Version)
+	sha.Write(buf[:4])
+	sha.Write(hashPrevouts[:])
+	sha.Write(hashSequence[:])
+
+	// The input being signed
+	sha.Write(t.TxIn[nIn].Input.Hash[:])
+	binary.LittleEndian.PutUint32(buf[:4], t.TxIn[nIn].Input.Vout)
+	sha.Write(buf[:4])
+	sha.Write(buf[:PutVlen(buf[:], len(scriptCode))])
+	sha.Write(scriptCode)
+	binary.LittleEndian.PutUint64(buf[:8], amount)
+	sha.Write(buf[:8])
+	binary.LittleEndian.PutUint32(buf[:4], t.TxIn[nIn].Sequence)
+	sha.Write(buf[:4])
+
+	sha.Write(hashOutputs[:])
+
+	binary.LittleEndian.PutUint32(buf[:4], t.Lock_time)
+	sha.Write(buf[:4])
+	binary.LittleEndian.PutUint32(buf[:4], uint32(hashType))
+	sha.Write(buf[:4])
+
+	res := dblSha(sha)
+	return res[:]
+}
+
+
+func writeTxOut(wr io.Writer, out *TxOut) {
+	var buf [9]byte
+	binary.LittleEndian.PutUint64(buf[:8], out.Value)
+	wr.Write(buf[:8])
+	wr.Write(buf[:PutVlen(buf[:], len(out.Pk_script))])
+	wr.Write(out.Pk_script)
+}
+
+
+// Returns double sha256 of the data written so far and resets the hasher
+func dblSha(sha hash.Hash) (res [32]byte) {
+	tmp := sha.Sum(nil)
+	sha.Reset()
+	sha.Write(tmp)
+	copy(res[:], sha.Sum(nil))
+	sha.Reset()
+	return
+}
@@ -0,0 +1,86 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Native P2WPKH example from BIP-143
+const (
+	bip143_unsigned = "0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000"
+	bip143_signed = "01000000000102fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f00000000494830450221008b9d1dc26ba6a9cb62127b02742fa9d754cd3bebf337f7a55d114c8e5cdd30be022040529b194ba3f9281a99f2b1c0a19c0489bc22ede944ccf4ecbab4cc618ef3ed01eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac000247304402203609e17b84f6a7d30c80bfa610b5b4542f32a8a0d5447a12fb1366d7f01cc44a0220573a954c4518331561406f90300e8f3358f51928d43c212a8caed02de67eebee0121025476c2e83188368da1ff3e292e7acafcdb3566bb0ad253f62fc70f07aeee635711000000"
+	bip143_script = "76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac"
+	bip143_sighash = "c37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670"
+)
+
+
+func TestSegWitTx(t *testing.T) {
+	raw, _ := hex.DecodeString(bip143_signed)
+	tx, n := NewTx(raw)
+	if tx == nil || n != len(raw) {
+		t.Fatal("Cannot decode segwit tx")
+	}
+	tx.Size = uint32(n)
+	if !tx.SegWit || !tx.HasWitness() {
+		t.Error("Witness data not found")
+	}
+	if len(tx.TxIn[0].Witness) != 0 || len(tx.TxIn[1].Witness) != 2 {
+		t.Error("Bad witness stacks")
+	}
+	if !bytes.Equal(tx.Serialize(), raw) {
+		t.Error("Serialize mismatch")
+	}
+
+	nowit := tx.SerializeNoWitness()
+	if int(tx.NoWitSize) != len(nowit) {
+		t.Error("NoWitSize mismatch", tx.NoWitSize, len(nowit))
+	}
+	if tx.Weight() != 3*len(nowit)+len(raw) {
+		t.Error("Weight mismatch", tx.Weight())
+	}
+	w := tx.TxIn[1].Witness
+	tx.TxIn[1].Witness = nil
+	if tx.Weight() != 4*len(nowit) {
+		t.Error("Weight not updated", tx.Weight())
+	}
+	tx.TxIn[1].Witness = w
+
+	tx.SetHash(raw)
+	if !tx.Hash.Equal(NewSha2Hash(nowit)) {
+		t.Error("TxID should not cover the witness")
+	}
+	if !tx.WTxID().Equal(NewSha2Hash(raw)) {
+		t.Error("WTxID mismatch")
+	}
+
+	// The signature from the witness must match BIP-143 hash
+	scr, _ := hex.DecodeString(bip143_script)
+	h := tx.WitnessSigHash(scr, 1, 600000000, SIGHASH_ALL)
+	exp, _ := hex.DecodeString(bip143_sighash)
+	if !bytes.Equal(h, exp) {
+		t.Error("WitnessSigHash mismatch", hex.EncodeToString(h))
+	}
+	sig := tx.TxIn[1].Witness[0]
+	if !EcdsaVerify(tx.TxIn[1].Witness[1], sig[:len(sig)-1], h) {
+		t.Error("Witness signature does not verify")
+	}
+}
+
+
+func TestLegacyTx(t *testing.T) {
+	raw, _ := hex.DecodeString(bip143_unsigned)
+	tx, n := NewTx(raw)
+	if tx == nil || n != len(raw) {
+		t.Fatal("Cannot decode legacy tx")
+	}
+	if tx.SegWit || tx.HasWitness() {
+		t.Error("Unexpected witness data")
+	}
+	if !bytes.Equal(tx.Serialize(), raw) || int(tx.NoWitSize) != len(raw) {
+		t.Error("Serialize mismatch")
+	}
+	if tx.VSize() != len(raw) {
+		t.Error("VSize mismatch")
+	}
+}
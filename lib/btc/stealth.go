@@ -12,11 +12,7 @@ import (
 )
 
 func StealthAddressVersion(testnet bool) byte {
-	if testnet {
-		return 43
-	} else {
-		return 42
-	}
+	return GetChainParams(testnet).AddrVerStealth
 }
 
 type StealthAddr struct {
@@ -197,8 +193,8 @@ func (sa *StealthAddr) CheckNonce(payload []byte) bool {
 }
 
 // Thanks @dabura667 - https://bitcointalk.org/index.php?topic=590349.msg6560332#msg6560332
-func MakeStealthTxOuts(sa *StealthAddr, value uint64, testnet bool) (res []*TxOut, er error) {
-	if sa.Version != StealthAddressVersion(testnet) {
+func MakeStealthTxOuts(sa *StealthAddr, value uint64, p *ChainParams) (res []*TxOut, er error) {
+	if sa.Version != p.AddrVerStealth {
 		er = errors.New(fmt.Sprint("ERROR: Unsupported version of a stealth address", sa.Version))
 		return
 	}
@@ -267,7 +263,7 @@ pick_different_e:
 	Dpr := DeriveNextPublic(sa.SpendKeys[0][:], c)
 
 	// 11. Create a normal P2KH output spending to D' as public key.
-	adr := NewAddrFromPubkey(Dpr, AddrVerPubkey(testnet))
+	adr := NewAddrFromPubkey(Dpr, p.AddrVerPubkey)
 	res[1] = &TxOut{Value: value, Pk_script: adr.OutScript()}
 
 	return
@@ -26,6 +26,7 @@ type TxIn struct {
 	Input TxPrevOut
 	ScriptSig []byte
 	Sequence uint32
+	Witness [][]byte // segregated witness stack (BIP-141), nil for legacy inputs
 	//PrvOut *TxOut  // this field is used only during verification
 }
 
@@ -43,9 +44,13 @@ type Tx struct {
 	TxOut []*TxOut
 	Lock_time uint32
 
+	SegWit bool // set if the transaction has been serialized with the witness data
+
 	// These two fields should be set in block.go:
 	Size uint32
 	Hash *Uint256
+
+	NoWitSize uint32 // size of the transaction without the witness data (set by NewTx)
 }
 
 
@@ -60,10 +65,10 @@ func (po *TxPrevOut) UIdx() uint64 {
 }
 
 
-func (to *TxOut) String(testnet bool) (s string) {
+func (to *TxOut) String(p *ChainParams) (s string) {
 	s = fmt.Sprintf("%.8f BTC", float64(to.Value)/1e8)
 	s += fmt.Sprint(" in block ", to.BlockHeight)
-	a := NewAddrFromPkScript(to.Pk_script, testnet)
+	a := NewAddrFromPkScript(to.Pk_script, p)
 	if a != nil {
 		s += " to "+a.String()
 	} else {
@@ -73,13 +78,31 @@ func (to *TxOut) String(testnet bool) (s string) {
 }
 
 
+// Returns the transaction serialized in the network format.
+// If the transaction has any witness data, it is serialized in BIP-144 format.
 func (t *Tx) Serialize() ([]byte) {
+	return t.serialize(t.HasWitness())
+}
+
+
+// Returns the transaction serialized in the legacy format, without any witness data.
+// This is the format used to calculate the TxID.
+func (t *Tx) SerializeNoWitness() ([]byte) {
+	return t.serialize(false)
+}
+
+
+func (t *Tx) serialize(witness bool) ([]byte) {
 	var buf [9]byte
 	wr := new(bytes.Buffer)
 
 	// Version
 	binary.Write(wr, binary.LittleEndian, t.Version)
 
+	if witness {
+		wr.Write([]byte{0x00, 0x01}) // marker and flag
+	}
+
 	//TxIns
 	wr.Write(buf[:PutVlen(buf[:], len(t.TxIn))])
 	for i := range t.TxIn {
@@ -98,6 +121,16 @@ func (t *Tx) Serialize() ([]byte) {
 		wr.Write(t.TxOut[i].Pk_script[:])
 	}
 
+	if witness {
+		for i := range t.TxIn {
+			wr.Write(buf[:PutVlen(buf[:], len(t.TxIn[i].Witness))])
+			for _, it := range t.TxIn[i].Witness {
+				wr.Write(buf[:PutVlen(buf[:], len(it))])
+				wr.Write(it)
+			}
+		}
+	}
+
 	//Lock_time
 	binary.Write(wr, binary.LittleEndian, t.Lock_time)
 
@@ -105,6 +138,16 @@ func (t *Tx) Serialize() ([]byte) {
 }
 
 
+// Sets the transaction's hash (TxID), given its raw data (it can be nil).
+// For segwit transactions the hash is calculated without the witness data.
+func (t *Tx) SetHash(raw []byte) {
+	if raw == nil || t.HasWitness() {
+		raw = t.SerializeNoWitness()
+	}
+	t.Hash = NewSha2Hash(raw)
+}
+
+
 // Return the transaction's hash, that is about to get signed/verified
 func (t *Tx) SignatureHash(scriptCode []byte, nIn int, hashType int32) ([]byte) {
 	var buf [9]byte
@@ -299,6 +342,17 @@ func (tx *Tx) CheckTransaction() error {
 		}
 	}
 
+	// Check for duplicate inputs
+	if len(tx.TxIn) > 1 {
+		inps := make(map[TxPrevOut]bool, len(tx.TxIn))
+		for i := range tx.TxIn {
+			if inps[tx.TxIn[i].Input] {
+				return errors.New("CheckTransaction() : duplicate inputs")
+			}
+			inps[tx.TxIn[i].Input] = true
+		}
+	}
+
 	return nil
 }
 
@@ -381,7 +435,7 @@ func NewTxIn(b []byte) (txin *TxIn, offs int) {
 }
 
 
-// Decode a raw transaction from a given bytes slice.
+// Decode a raw transaction from a given bytes slice (legacy or BIP-144 format).
 // Returns the transaction and the size it took in the buffer.
 // WARNING: This function does not set Tx.Hash neither Tx.Size
 func NewTx(b []byte) (tx *Tx, offs int) {
@@ -400,6 +454,15 @@ func NewTx(b []byte) (tx *Tx, offs int) {
 	tx.Version = binary.LittleEndian.Uint32(b[0:4])
 	offs = 4
 
+	// BIP-144 marker and flag
+	if b[offs]==0 {
+		if b[offs+1]!=1 {
+			return nil, 0 // unknown flag
+		}
+		tx.SegWit = true
+		offs += 2
+	}
+
 	// TxIn
 	le, n = VLen(b[offs:])
 	if n==0 {
@@ -424,8 +487,42 @@ func NewTx(b []byte) (tx *Tx, offs int) {
 		offs += n
 	}
 
+	if tx.SegWit {
+		wit_start := offs
+		var has_wit bool
+		for i := range tx.TxIn {
+			le, n = VLen(b[offs:])
+			if n==0 {
+				return nil, 0
+			}
+			offs += n
+			if le==0 {
+				continue
+			}
+			has_wit = true
+			tx.TxIn[i].Witness = make([][]byte, le)
+			for j := range tx.TxIn[i].Witness {
+				le, n = VLen(b[offs:])
+				if n==0 {
+					return nil, 0
+				}
+				offs += n
+				tx.TxIn[i].Witness[j] = make([]byte, le)
+				copy(tx.TxIn[i].Witness[j], b[offs:offs+le])
+				offs += le
+			}
+		}
+		if !has_wit {
+			return nil, 0 // superfluous witness record
+		}
+		tx.NoWitSize = uint32(wit_start - 2)
+	} else {
+		tx.NoWitSize = uint32(offs)
+	}
+
 	tx.Lock_time = binary.LittleEndian.Uint32(b[offs:offs+4])
 	offs += 4
+	tx.NoWitSize += 4
 
 	return
 }
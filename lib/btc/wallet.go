@@ -71,9 +71,9 @@ func DeriveNextPublic(public, secret []byte) (out []byte) {
 }
 
 // returns one or two (for stealth) TxOut records
-func NewSpendOutputs(addr *BtcAddr, amount uint64, testnet bool) ([]*TxOut, error) {
+func NewSpendOutputs(addr *BtcAddr, amount uint64, p *ChainParams) ([]*TxOut, error) {
 	if addr.StealthAddr != nil {
-		return MakeStealthTxOuts(addr.StealthAddr, amount, testnet)
+		return MakeStealthTxOuts(addr.StealthAddr, amount, p)
 	} else {
 		out := new(TxOut)
 		out.Value = amount
@@ -38,7 +38,11 @@ func (w *HDWallet) Child(i uint32) (res *HDWallet) {
 	var ha, newkey []byte
 	var chksum [20]byte
 
-	if w.Prefix == Private || w.Prefix == TestPrivate {
+	p, private := hdKeyParams(w.Prefix)
+	if p == nil {
+		panic("HDWallet.Child(): Unexpected Prefix")
+	}
+	if private {
 		pub := PublicFromPrivate(w.Key[1:], true)
 		mac := hmac.New(sha512.New, w.ChCode)
 		if i >= uint32(0x80000000) {
@@ -50,7 +54,7 @@ func (w *HDWallet) Child(i uint32) (res *HDWallet) {
 		ha = mac.Sum(nil)
 		newkey = append([]byte{0}, DeriveNextPrivate(ha[:32], w.Key[1:])...)
 		RimpHash(pub, chksum[:])
-	} else if w.Prefix == Public || w.Prefix == TestPublic {
+	} else {
 		mac := hmac.New(sha512.New, w.ChCode)
 		if i >= uint32(0x80000000) {
 			panic("HDWallet.Child(): Private derivation on Public key")
@@ -60,8 +64,6 @@ func (w *HDWallet) Child(i uint32) (res *HDWallet) {
 		ha = mac.Sum(nil)
 		newkey = DeriveNextPublic(w.Key, ha[:32])
 		RimpHash(w.Key, chksum[:])
-	} else {
-		panic("HDWallet.Child(): Unexpected Prefix")
 	}
 	res = new(HDWallet)
 	res.Prefix = w.Prefix
@@ -117,12 +119,13 @@ func StringWallet(data string) (*HDWallet, error) {
 // Pub returns a new wallet which is the public key version of w.
 // If w is a public key, Pub returns a copy of w
 func (w *HDWallet) Pub() *HDWallet {
-	if w.Prefix == Public || w.Prefix == TestPublic {
+	p, private := hdKeyParams(w.Prefix)
+	if !private {
 		r := new(HDWallet)
 		*r = *w
 		return r
 	} else {
-		return &HDWallet{Prefix: Public, Depth: w.Depth, Checksum: w.Checksum,
+		return &HDWallet{Prefix: p.HDPublic, Depth: w.Depth, Checksum: w.Checksum,
 			I: w.I, ChCode: w.ChCode, Key: PublicFromPrivate(w.Key[1:], true)}
 	}
 }
@@ -145,33 +148,38 @@ func StringAddress(data string) (string, error) {
 		return "", err
 	}
 
-	return NewAddrFromPubkey(w.Key, AddrVerPubkey(w.Prefix == TestPublic || w.Prefix == TestPrivate)).String(), nil
+	a, err := w.PubAddr()
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
 }
 
 // PublicAddress returns base58 encoded public address of the given HD key
-func (w *HDWallet) PubAddr() *BtcAddr {
+func (w *HDWallet) PubAddr() (*BtcAddr, error) {
 	var pub []byte
-	if w.Prefix == Private || w.Prefix == TestPrivate {
+	p, private := hdKeyParams(w.Prefix)
+	if p == nil {
+		return nil, errors.New("HDWallet.PubAddr(): Unexpected Prefix")
+	}
+	if private {
 		pub = PublicFromPrivate(w.Key[1:], true)
 	} else {
 		pub = w.Key
 	}
-	return NewAddrFromPubkey(pub, AddrVerPubkey(w.Prefix == TestPublic || w.Prefix == TestPrivate))
+	if pub == nil {
+		return nil, errors.New("HDWallet.PubAddr(): Invalid key")
+	}
+	return NewAddrFromPubkey(pub, p.AddrVerPubkey), nil
 }
 
 // MasterKey returns a new wallet given a random seed.
-func MasterKey(seed []byte, testnet bool) *HDWallet {
+func MasterKey(seed []byte, p *ChainParams) *HDWallet {
 	key := []byte("Bitcoin seed")
 	mac := hmac.New(sha512.New, key)
 	mac.Write(seed)
 	I := mac.Sum(nil)
-	res := &HDWallet{ChCode: I[len(I)/2:], Key: append([]byte{0}, I[:len(I)/2]...)}
-	if testnet {
-		res.Prefix = TestPrivate
-	} else {
-		res.Prefix = Private
-	}
-	return res
+	return &HDWallet{Prefix: p.HDPrivate, ChCode: I[len(I)/2:], Key: append([]byte{0}, I[:len(I)/2]...)}
 }
 
 // StringCheck is a validation check of a base58-encoded extended key.
@@ -187,13 +195,13 @@ func ByteCheck(dbin []byte) error {
 	}
 
 	// check for correct Public or Private Prefix
-	vb := binary.BigEndian.Uint32(dbin[:4])
-	if vb != Public && vb != Private && vb != TestPublic && vb != TestPrivate {
+	p, private := hdKeyParams(binary.BigEndian.Uint32(dbin[:4]))
+	if p == nil {
 		return errors.New("ByteCheck: Unexpected Prefix")
 	}
 
 	// if Public, check x coord is on curve
-	if vb == Public || vb == TestPublic {
+	if !private {
 		var xy secp256k1.XY
 		xy.ParsePubkey(dbin[45:78])
 		if !xy.IsValid() {
@@ -203,19 +211,25 @@ func ByteCheck(dbin []byte) error {
 	return nil
 }
 
+// Returns parameters of the chain using the given HD key prefix (nil if unknown)
+// and whether the prefix is the one of a private key.
+func hdKeyParams(prefix uint32) (p *ChainParams, private bool) {
+	for _, p = range AllChainParams {
+		if prefix == p.HDPrivate {
+			return p, true
+		}
+		if prefix == p.HDPublic {
+			return p, false
+		}
+	}
+	return nil, false
+}
+
 // Returns first 32 bits, as expected for sepcific HD address
 func HDKeyPrefix(private, testnet bool) uint32 {
 	if private {
-		if testnet {
-			return TestPrivate
-		} else {
-			return Private
-		}
+		return GetChainParams(testnet).HDPrivate
 	} else {
-		if testnet {
-			return TestPublic
-		} else {
-			return Public
-		}
+		return GetChainParams(testnet).HDPublic
 	}
 }
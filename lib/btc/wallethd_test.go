@@ -49,7 +49,7 @@ func testChild(t *testing.T, key, ref_key string, i uint32) {
 }
 
 func testMasterKey(t *testing.T, seed []byte, ref_key string) {
-    masterprv := MasterKey(seed, false).String()
+    masterprv := MasterKey(seed, &MainNetParams).String()
     if masterprv != ref_key {
         t.Errorf("\n%s\nsupposed to be\n%s",masterprv,ref_key)
     }
@@ -169,6 +169,14 @@ func TestAddress(t *testing.T) {
     }
 }
 
+func TestPubAddrPrefix(t *testing.T) {
+    w, _ := StringWallet(m_pub2)
+    w.Prefix = 0x12345678
+    if _, err := w.PubAddr(); err == nil {
+        t.Error("PubAddr should have failed for an unknown prefix")
+    }
+}
+
 func TestStringCheck(t *testing.T) {
     if err := StringCheck(m_pub2); err != nil {
         t.Errorf("%s should have been nil",err.Error())
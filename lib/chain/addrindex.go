@@ -0,0 +1,448 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/qdb"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	NumberOfAddrIndexSubDBs = 0x10
+	addrIndexRecSize        = 84
+	addrIndexHdrSize        = 36
+
+	// Commit the changes (during the initial sync) when so many records are pending
+	addrIndexMaxPending = 0x40000
+)
+
+/*
+Optional index of all the outputs by their pk_script, kept in the "addrindex" folder.
+The addr/ databases are keyed by the first 8 bytes of sha256(pk_script). Their values
+are the remaining 24 bytes of the hash, followed by the number of the script's outputs (LSB 32 bits).
+
+The recs/ databases keep one record per output. The n-th output of the script (counting from zero)
+is keyed by the first 8 bytes of sha256(script's hash + n as LSB 32 bits). The value (all LSB):
+
+	[0:32]  - the script's hash
+	[32:36] - n
+	followed by the output's record of 84 bytes:
+	[0:32]  - txid
+	[32:36] - output index
+	[36:40] - height of the block with the transaction
+	[40:48] - value
+	[48:80] - txid that has spent the output (all zeros if not spent)
+	[80:84] - height of the block with the spending transaction
+
+The outs/ databases keep the outputs not spent yet (keyed by TxPrevOut.UIdx()), so the
+spending transactions can be assigned to the right records. Their values:
+
+	[0:32]  - txid
+	[32:36] - output index
+	[36:68] - sha256(pk_script)
+	[68:72] - n (which one of the script's outputs it is)
+
+All the databases belong to one qdb.Batch, so their changes go to disk in commits, together
+with the "lastblock" file (hash of the last indexed block, followed by its 32-bit height).
+After a crash, the index is at the last commit, so no block gets indexed twice.
+*/
+type AddrIndex struct {
+	LastBlockHash   []byte
+	LastBlockHeight uint32
+	dir             string
+	adb             [NumberOfAddrIndexSubDBs]*qdb.DB
+	rdb             [NumberOfAddrIndexSubDBs]*qdb.DB
+	odb             [NumberOfAddrIndexSubDBs]*qdb.DB
+	batch           *qdb.Batch
+	committed       []byte     // hash of the last block, as in the "lastblock" file
+	mutex           sync.Mutex // protects the databases, as Get is also called from outside the chain's thread
+}
+
+// One output of the given pk_script
+type AddrOut struct {
+	btc.TxPrevOut
+	Height      uint32
+	Value       uint64
+	SpentBy     *btc.Uint256 // nil if not spent
+	SpentHeight uint32
+}
+
+func NewAddrIndex(dir string) (ai *AddrIndex) {
+	ai = new(AddrIndex)
+	ai.dir = dir + "addrindex" + string(os.PathSeparator)
+	os.MkdirAll(ai.dir, 0770)
+	ai.batch = qdb.NewBatch(ai.dir + "batch")
+	if e := qdb.RecoverBatch(ai.dir + "batch"); e != nil {
+		println("Address index not recovered:", e.Error()) // it will be built from scratch
+	} else if d, _ := ioutil.ReadFile(ai.dir + "lastblock"); len(d) == 36 {
+		ai.LastBlockHash = d[:32]
+		ai.LastBlockHeight = binary.LittleEndian.Uint32(d[32:36])
+		ai.committed = append([]byte{}, ai.LastBlockHash...)
+	}
+	return
+}
+
+func (ai *AddrIndex) dbN(tdb *[NumberOfAddrIndexSubDBs]*qdb.DB, sub string, i int) *qdb.DB {
+	if tdb[i] == nil {
+		qdb.NewDBExt(&tdb[i], ai.dir+sub+string(os.PathSeparator)+fmt.Sprintf("%06d", i), true, nil, 100000)
+		ai.batch.Add(tdb[i])
+	}
+	return tdb[i]
+}
+
+func (ai *AddrIndex) addrDB(sh []byte) (*qdb.DB, qdb.KeyType) {
+	return ai.dbN(&ai.adb, "addr", int(sh[31])%NumberOfAddrIndexSubDBs), qdb.KeyType(binary.LittleEndian.Uint64(sh[:8]))
+}
+
+func (ai *AddrIndex) recsDB(sh []byte, n uint32) (*qdb.DB, qdb.KeyType) {
+	var d [36]byte
+	copy(d[:32], sh)
+	binary.LittleEndian.PutUint32(d[32:36], n)
+	h := btc.Sha2Sum(d[:])
+	return ai.dbN(&ai.rdb, "recs", int(sh[31])%NumberOfAddrIndexSubDBs), qdb.KeyType(binary.LittleEndian.Uint64(h[:8]))
+}
+
+func (ai *AddrIndex) outsDB(po *btc.TxPrevOut) (*qdb.DB, qdb.KeyType) {
+	return ai.dbN(&ai.odb, "outs", int(po.Hash[31])%NumberOfAddrIndexSubDBs), qdb.KeyType(po.UIdx())
+}
+
+// Returns the number of the script's outputs. ok is false if the first 64 bits
+// of the script's hash collide with another script (should never happen).
+func (ai *AddrIndex) outCount(sh []byte) (cnt uint32, ok bool) {
+	_db, key := ai.addrDB(sh)
+	v := _db.Get(key)
+	if v == nil {
+		return 0, true
+	}
+	if !bytes.Equal(v[:24], sh[8:32]) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(v[24:28]), true
+}
+
+func (ai *AddrIndex) setOutCount(sh []byte, cnt uint32) {
+	_db, key := ai.addrDB(sh)
+	if cnt == 0 {
+		_db.Del(key)
+		return
+	}
+	v := make([]byte, 28)
+	copy(v[:24], sh[8:32])
+	binary.LittleEndian.PutUint32(v[24:28], cnt)
+	_db.PutExt(key, v, qdb.NO_CACHE)
+}
+
+// Returns the record of the script's n-th output (nil if not found)
+func (ai *AddrIndex) getRec(sh []byte, n uint32) []byte {
+	_db, key := ai.recsDB(sh, n)
+	v := _db.Get(key)
+	if len(v) != addrIndexHdrSize+addrIndexRecSize || !bytes.Equal(v[:32], sh) ||
+		binary.LittleEndian.Uint32(v[32:36]) != n {
+		return nil
+	}
+	return v[addrIndexHdrSize:]
+}
+
+func (ai *AddrIndex) putRec(sh []byte, n uint32, rec []byte) {
+	v := make([]byte, addrIndexHdrSize+addrIndexRecSize)
+	copy(v[:32], sh)
+	binary.LittleEndian.PutUint32(v[32:36], n)
+	copy(v[addrIndexHdrSize:], rec)
+	_db, key := ai.recsDB(sh, n)
+	_db.PutExt(key, v, qdb.NO_CACHE)
+}
+
+// Calls upd with a copy of the record of the script's n-th output, then stores it back
+func (ai *AddrIndex) updateRec(sh []byte, n uint32, upd func(rec []byte)) {
+	if v := ai.getRec(sh, n); v != nil {
+		rec := make([]byte, addrIndexRecSize)
+		copy(rec, v)
+		upd(rec)
+		ai.putRec(sh, n, rec)
+	}
+}
+
+func (ai *AddrIndex) putOut(po *btc.TxPrevOut, sh []byte, n uint32) {
+	v := make([]byte, 72)
+	copy(v[:32], po.Hash[:])
+	binary.LittleEndian.PutUint32(v[32:36], po.Vout)
+	copy(v[36:68], sh)
+	binary.LittleEndian.PutUint32(v[68:72], n)
+	_db, key := ai.outsDB(po)
+	_db.PutExt(key, v, qdb.NO_CACHE)
+}
+
+// Adds outputs of the block, that has just been put on top of the main chain, and marks the spent ones
+func (ai *AddrIndex) AddBlock(bl *btc.Block, height uint32, sync bool) {
+	ai.mutex.Lock()
+	defer ai.mutex.Unlock()
+	for _, tx := range bl.Txs {
+		if !tx.IsCoinBase() {
+			for _, in := range tx.TxIn {
+				_odb, okey := ai.outsDB(&in.Input)
+				v := _odb.Get(okey)
+				if v == nil || binary.LittleEndian.Uint32(v[32:36]) != in.Input.Vout || !bytes.Equal(v[:32], in.Input.Hash[:]) {
+					continue
+				}
+				sh := append([]byte{}, v[36:68]...)
+				ai.updateRec(sh, binary.LittleEndian.Uint32(v[68:72]), func(rec []byte) {
+					copy(rec[48:80], tx.Hash.Hash[:])
+					binary.LittleEndian.PutUint32(rec[80:84], height)
+				})
+				_odb.Del(okey)
+			}
+		}
+		for vout, out := range tx.TxOut {
+			if len(out.Pk_script) > 0 && out.Pk_script[0] == btc.OP_RETURN {
+				continue // provably unspendable
+			}
+			sh := btc.Sha2Sum(out.Pk_script)
+			n, ok := ai.outCount(sh[:])
+			if !ok {
+				continue
+			}
+			for {
+				if _db, key := ai.recsDB(sh[:], n); _db.Get(key) == nil {
+					break
+				}
+				n++ // the key is taken by another record (should never happen), so skip this n
+			}
+			po := btc.TxPrevOut{Hash: tx.Hash.Hash, Vout: uint32(vout)}
+			rec := make([]byte, addrIndexRecSize)
+			copy(rec[:32], po.Hash[:])
+			binary.LittleEndian.PutUint32(rec[32:36], po.Vout)
+			binary.LittleEndian.PutUint32(rec[36:40], height)
+			binary.LittleEndian.PutUint64(rec[40:48], out.Value)
+			ai.putRec(sh[:], n, rec)
+			ai.setOutCount(sh[:], n+1)
+			ai.putOut(&po, sh[:], n)
+		}
+	}
+	ai.LastBlockHash = bl.Hash.Hash[:]
+	ai.LastBlockHeight = height
+	if sync || ai.batch.Pending() > addrIndexMaxPending {
+		ai.sync()
+	}
+}
+
+// Reverts the block, that has just been taken off the main chain.
+// addback are the outputs that it had spent (as passed to UnspentDB.UndoBlockTxs).
+func (ai *AddrIndex) UndoBlock(bl *btc.Block, addback []*QdbRec) {
+	ai.mutex.Lock()
+	defer ai.mutex.Unlock()
+	spent := make(map[[32]byte]*QdbRec, len(addback))
+	for _, rec := range addback {
+		spent[rec.TxID] = rec
+	}
+	for i := len(bl.Txs) - 1; i >= 0; i-- {
+		tx := bl.Txs[i]
+		// The block's outputs are the most recent ones of their scripts, so go backwards
+		for vout := len(tx.TxOut) - 1; vout >= 0; vout-- {
+			sh := btc.Sha2Sum(tx.TxOut[vout].Pk_script)
+			po := btc.TxPrevOut{Hash: tx.Hash.Hash, Vout: uint32(vout)}
+			if n, ok := ai.outCount(sh[:]); ok && n > 0 {
+				if rec := ai.getRec(sh[:], n-1); rec != nil &&
+					binary.LittleEndian.Uint32(rec[32:36]) == po.Vout && bytes.Equal(rec[:32], po.Hash[:]) {
+					_db, key := ai.recsDB(sh[:], n-1)
+					_db.Del(key)
+					n--
+					for n > 0 && ai.getRec(sh[:], n-1) == nil {
+						n-- // drop the numbers skipped by AddBlock
+					}
+					ai.setOutCount(sh[:], n)
+				}
+			}
+			_odb, okey := ai.outsDB(&po)
+			_odb.Del(okey)
+		}
+		if i == 0 {
+			continue
+		}
+		for _, in := range tx.TxIn {
+			rec := spent[in.Input.Hash]
+			if rec == nil || int(in.Input.Vout) >= len(rec.Outs) || rec.Outs[in.Input.Vout] == nil {
+				continue // the output was created by this block, so it is gone already
+			}
+			sh := btc.Sha2Sum(rec.Outs[in.Input.Vout].PKScr)
+			cnt, _ := ai.outCount(sh[:])
+			for n := cnt; n > 0; n-- {
+				if r := ai.getRec(sh[:], n-1); r != nil &&
+					binary.LittleEndian.Uint32(r[32:36]) == in.Input.Vout && bytes.Equal(r[:32], in.Input.Hash[:]) {
+					ai.updateRec(sh[:], n-1, func(rec []byte) {
+						for k := 48; k < 84; k++ {
+							rec[k] = 0
+						}
+					})
+					ai.putOut(&in.Input, sh[:], n-1)
+					break
+				}
+			}
+		}
+	}
+	ai.LastBlockHash = btc.NewUint256(bl.ParentHash()).Hash[:]
+	ai.LastBlockHeight--
+	ai.sync()
+}
+
+// Returns all the outputs of the given pk_script, in the order they appeared in the chain,
+// as well as the height of the last indexed block.
+func (ai *AddrIndex) Get(pkscr []byte) (res []*AddrOut, height uint32) {
+	ai.mutex.Lock()
+	defer ai.mutex.Unlock()
+	height = ai.LastBlockHeight
+	sh := btc.Sha2Sum(pkscr)
+	cnt, _ := ai.outCount(sh[:])
+	var zero [32]byte
+	for n := uint32(0); n < cnt; n++ {
+		rec := ai.getRec(sh[:], n)
+		if rec == nil {
+			continue
+		}
+		o := new(AddrOut)
+		copy(o.Hash[:], rec[:32])
+		o.Vout = binary.LittleEndian.Uint32(rec[32:36])
+		o.Height = binary.LittleEndian.Uint32(rec[36:40])
+		o.Value = binary.LittleEndian.Uint64(rec[40:48])
+		if !bytes.Equal(rec[48:80], zero[:]) {
+			o.SpentBy = btc.NewUint256(rec[48:80])
+			o.SpentHeight = binary.LittleEndian.Uint32(rec[80:84])
+		}
+		res = append(res, o)
+	}
+	return
+}
+
+func (ai *AddrIndex) allDBs(f func(db *qdb.DB)) {
+	for i := range ai.adb {
+		for _, db := range []*qdb.DB{ai.adb[i], ai.rdb[i], ai.odb[i]} {
+			if db != nil {
+				f(db)
+			}
+		}
+	}
+}
+
+// Commit all the changes to disk, together with the last block
+func (ai *AddrIndex) Sync() {
+	ai.mutex.Lock()
+	ai.sync()
+	ai.mutex.Unlock()
+}
+
+func (ai *AddrIndex) sync() {
+	if ai.LastBlockHash == nil || bytes.Equal(ai.LastBlockHash, ai.committed) && ai.batch.Pending() == 0 {
+		return
+	}
+	ai.batch.WriteFile("lastblock", lastBlockMarker(ai.LastBlockHash, ai.LastBlockHeight))
+	if e := ai.batch.Commit(); e != nil {
+		println("AddrIndex commit failed:", e.Error())
+		return
+	}
+	ai.committed = append(ai.committed[:0], ai.LastBlockHash...)
+}
+
+// Call it when the main thread is idle - this will do DB defrag
+func (ai *AddrIndex) Idle() bool {
+	var dbs []*qdb.DB
+	ai.mutex.Lock()
+	ai.allDBs(func(db *qdb.DB) { dbs = append(dbs, db) })
+	ai.mutex.Unlock()
+	for _, db := range dbs {
+		if db.Defrag() {
+			return true
+		}
+	}
+	return false
+}
+
+// Commit the data and close all the files
+func (ai *AddrIndex) Close() {
+	ai.mutex.Lock()
+	defer ai.mutex.Unlock()
+	ai.sync()
+	ai.allDBs(func(db *qdb.DB) { db.Close() })
+	for i := range ai.adb {
+		ai.adb[i] = nil
+		ai.rdb[i] = nil
+		ai.odb[i] = nil
+	}
+}
+
+func (ai *AddrIndex) GetStats() (s string) {
+	var na, nr, no int
+	ai.mutex.Lock()
+	defer ai.mutex.Unlock()
+	for i := range ai.adb {
+		na += ai.dbN(&ai.adb, "addr", i).Count()
+		nr += ai.dbN(&ai.rdb, "recs", i).Count()
+		no += ai.dbN(&ai.odb, "outs", i).Count()
+	}
+	return fmt.Sprintf("ADDRINDEX: %d scripts, %d outputs, %d unspent.  Last block: %d\n", na, nr, no, ai.LastBlockHeight)
+}
+
+// Brings the address index in line with the main chain, using the block database.
+// Indexed blocks that are not in the main chain anymore get reverted first. If the last
+// indexed block is unknown (or cannot be reverted), the index is built from scratch.
+func (ch *Chain) syncAddrIndex() (e error) {
+	ai := ch.AddrIndex
+	var start *BlockTreeNode
+	if ai.LastBlockHash != nil {
+		start = ch.BlockIndex[btc.NewUint256(ai.LastBlockHash).BIdx()]
+	}
+	if start != nil && (start.Height > ch.BlockTreeEnd.Height || ch.BlockTreeEnd.FindAncestor(start.Height) != start) {
+		// The outputs spent by the reverted blocks are needed, so get their undo data
+		fork := ch.BlockTreeEnd.FirstCommonParent(start)
+		ubs, er := ch.prepareUndo(start, fork)
+		for i := 0; er == nil && i < len(ubs); i++ {
+			var bl *btc.Block
+			if bl, er = ch.getBlock(ubs[i].node); er == nil && ubs[i].spent == nil {
+				ubs[i].addback, er = ch.Unspent.GetUndoData(bl, ubs[i].node.Height)
+			}
+			if er == nil {
+				ai.UndoBlock(bl, ubs[i].addback)
+			}
+		}
+		if er != nil {
+			start = nil
+		} else {
+			start = fork
+		}
+	}
+
+	if start == nil {
+		if ch.BlockTreeEnd != ch.BlockTreeRoot {
+			fmt.Println("Building the address index from the block database...")
+		}
+		ai.Close()
+		os.RemoveAll(ai.dir)
+		os.MkdirAll(ai.dir, 0770)
+		ai.batch = qdb.NewBatch(ai.dir + "batch")
+		ai.LastBlockHash = nil
+		ai.committed = nil
+		start = ch.BlockTreeRoot
+	}
+
+	prv := time.Now().UnixNano()
+	for n := start.FindPathTo(ch.BlockTreeEnd); n != nil; n = n.FindPathTo(ch.BlockTreeEnd) {
+		if AbortNow {
+			return errors.New("Aborted")
+		}
+		var bl *btc.Block
+		if bl, e = ch.getBlock(n); e != nil {
+			return
+		}
+		ai.AddBlock(bl, n.Height, false)
+		if now := time.Now().UnixNano(); now-prv >= 10e9 {
+			fmt.Println("Indexing addresses ...", n.Height, "/", ch.BlockTreeEnd.Height)
+			prv = now
+		}
+	}
+	ai.Sync()
+	return
+}
@@ -11,8 +11,8 @@ import (
 )
 
 func (ch *Chain) CheckBlock(bl *btc.Block) (er error, dos bool, maybelater bool) {
-	// Size limits
-	if len(bl.Raw) < 81 || len(bl.Raw) > btc.MAX_BLOCK_SIZE {
+	// Size limits (block's weight is never lower than its size)
+	if len(bl.Raw) < 81 || len(bl.Raw) > btc.MAX_BLOCK_WEIGHT {
 		er = errors.New("CheckBlock() : size limits failed")
 		dos = true
 		return
@@ -59,45 +59,73 @@ func (ch *Chain) CheckBlock(bl *btc.Block) (er error, dos bool, maybelater bool)
 		return
 	}
 
+	// With pruning, the undo data beyond UnwindBufferMaxHistory cannot be rebuilt (the blocks are gone)
+	if prevblk != ch.BlockTreeEnd && ch.Blocks.PruneTarget > 0 &&
+		int(ch.BlockTreeEnd.Height)-int(height) >= UnwindBufferMaxHistory {
+		er = errors.New(fmt.Sprint("CheckBlock: btc.Block ", bl.Hash.String(),
+			" hooks too deep into the pruned chain: ", height, "/", ch.BlockTreeEnd.Height,
+			" (max reorg depth is ", UnwindBufferMaxHistory, " in pruning mode)"))
+		return
+	}
+
+	// Check timestamp against the median time of the previous blocks
+	if bl.BlockTime() <= prevblk.MedianTimePast() {
+		er = errors.New("CheckBlock() : block's timestamp is too early")
+		dos = true
+		return
+	}
+
+	bl.VerifyFlags = ch.GetBlockFlags(prevblk, bl.BlockTime())
+
+	// BIP-113: the finality of transactions is checked against the median time past
+	csv_active := (bl.VerifyFlags & script.VER_CSV) != 0
+	locktime_cutoff := bl.BlockTime()
+	if csv_active {
+		locktime_cutoff = prevblk.MedianTimePast()
+	}
+
+	segwit_active := (bl.VerifyFlags & script.VER_WITNESS) != 0
+
 	// Check proof of work
 	gnwr := ch.GetNextWorkRequired(prevblk, bl.BlockTime())
 	if bl.Bits() != gnwr {
 		println("AcceptBlock() : incorrect proof of work ", bl.Bits, " at block", height, " exp:", gnwr)
 
 		// Here is a "solution" for whatever shit there is in testnet3, that nobody can explain me:
-		if !ch.testnet() || (height%2016) != 0 {
+		if !ch.Params.PowAllowMinDifficulty || (height%2016) != 0 {
 			er = errors.New("CheckBlock: incorrect proof of work")
 			dos = true
 			return
 		}
 	}
 
-	// Count block versions within the Majority Window
-	var majority_v2, majority_v3 uint
-	n := prevblk
-	for cnt := uint(0); cnt < ch.Consensus.Window && n != nil; cnt++ {
-		ver := binary.LittleEndian.Uint32(n.BlockHeader[0:4])
-		if ver >= 2 {
-			majority_v2++
-			if ver >= 3 {
-				majority_v3++
-			}
-		}
-		n = n.Parent
+	if exp, ok := ch.Params.Checkpoints[height]; ok && exp != bl.Hash.String() {
+		er = errors.New(fmt.Sprint("CheckBlock() : block does not match the checkpoint at height ", height))
+		dos = true
+		return
 	}
 
-	if bl.Version() < 2 && majority_v2 >= ch.Consensus.RejectBlock {
+	// Count block versions within the Majority Window
+	majority_v2, majority_v3, majority_v4 := ch.versionMajority(prevblk)
+
+	if bl.Version() < 2 && majority_v2 >= ch.Params.MajorityRejectBlock {
 		er = errors.New("CheckBlock() : Rejected nVersion=1 block")
 		dos = true
 		return
 	}
 
-	if bl.Version() < 3 && majority_v3 >= ch.Consensus.RejectBlock {
+	if bl.Version() < 3 && majority_v3 >= ch.Params.MajorityRejectBlock {
 		er = errors.New("CheckBlock() : Rejected nVersion=2 block")
 		dos = true
 		return
 	}
 
+	if bl.Version() < 4 && majority_v4 >= ch.Params.MajorityRejectBlock {
+		er = errors.New("CheckBlock() : Rejected nVersion=3 block")
+		dos = true
+		return
+	}
+
 	if bl.Txs == nil {
 		er = bl.BuildTxList()
 		if er != nil {
@@ -106,18 +134,17 @@ func (ch *Chain) CheckBlock(bl *btc.Block) (er error, dos bool, maybelater bool)
 		}
 	}
 
+	// Size limits, now when we know how much of the block is the witness data
+	if bl.NoWitnessSize() > btc.MAX_BLOCK_SIZE || bl.Weight() > btc.MAX_BLOCK_WEIGHT {
+		er = errors.New("CheckBlock() : weight limits failed")
+		dos = true
+		return
+	}
+
 	if !bl.Trusted {
-		if bl.Version() >= 2 && majority_v2 >= ch.Consensus.EnforceUpgrade {
-			var exp []byte
-			if height >= 0x800000 {
-				if height >= 0x80000000 {
-					exp = []byte{5, byte(height), byte(height >> 8), byte(height >> 16), byte(height >> 24), 0}
-				} else {
-					exp = []byte{4, byte(height), byte(height >> 8), byte(height >> 16), byte(height >> 24)}
-				}
-			} else {
-				exp = []byte{3, byte(height), byte(height >> 8), byte(height >> 16)}
-			}
+		// BIP-34: coinbase must start with the serialized block height
+		if bl.Version() >= 2 && majority_v2 >= ch.Params.MajorityEnforceUpgrade {
+			exp := btc.CoinbaseHeight(height)
 			if len(bl.Txs[0].TxIn[0].ScriptSig) < len(exp) || !bytes.Equal(exp, bl.Txs[0].TxIn[0].ScriptSig[:len(exp)]) {
 				er = errors.New("CheckBlock() : Unexpected block number in coinbase: " + bl.Hash.String())
 				dos = true
@@ -139,23 +166,146 @@ func (ch *Chain) CheckBlock(bl *btc.Block) (er error, dos bool, maybelater bool)
 			return
 		}
 
+		// On signet, blocks must be signed instead of (well, in addition to) being mined
+		if ch.Params.SignetChallenge != nil {
+			if er = ch.CheckSignetSolution(bl); er != nil {
+				dos = true
+				return
+			}
+		}
+
+		// Check the legacy sigops (without P2SH ones, which need the inputs)
+		var sigops int
+		for i := range bl.Txs {
+			sigops += script.GetLegacySigOpCount(bl.Txs[i])
+		}
+		if sigops > btc.MAX_BLOCK_SIGOPS {
+			er = errors.New("CheckBlock() : out-of-bounds SigOpCount")
+			dos = true
+			return
+		}
+
+		// Check the witness commitment, or that there is no witness data, if not active yet
+		if segwit_active {
+			er = checkWitnessCommitment(bl)
+		} else {
+			for i := range bl.Txs {
+				if bl.Txs[i].HasWitness() {
+					er = errors.New("CheckBlock() : unexpected witness data")
+					break
+				}
+			}
+		}
+		if er != nil {
+			dos = true
+			return
+		}
+
 		// Check transactions - this is the most time consuming task
-		if !CheckTransactions(bl.Txs, height, bl.BlockTime()) {
+		if !CheckTransactions(bl.Txs, height, locktime_cutoff) {
 			er = errors.New("CheckBlock() : CheckTransactions() failed")
 			dos = true
 			return
 		}
 	}
 
-	if bl.BlockTime() >= BIP16SwitchTime {
-		bl.VerifyFlags = script.VER_P2SH
-	} else {
-		bl.VerifyFlags = 0
+	return
+}
+
+// Counts blocks of version 2, 3 and 4 (or higher) within the majority window ending with n
+func (ch *Chain) versionMajority(n *BlockTreeNode) (v2, v3, v4 uint) {
+	for cnt := uint(0); cnt < ch.Params.MajorityWindow && n != nil; cnt++ {
+		ver := binary.LittleEndian.Uint32(n.BlockHeader[0:4])
+		if ver >= 2 {
+			v2++
+			if ver >= 3 {
+				v3++
+				if ver >= 4 {
+					v4++
+				}
+			}
+		}
+		n = n.Parent
+	}
+	return
+}
+
+// Checks if BIP-30 rule needs to be verified for a block on top of prevblk.
+// It does not, once BIP-34 is enforced for all the blocks (so each coinbase has a different
+// height in it) - until BIP34ImpliesBIP30Limit, where heights encoded (by chance)
+// in coinbases from before BIP-34 may come up.
+func (ch *Chain) bip30Needed(prevblk *BlockTreeNode) bool {
+	if prevblk.Height+1 >= BIP34ImpliesBIP30Limit {
+		return true
+	}
+	majority_v2, _, _ := ch.versionMajority(prevblk)
+	return majority_v2 < ch.Params.MajorityRejectBlock
+}
+
+// Returns script verification flags for a block with the given timestamp, on top of prevblk
+func (ch *Chain) GetBlockFlags(prevblk *BlockTreeNode, btime uint32) (flags uint32) {
+	height := prevblk.Height + 1
+
+	if btime >= ch.Params.BIP16Time {
+		flags = script.VER_P2SH
+	}
+
+	_, majority_v3, majority_v4 := ch.versionMajority(prevblk)
+
+	if majority_v3 >= ch.Params.MajorityEnforceUpgrade {
+		flags |= script.VER_DERSIG
+	}
+
+	if majority_v4 >= ch.Params.MajorityEnforceUpgrade {
+		flags |= script.VER_CLTV
+	}
+
+	if height >= ch.Params.CSVHeight {
+		flags |= script.VER_CSV
 	}
 
-	if majority_v3 >= ch.Consensus.EnforceUpgrade {
-		bl.VerifyFlags |= script.VER_DERSIG
+	if height >= ch.Params.SegWitHeight {
+		flags |= script.VER_WITNESS
 	}
 
+	// Soft forks activated with BIP-9 version bits
+	flags |= ch.DeploymentFlags(prevblk)
+
 	return
 }
+
+// Checks the witness commitment in the coinbase transaction (BIP-141).
+// If there is no commitment, none of the transactions may have witness data.
+func checkWitnessCommitment(bl *btc.Block) error {
+	var commitment []byte
+	cb := bl.Txs[0]
+
+	// If there are more commitments, the last one counts
+	for i := len(cb.TxOut) - 1; i >= 0; i-- {
+		scr := cb.TxOut[i].Pk_script
+		if len(scr) >= 38 && bytes.Equal(scr[:6], btc.WitnessCommitmentHeader) {
+			commitment = scr[6:38]
+			break
+		}
+	}
+
+	if commitment == nil {
+		for i := range bl.Txs {
+			if bl.Txs[i].HasWitness() {
+				return errors.New("CheckBlock() : unexpected witness data without commitment")
+			}
+		}
+		return nil
+	}
+
+	// Coinbase's witness must consist of a single 32-byte reserved value
+	if len(cb.TxIn[0].Witness) != 1 || len(cb.TxIn[0].Witness[0]) != 32 {
+		return errors.New("CheckBlock() : invalid witness reserved value")
+	}
+
+	h := btc.Sha2Sum(append(btc.GetWitnessMerkle(bl.Txs), cb.TxIn[0].Witness[0]...))
+	if !bytes.Equal(h[:], commitment) {
+		return errors.New("CheckBlock() : witness merkle commitment mismatch")
+	}
+	return nil
+}
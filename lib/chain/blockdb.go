@@ -8,8 +8,12 @@ import (
 	"fmt"
 	"github.com/golang/snappy/snappy"
 	"github.com/wchh/gocoin/lib/btc"
+	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,24 +23,43 @@ const (
 	BLOCK_INVALID = 0x02
 	BLOCK_COMPRSD = 0x04
 	BLOCK_SNAPPED = 0x08
+	BLOCK_PRUNED  = 0x10
+
+	// The last blocks are never pruned (BIP-159 peers can still ask for them).
+	// A pruned chain cannot be reorganized deeper than UnwindBufferMaxHistory (see CheckBlock).
+	MinBlocksToKeep = 288
 )
 
-var MaxCachedBlocks uint = 500
+var (
+	MaxCachedBlocks uint = 500
+
+	// A new segment file is started when a block would not fit into the current one.
+	// It must be under 4GB, as positions within a segment file are stored as uint32.
+	BlockSegmentSize uint64 = 128 << 20
+)
 
 /*
-	blockchain.dat - contains raw blocks data, no headers, nothing
-	blockchain.new - contains records of 136 bytes (all values LSB):
+	blocks/NNNNNN.dat - segment files with raw blocks data, no headers, nothing (numbered from 000000)
+	blocks/index.dat - contains records of 136 bytes (all values LSB):
 		[0] - flags:
 			bit(0) - "trusted" flag - this block's scripts have been verified
 			bit(1) - "invalid" flag - this block's scripts have failed
 			bit(2) - "compressed" flag - this block's data is compressed
 			bit(3) - "snappy" flag - this block is compressed with snappy (not gzip'ed)
+			bit(4) - "pruned" flag - this block's data has been removed from its segment file
 		[4:36]  - 256-bit block hash
 		[36:40] - 32-bit block height (genesis is 0)
-		[40:48] - 64-bit block pos in blockchain.dat file
+		[40:44] - 32-bit number of the segment file
+		[44:48] - 32-bit block pos in the segment file
 		[48:52] - 32-bit block lenght in bytes
 		[52:56] - 32-bit number of transaction in the block
 		[56:136] - 80 bytes blocks header
+	blocks/defrag.log - only present while a segment file is being replaced (see DefragSegment)
+
+DEPRECATED from version 1.3.0:
+	blockchain.dat - used to contain data of all the blocks
+	blockchain.new - used to contain the same records as blocks/index.dat, except for:
+		[40:48] - 64-bit block pos in blockchain.dat file
 
 DEPRECATED from version 0.9.8:
 	blockchain.idx - used to contain records of 92 bytes (all values LSB):
@@ -55,13 +78,16 @@ DEPRECATED from version 0.9.8:
 */
 
 type oneBl struct {
-	fpos uint64 // where at the block is stored in blockchain.dat
-	blen uint32 // how long the block is in blockchain.dat
+	fnum uint32 // which segment file the block is stored in
+	fpos uint32 // where at the block is stored in the segment file
+	blen uint32 // how long the block is in the segment file
 
-	ipos       int64 // where at the record is stored in blockchain.idx (used to set flags)
+	ipos       int64 // where at the record is stored in index.dat (used to set flags)
+	height     uint32
 	trusted    bool
 	compressed bool
 	snappied   bool
+	pruned     bool
 }
 
 type cacheRecord struct {
@@ -71,11 +97,21 @@ type cacheRecord struct {
 
 type BlockDB struct {
 	dirname    string
+	segdir     string // the "blocks" subfolder
 	blockIndex map[[btc.Uint256IdxLen]byte]*oneBl
-	blockdata  *os.File
+	blockdata  *os.File // the last segment file, where new blocks are appended
+	datanum    uint32   // number of the last segment file
+	datapos    uint64   // where the next block goes in the last segment file
 	blockindx  *os.File
 	mutex      sync.Mutex
 	cache      map[[btc.Uint256IdxLen]byte]*cacheRecord
+	filelock   sync.RWMutex // held while reading a segment file (or replacing it)
+
+	// If not zero, data of the old blocks gets deleted to keep the segment files within this many bytes
+	PruneTarget uint64
+	datasize    uint64            // size of the blocks' data that has not been pruned
+	segdata     map[uint32]uint64 // size of the blocks' data that has not been pruned, per segment file
+	prunedCount int
 }
 
 func NewBlockDB(dir string) (db *BlockDB) {
@@ -86,21 +122,172 @@ func NewBlockDB(dir string) (db *BlockDB) {
 	if db.dirname != "" && db.dirname[len(db.dirname)-1] != '/' && db.dirname[len(db.dirname)-1] != '\\' {
 		db.dirname += "/"
 	}
+	db.segdir = db.dirname + "blocks" + string(os.PathSeparator)
 	db.blockIndex = make(map[[btc.Uint256IdxLen]byte]*oneBl)
+	db.segdata = make(map[uint32]uint64)
 	os.MkdirAll(db.dirname, 0770)
-	db.blockdata, _ = os.OpenFile(db.dirname+"blockchain.dat", os.O_RDWR|os.O_CREATE, 0660)
-	if db.blockdata == nil {
-		panic("Cannot open blockchain.dat")
-	}
+	BlockDBConvertToSegments(db.dirname)
+	os.MkdirAll(db.segdir, 0770)
 
-	db.blockindx, _ = os.OpenFile(db.dirname+"blockchain.new", os.O_RDWR|os.O_CREATE, 0660)
+	db.blockindx, _ = os.OpenFile(db.segdir+"index.dat", os.O_RDWR|os.O_CREATE, 0660)
 	if db.blockindx == nil {
-		panic("Cannot open blockchain.new")
+		panic("Cannot open " + db.segdir + "index.dat")
+	}
+	if e := recoverDefrag(db.segdir, db.blockindx); e != nil {
+		panic("Cannot recover interrupted defragmentation: " + e.Error())
+	}
+
+	db.datanum = lastSegment(db.segdir)
+	db.blockdata, _ = os.OpenFile(segmentName(db.segdir, db.datanum), os.O_RDWR|os.O_CREATE, 0660)
+	if db.blockdata == nil {
+		panic("Cannot open " + segmentName(db.segdir, db.datanum))
 	}
 	db.cache = make(map[[btc.Uint256IdxLen]byte]*cacheRecord, MaxCachedBlocks)
 	return
 }
 
+// Returns true if there is a block database (of any version) in the given folder
+func BlockDBExists(dir string) bool {
+	for _, fn := range []string{"blocks", "blockchain.dat"} {
+		if _, e := os.Stat(dir + fn); e == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func segmentName(segdir string, n uint32) string {
+	return fmt.Sprintf("%s%06d.dat", segdir, n)
+}
+
+// Returns the highest number of the existing segment files
+func lastSegment(segdir string) (n uint32) {
+	fis, _ := ioutil.ReadDir(segdir)
+	for _, fi := range fis {
+		if nam := fi.Name(); len(nam) == 10 && strings.HasSuffix(nam, ".dat") {
+			if v, e := strconv.ParseUint(nam[:6], 10, 32); e == nil && uint32(v) > n {
+				n = uint32(v)
+			}
+		}
+	}
+	return
+}
+
+// Finishes an interrupted compaction of the old (single data file) layout
+func recoverCompaction(dir string) {
+	if _, e := os.Stat(dir + "compact.done"); e == nil {
+		os.Rename(dir+"blockchain.new.tmp", dir+"blockchain.new")
+		os.Rename(dir+"blockchain.dat.tmp", dir+"blockchain.dat")
+	}
+	os.Remove(dir + "blockchain.new.tmp")
+	os.Remove(dir + "blockchain.dat.tmp")
+	os.Remove(dir + "compact.done")
+}
+
+// Moves the blocks from blockchain.dat into segment files, in the "blocks" subfolder.
+// Everything is written into "blocks.tmp" first, which gets renamed once complete.
+// TODO: at some point this function will become obsolete
+func BlockDBConvertToSegments(dir string) {
+	if _, e := os.Stat(dir + "blockchain.dat"); e != nil {
+		return // nothing to convert
+	}
+	if _, e := os.Stat(dir + "blocks"); e == nil {
+		// The conversion has been done, but the old files did not get removed
+		os.Remove(dir + "blockchain.dat")
+		os.Remove(dir + "blockchain.new")
+		return
+	}
+	recoverCompaction(dir)
+
+	fmt.Println("Moving the blocks into segment files of", BlockSegmentSize>>20, "MB - please be patient!")
+	id, _ := ioutil.ReadFile(dir + "blockchain.new")
+	f, e := os.Open(dir + "blockchain.dat")
+	if e != nil {
+		panic(e.Error())
+	}
+	defer f.Close()
+
+	var datlen int64
+	if fi, _ := f.Stat(); fi != nil {
+		datlen = fi.Size()
+	}
+
+	tmpdir := dir + "blocks.tmp" + string(os.PathSeparator)
+	os.RemoveAll(tmpdir)
+	os.MkdirAll(tmpdir, 0770)
+
+	var (
+		fnum           uint32
+		fpos, sofar    uint64
+		out            *os.File
+		buf            []byte
+		blen           uint32
+		validpos, tmp  uint64
+		pruned_records int
+	)
+	nidx := new(bytes.Buffer)
+	for i := 0; i+136 <= len(id); i += 136 {
+		rec := id[i : i+136]
+		if (rec[0] & BLOCK_INVALID) != 0 {
+			continue
+		}
+		blen = binary.LittleEndian.Uint32(rec[48:52])
+		if (rec[0] & BLOCK_PRUNED) != 0 {
+			binary.LittleEndian.PutUint64(rec[40:48], 0)
+			pruned_records++
+		} else {
+			if out == nil || fpos > 0 && fpos+uint64(blen) > BlockSegmentSize {
+				if out != nil {
+					e = out.Close()
+					fnum++
+				}
+				if e == nil {
+					out, e = os.Create(segmentName(tmpdir, fnum))
+				}
+				fpos = 0
+			}
+			if uint32(len(buf)) < blen {
+				buf = make([]byte, blen)
+			}
+			if e == nil {
+				_, e = f.ReadAt(buf[:blen], int64(binary.LittleEndian.Uint64(rec[40:48])))
+			}
+			if e == nil {
+				_, e = out.Write(buf[:blen])
+			}
+			if e != nil {
+				panic("Block database conversion failed: " + e.Error())
+			}
+			binary.LittleEndian.PutUint32(rec[40:44], fnum)
+			binary.LittleEndian.PutUint32(rec[44:48], uint32(fpos))
+			fpos += uint64(blen)
+
+			tmp = sofar + uint64(blen)
+			if ((tmp ^ sofar) >> 20) != 0 {
+				fmt.Printf("\r%d / %d MB moved so far  ", tmp>>20, datlen>>20)
+			}
+			sofar = tmp
+		}
+		nidx.Write(rec)
+		validpos += 136
+	}
+	fmt.Println()
+	if out != nil {
+		out.Close()
+	}
+
+	fmt.Println("Almost there - just save the new index file... don't you dare to stop now!")
+	if e = ioutil.WriteFile(tmpdir+"index.dat", nidx.Bytes(), 0660); e == nil {
+		e = os.Rename(dir+"blocks.tmp", dir+"blocks")
+	}
+	if e != nil {
+		panic("Block database conversion failed: " + e.Error())
+	}
+	os.Remove(dir + "blockchain.dat")
+	os.Remove(dir + "blockchain.new")
+	fmt.Println(validpos/136, "blocks (", pruned_records, "pruned ) moved into", fnum+1, "segment files")
+}
+
 // TODO: at some point this function will become obsolete
 func BlockDBConvertIndexFile(dir string) {
 	f, _ := os.Open(dir + "blockchain.idx")
@@ -207,7 +394,12 @@ func (db *BlockDB) addToCache(h *btc.Uint256, bl []byte) {
 
 func (db *BlockDB) GetStats() (s string) {
 	db.mutex.Lock()
-	s += fmt.Sprintf("BlockDB: %d blocks, %d in cache\n", len(db.blockIndex), len(db.cache))
+	s += fmt.Sprintf("BlockDB: %d blocks, %d in cache, %d segment files (up to %d MB)\n", len(db.blockIndex),
+		len(db.cache), len(db.segdata), BlockSegmentSize>>20)
+	if db.PruneTarget > 0 {
+		s += fmt.Sprintf(" Pruned: %d blocks.  Data: %d MB, limit %d MB\n", db.prunedCount,
+			db.datasize>>20, db.PruneTarget>>20)
+	}
 	db.mutex.Unlock()
 	return
 }
@@ -218,20 +410,29 @@ func hash2idx(h []byte) (idx [btc.Uint256IdxLen]byte) {
 }
 
 func (db *BlockDB) BlockAdd(height uint32, bl *btc.Block) (e error) {
-	var pos int64
 	var flagz [4]byte
 
-	pos, e = db.blockdata.Seek(0, os.SEEK_END)
-	if e != nil {
-		panic(e.Error())
-	}
-
 	flagz[0] |= BLOCK_COMPRSD | BLOCK_SNAPPED // gzip compression is deprecated
 	cbts, _ := snappy.Encode(nil, bl.Raw)
 
 	blksize := uint32(len(cbts))
 
-	_, e = db.blockdata.Write(cbts)
+	if db.datapos > 0 && db.datapos+uint64(blksize) > BlockSegmentSize {
+		// Start a new segment file
+		db.blockdata.Sync()
+		db.blockdata.Close()
+		f, e := os.OpenFile(segmentName(db.segdir, db.datanum+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+		if e != nil {
+			panic(e.Error())
+		}
+		db.mutex.Lock()
+		db.blockdata = f
+		db.datanum++
+		db.datapos = 0
+		db.mutex.Unlock()
+	}
+
+	_, e = db.blockdata.WriteAt(cbts, int64(db.datapos))
 	if e != nil {
 		panic(e.Error())
 	}
@@ -244,14 +445,18 @@ func (db *BlockDB) BlockAdd(height uint32, bl *btc.Block) (e error) {
 	db.blockindx.Write(flagz[:])
 	db.blockindx.Write(bl.Hash.Hash[0:32])
 	binary.Write(db.blockindx, binary.LittleEndian, uint32(height))
-	binary.Write(db.blockindx, binary.LittleEndian, uint64(pos))
+	binary.Write(db.blockindx, binary.LittleEndian, db.datanum)
+	binary.Write(db.blockindx, binary.LittleEndian, uint32(db.datapos))
 	binary.Write(db.blockindx, binary.LittleEndian, blksize)
 	binary.Write(db.blockindx, binary.LittleEndian, uint32(bl.TxCount))
 	db.blockindx.Write(bl.Raw[:80])
 
 	db.mutex.Lock()
-	db.blockIndex[bl.Hash.BIdx()] = &oneBl{fpos: uint64(pos),
-		blen: blksize, ipos: ipos, trusted: bl.Trusted, compressed: true, snappied: true}
+	db.blockIndex[bl.Hash.BIdx()] = &oneBl{fnum: db.datanum, fpos: uint32(db.datapos), blen: blksize,
+		ipos: ipos, height: height, trusted: bl.Trusted, compressed: true, snappied: true}
+	db.datapos += uint64(blksize)
+	db.datasize += uint64(blksize)
+	db.segdata[db.datanum] += uint64(blksize)
 	db.addToCache(bl.Hash, bl.Raw)
 	db.mutex.Unlock()
 	return
@@ -273,6 +478,10 @@ func (db *BlockDB) BlockInvalid(hash []byte) {
 	}
 	//println("mark", btc.NewUint256(hash).String(), "as invalid")
 	db.setBlockFlag(cur, BLOCK_INVALID)
+	if !cur.pruned {
+		db.datasize -= uint64(cur.blen)
+		db.segdata[cur.fnum] -= uint64(cur.blen)
+	}
 	delete(db.blockIndex, idx)
 	db.mutex.Unlock()
 }
@@ -289,13 +498,13 @@ func (db *BlockDB) BlockTrusted(hash []byte) {
 	if !cur.trusted {
 		//fmt.Println("mark", btc.NewUint256(hash).String(), "as trusted")
 		db.setBlockFlag(cur, BLOCK_TRUSTED)
+		cur.trusted = true
 	}
 	db.mutex.Unlock()
 }
 
 func (db *BlockDB) setBlockFlag(cur *oneBl, fl byte) {
 	var b [1]byte
-	cur.trusted = true
 	cpos, _ := db.blockindx.Seek(0, os.SEEK_CUR) // remember our position
 	db.blockindx.ReadAt(b[:], cur.ipos)
 	b[0] |= fl
@@ -314,6 +523,56 @@ func (db *BlockDB) Close() {
 	db.blockdata.Close()
 }
 
+// Returns heights of the blocks with valid records in the index file (before LoadBlockIndex is called)
+func (db *BlockDB) indexHeights() (res map[[btc.Uint256IdxLen]byte]uint32) {
+	var b [136]byte
+	res = make(map[[btc.Uint256IdxLen]byte]uint32)
+	for pos := int64(0); ; pos += 136 {
+		if _, e := db.blockindx.ReadAt(b[:], pos); e != nil {
+			return
+		}
+		if (b[0] & BLOCK_INVALID) == 0 {
+			res[hash2idx(b[4:36])] = binary.LittleEndian.Uint32(b[36:40])
+		}
+	}
+}
+
+// Appends records of the blocks known only from their headers to the index file (before
+// LoadBlockIndex is called). They have no data, so they are marked as pruned.
+// hdrs are the headers of the blocks from the given height on. The ones in known are skipped.
+func (db *BlockDB) addHeaders(height uint32, hdrs []byte, known map[[btc.Uint256IdxLen]byte]uint32) (e error) {
+	fi, e := db.blockindx.Stat()
+	if e != nil {
+		return
+	}
+	var b [136]byte
+	buf := new(bytes.Buffer)
+	for off := 0; off+80 <= len(hdrs); off += 80 {
+		hash := btc.NewSha2Hash(hdrs[off : off+80])
+		if _, ok := known[hash.BIdx()]; !ok {
+			b[0] = BLOCK_PRUNED
+			copy(b[4:36], hash.Hash[:])
+			binary.LittleEndian.PutUint32(b[36:40], height)
+			binary.LittleEndian.PutUint32(b[40:44], db.datanum) // no position, length nor number of transactions
+			copy(b[56:136], hdrs[off:off+80])
+			buf.Write(b[:])
+		}
+		height++
+	}
+	if _, e = db.blockindx.WriteAt(buf.Bytes(), fi.Size()-fi.Size()%136); e == nil {
+		e = db.blockindx.Sync()
+	}
+	return
+}
+
+// Returns number of the blocks without their data (pruned, or known only from their headers)
+func (db *BlockDB) PrunedCount() (cnt int) {
+	db.mutex.Lock()
+	cnt = db.prunedCount
+	db.mutex.Unlock()
+	return
+}
+
 func (db *BlockDB) BlockGet(hash *btc.Uint256) (bl []byte, trusted bool, e error) {
 	db.mutex.Lock()
 	rec, ok := db.blockIndex[hash.BIdx()]
@@ -324,27 +583,36 @@ func (db *BlockDB) BlockGet(hash *btc.Uint256) (bl []byte, trusted bool, e error
 	}
 
 	trusted = rec.trusted
+	if rec.pruned {
+		db.mutex.Unlock()
+		e = errors.New("btc.Block data has been pruned")
+		return
+	}
 	if crec, hit := db.cache[hash.BIdx()]; hit {
 		bl = crec.data
 		crec.used = time.Now()
 		db.mutex.Unlock()
 		return
 	}
+	fnum, fpos := rec.fnum, rec.fpos
+	db.filelock.RLock() // so the segment file does not get replaced before we read it
 	db.mutex.Unlock()
 
 	bl = make([]byte, rec.blen)
 
 	// we will re-open the data file, to not spoil the writting pointer
-	f, e := os.Open(db.dirname + "blockchain.dat")
+	f, e := os.Open(segmentName(db.segdir, fnum))
 	if e != nil {
+		db.filelock.RUnlock()
 		return
 	}
 
-	_, e = f.Seek(int64(rec.fpos), os.SEEK_SET)
-	if e == nil {
-		_, e = f.Read(bl[:])
-	}
+	_, e = f.ReadAt(bl[:], int64(fpos))
 	f.Close()
+	db.filelock.RUnlock()
+	if e != nil {
+		return
+	}
 
 	if rec.compressed {
 		if rec.snappied {
@@ -356,7 +624,9 @@ func (db *BlockDB) BlockGet(hash *btc.Uint256) (bl []byte, trusted bool, e error
 		}
 	}
 
+	db.mutex.Lock()
 	db.addToCache(hash, bl)
+	db.mutex.Unlock()
 
 	return
 }
@@ -364,16 +634,17 @@ func (db *BlockDB) BlockGet(hash *btc.Uint256) (bl []byte, trusted bool, e error
 func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []byte, height, blen, txs uint32)) (e error) {
 	var b [136]byte
 	var bh, txs uint32
-	var maxdatfilepos int64
+	var maxdatfilepos uint64
 	validpos, _ := db.blockindx.Seek(0, os.SEEK_SET)
 	for !AbortNow {
-		_, e := db.blockindx.Read(b[:])
+		_, e := io.ReadFull(db.blockindx, b[:])
 		if e != nil {
 			break
 		}
 
 		if (b[0] & BLOCK_INVALID) != 0 {
 			// just ignore it
+			validpos += 136
 			continue
 		}
 
@@ -381,8 +652,11 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 		ob.trusted = (b[0] & BLOCK_TRUSTED) != 0
 		ob.compressed = (b[0] & BLOCK_COMPRSD) != 0
 		ob.snappied = (b[0] & BLOCK_SNAPPED) != 0
+		ob.pruned = (b[0] & BLOCK_PRUNED) != 0
 		bh = binary.LittleEndian.Uint32(b[36:40])
-		ob.fpos = binary.LittleEndian.Uint64(b[40:48])
+		ob.height = bh
+		ob.fnum = binary.LittleEndian.Uint32(b[40:44])
+		ob.fpos = binary.LittleEndian.Uint32(b[44:48])
 		ob.blen = binary.LittleEndian.Uint32(b[48:52])
 		txs = binary.LittleEndian.Uint32(b[52:56])
 		ob.ipos = validpos
@@ -390,8 +664,15 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 		BlockHash := b[4:36]
 		db.blockIndex[btc.NewUint256(BlockHash).BIdx()] = ob
 
-		if int64(ob.fpos)+int64(ob.blen) > maxdatfilepos {
-			maxdatfilepos = int64(ob.fpos) + int64(ob.blen)
+		if ob.pruned {
+			db.prunedCount++
+			db.segdata[ob.fnum] += 0 // so the file gets removed, if it is still there
+		} else {
+			db.datasize += uint64(ob.blen)
+			db.segdata[ob.fnum] += uint64(ob.blen)
+			if ob.fnum == db.datanum && uint64(ob.fpos)+uint64(ob.blen) > maxdatfilepos {
+				maxdatfilepos = uint64(ob.fpos) + uint64(ob.blen)
+			}
 		}
 
 		walk(ch, b[4:36], b[56:136], bh, ob.blen, txs)
@@ -399,6 +680,276 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 	}
 	// In case if there was some trash at the end of data or index file, this should truncate it:
 	db.blockindx.Seek(validpos, os.SEEK_SET)
-	db.blockdata.Seek(maxdatfilepos, os.SEEK_SET)
+	db.datapos = maxdatfilepos
+	return
+}
+
+type pruneList []*oneBl
+
+func (l pruneList) Len() int           { return len(l) }
+func (l pruneList) Less(i, j int) bool { return l[i].height < l[j].height }
+func (l pruneList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// If the blocks' data is over PruneTarget, removes the oldest blocks (not higher than max_height)
+// until it gets down to 3/4 of it. A segment file gets deleted as soon as none of its blocks is left.
+// Index records of the pruned blocks, with their headers, stay in the database.
+func (db *BlockDB) Prune(max_height uint32) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.PruneTarget == 0 || db.datasize <= db.PruneTarget {
+		return
+	}
+
+	var lst pruneList
+	for _, ob := range db.blockIndex {
+		if !ob.pruned && ob.height <= max_height {
+			lst = append(lst, ob)
+		}
+	}
+	sort.Sort(lst)
+
+	var cnt int
+	for _, ob := range lst {
+		if db.datasize <= db.PruneTarget-db.PruneTarget/4 {
+			break
+		}
+		db.setBlockFlag(ob, BLOCK_PRUNED)
+		ob.pruned = true
+		db.datasize -= uint64(ob.blen)
+		db.segdata[ob.fnum] -= uint64(ob.blen)
+		cnt++
+	}
+	if cnt == 0 {
+		return
+	}
+	db.prunedCount += cnt
+	for k := range db.cache {
+		if ob := db.blockIndex[k]; ob != nil && ob.pruned {
+			delete(db.cache, k)
+		}
+	}
+	db.blockindx.Sync()
+	db.removeEmptySegments()
+}
+
+// Deletes the segment files (except for the last one) that have no data of not pruned blocks.
+// Call it with the mutex locked.
+func (db *BlockDB) removeEmptySegments() {
+	for n, siz := range db.segdata {
+		if siz == 0 && n != db.datanum {
+			db.filelock.Lock()
+			os.Remove(segmentName(db.segdir, n))
+			db.filelock.Unlock()
+			delete(db.segdata, n)
+		}
+	}
+}
+
+// Returns the numbers of the existing segment files, in ascending order
+func (db *BlockDB) Segments() (res []uint32) {
+	db.mutex.Lock()
+	for n := range db.segdata {
+		res = append(res, n)
+	}
+	if _, ok := db.segdata[db.datanum]; !ok {
+		res = append(res, db.datanum)
+	}
+	db.mutex.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return
+}
+
+// Applies the new positions (and flags) of the blocks from defrag.log to the index file
+// and moves the new segment file (NNNNNN.tmp) in place of the old one.
+func applyDefragLog(segdir string, indx *os.File) (e error) {
+	d, e := ioutil.ReadFile(segdir + "defrag.log")
+	if e != nil {
+		return
+	}
+	if len(d) < 4 || (len(d)-4)%13 != 0 {
+		return errors.New("defrag.log has an unexpected size")
+	}
+	fn := segmentName(segdir, binary.LittleEndian.Uint32(d[:4]))
+	if _, er := os.Stat(fn[:len(fn)-4] + ".tmp"); er == nil {
+		if e = os.Rename(fn[:len(fn)-4]+".tmp", fn); e != nil {
+			return
+		}
+	}
+	var fl [1]byte
+	for i := 4; i < len(d); i += 13 {
+		ipos := int64(binary.LittleEndian.Uint64(d[i : i+8]))
+		if _, e = indx.WriteAt(d[i+8:i+12], ipos+44); e != nil {
+			return
+		}
+		if d[i+12] != 0 {
+			if _, e = indx.ReadAt(fl[:], ipos); e != nil {
+				return
+			}
+			fl[0] |= d[i+12]
+			if _, e = indx.WriteAt(fl[:], ipos); e != nil {
+				return
+			}
+		}
+	}
+	if e = indx.Sync(); e != nil {
+		return
+	}
+	return os.Remove(segdir + "defrag.log")
+}
+
+// Completes the segment defragmentation that got interrupted (if defrag.log is there),
+// or removes whatever it had left behind.
+func recoverDefrag(segdir string, indx *os.File) (e error) {
+	if _, er := os.Stat(segdir + "defrag.log"); er == nil {
+		if e = applyDefragLog(segdir, indx); e != nil {
+			return
+		}
+	}
+	os.Remove(segdir + "defrag.tmp")
+	tmps, _ := ioutil.ReadDir(segdir)
+	for _, fi := range tmps {
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			os.Remove(segdir + fi.Name())
+		}
+	}
+	return
+}
+
+// Rewrites the given segment file without data of the pruned blocks, as well as of the blocks
+// for which keep returns false (these get marked as pruned), if keep is not nil.
+// The last segment file (where the new blocks go) is never touched.
+// Returns the number of bytes that the file has shrunk by.
+func (db *BlockDB) DefragSegment(n uint32, keep func(hash *btc.Uint256) bool) (saved uint64, e error) {
+	type oneMove struct {
+		ob   *oneBl
+		hash *btc.Uint256
+		drop bool
+		fpos uint32
+	}
+	var moves []*oneMove
+	var hash [32]byte
+
+	db.mutex.Lock()
+	if n >= db.datanum {
+		db.mutex.Unlock()
+		return
+	}
+	for _, ob := range db.blockIndex {
+		if ob.fnum == n && !ob.pruned {
+			db.blockindx.ReadAt(hash[:], ob.ipos+4)
+			moves = append(moves, &oneMove{ob: ob, hash: btc.NewUint256(hash[:])})
+		}
+	}
+	db.mutex.Unlock()
+
+	// keep may need to lock the chain, so we must not call it with our mutex locked
+	if keep != nil {
+		for _, m := range moves {
+			m.drop = !keep(m.hash)
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	fn := segmentName(db.segdir, n)
+	fi, e := os.Stat(fn)
+	if e != nil {
+		return
+	}
+	sort.Slice(moves, func(i, j int) bool { return moves[i].ob.fpos < moves[j].ob.fpos })
+
+	var fpos uint64
+	var dropped bool
+	for _, m := range moves {
+		if m.ob.pruned { // pruned in the meantime
+			m.drop = true
+		}
+		if m.drop {
+			dropped = true
+		} else {
+			fpos += uint64(m.ob.blen)
+		}
+	}
+	if !dropped && fpos == uint64(fi.Size()) {
+		return // nothing to gain
+	}
+
+	f, e := os.Open(fn)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	out, e := os.Create(fn[:len(fn)-4] + ".tmp")
+	if e != nil {
+		return
+	}
+	journal := new(bytes.Buffer)
+	binary.Write(journal, binary.LittleEndian, n)
+	var buf []byte
+	fpos = 0
+	for _, m := range moves {
+		binary.Write(journal, binary.LittleEndian, m.ob.ipos)
+		if m.drop {
+			binary.Write(journal, binary.LittleEndian, uint32(0))
+			journal.WriteByte(BLOCK_PRUNED)
+			continue
+		}
+		if uint32(len(buf)) < m.ob.blen {
+			buf = make([]byte, m.ob.blen)
+		}
+		if _, e = f.ReadAt(buf[:m.ob.blen], int64(m.ob.fpos)); e != nil {
+			break
+		}
+		if _, e = out.Write(buf[:m.ob.blen]); e != nil {
+			break
+		}
+		m.fpos = uint32(fpos)
+		binary.Write(journal, binary.LittleEndian, m.fpos)
+		journal.WriteByte(0)
+		fpos += uint64(m.ob.blen)
+	}
+	if e == nil {
+		e = out.Sync()
+	}
+	out.Close()
+	if e == nil {
+		e = ioutil.WriteFile(db.segdir+"defrag.tmp", journal.Bytes(), 0660)
+	}
+	if e == nil {
+		e = os.Rename(db.segdir+"defrag.tmp", db.segdir+"defrag.log")
+	}
+	if e != nil {
+		recoverDefrag(db.segdir, db.blockindx)
+		return
+	}
+
+	// From now on the new file is going to be used, even if we crash
+	db.filelock.Lock()
+	e = applyDefragLog(db.segdir, db.blockindx)
+	db.filelock.Unlock()
+	if e != nil {
+		panic("Segment defragmentation failed: " + e.Error())
+	}
+
+	for _, m := range moves {
+		if m.drop {
+			if !m.ob.pruned {
+				m.ob.pruned = true
+				db.datasize -= uint64(m.ob.blen)
+				db.segdata[n] -= uint64(m.ob.blen)
+				db.prunedCount++
+				delete(db.cache, m.hash.BIdx())
+			}
+		} else {
+			m.ob.fpos = m.fpos
+		}
+	}
+	saved = uint64(fi.Size()) - fpos
+	if fpos == 0 {
+		os.Remove(fn)
+		delete(db.segdata, n)
+	}
 	return
 }
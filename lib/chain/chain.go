@@ -9,12 +9,16 @@ import (
 var AbortNow bool // set it to true to abort any activity
 
 type Chain struct {
-	Blocks  *BlockDB   // blockchain.dat and blockchain.idx
+	Blocks  *BlockDB   // block segment files and their index
 	Unspent *UnspentDB // unspent folder
+	TxIndex *TxIndex   // txindex folder (nil if not enabled)
+
+	AddrIndex *AddrIndex // addrindex folder (nil if not enabled)
 
 	BlockTreeRoot *BlockTreeNode
 	BlockTreeEnd  *BlockTreeNode
-	Genesis       *btc.Uint256
+
+	Params *btc.ChainParams // network this chain belongs to
 
 	BlockIndexAccess sync.Mutex
 	BlockIndex       map[[btc.Uint256IdxLen]byte]*BlockTreeNode
@@ -23,9 +27,7 @@ type Chain struct {
 
 	CB NewChanOpts // callbacks used by Unspent database
 
-	Consensus struct {
-		Window, EnforceUpgrade, RejectBlock uint
-	}
+	vbMutex sync.Mutex // protects the version bits states cache
 }
 
 type NewChanOpts struct {
@@ -36,32 +38,41 @@ type NewChanOpts struct {
 
 	// These two are used only during loading
 	LoadWalk FunctionWalkUnspent // this one is called for each UTXO record that has just been loaded
+
+	PruneTarget uint64 // if not zero, keep the blocks' data within this many bytes (see BlockDB.Prune)
+
+	TxIndex bool // maintain the index of all the transactions in the main chain (see GetTx)
+
+	AddrIndex bool // maintain the history of all the outputs, per pk_script (see AddrIndex.Get)
+
+	// If UtxoSnapshot is set, the unspent database gets replaced with the content of this file,
+	// as written by UnspentDB.ExportSnapshot. It must have the expected UtxoSnapshotHash.
+	UtxoSnapshot     string
+	UtxoSnapshotHash *btc.Uint256
 }
 
-func NewChain(dbrootdir string, genesis *btc.Uint256, rescan bool) (ch *Chain) {
-	return NewChainExt(dbrootdir, genesis, rescan, nil)
+func NewChain(dbrootdir string, params *btc.ChainParams, rescan bool) (ch *Chain) {
+	return NewChainExt(dbrootdir, params, rescan, nil)
 }
 
 // This is the very first function one should call in order to use this package
-func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewChanOpts) (ch *Chain) {
+func NewChainExt(dbrootdir string, params *btc.ChainParams, rescan bool, opts *NewChanOpts) (ch *Chain) {
 	var undo_last_block bool
 	ch = new(Chain)
-	ch.Genesis = genesis
+	ch.Params = params
 	if opts != nil {
 		ch.CB = *opts
 	}
 
-	if ch.testnet() {
-		ch.Consensus.Window = 100
-		ch.Consensus.EnforceUpgrade = 51
-		ch.Consensus.RejectBlock = 75
-	} else {
-		ch.Consensus.Window = 1000
-		ch.Consensus.EnforceUpgrade = 750
-		ch.Consensus.RejectBlock = 950
-	}
-
 	ch.Blocks = NewBlockDB(dbrootdir)
+	ch.Blocks.PruneTarget = ch.CB.PruneTarget
+	if ch.CB.UtxoSnapshot != "" {
+		if e := ch.importUtxoSnapshot(dbrootdir); e != nil {
+			fmt.Println("UTXO snapshot not loaded:", e.Error())
+			AbortNow = true
+			return
+		}
+	}
 	ch.Unspent, undo_last_block = NewUnspentDb(dbrootdir, rescan, ch)
 
 	if AbortNow {
@@ -88,11 +99,27 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 	}
 
 	// And now re-apply the blocks which you have just reverted :)
-	end, _ := ch.BlockTreeRoot.FindFarthestNode()
-	if end.Height > ch.BlockTreeEnd.Height {
-		ch.ParseTillBlock(end)
+	end := ch.BlockTreeRoot.FindBestNode()
+	if end.SumWork.Cmp(ch.BlockTreeEnd.SumWork) > 0 {
+		if e := ch.MoveToBlock(end); e != nil {
+			println(e.Error())
+		}
+	}
+	ch.Unspent.LastBlockHeight = ch.BlockTreeEnd.Height
+
+	if ch.CB.TxIndex {
+		ch.TxIndex = NewTxIndex(dbrootdir)
+		if e := ch.syncTxIndex(); e != nil {
+			fmt.Println("Transaction index not complete:", e.Error())
+		}
+	}
+
+	if ch.CB.AddrIndex {
+		ch.AddrIndex = NewAddrIndex(dbrootdir)
+		if e := ch.syncAddrIndex(); e != nil {
+			fmt.Println("Address index not complete:", e.Error())
+		}
 	}
-	ch.Unspent.LastBlockHeight = end.Height
 
 	return
 }
@@ -102,11 +129,23 @@ func (ch *Chain) Sync() {
 	ch.DoNotSync = false
 	ch.Blocks.Sync()
 	ch.Unspent.Sync()
+	if ch.TxIndex != nil {
+		ch.TxIndex.Sync()
+	}
+	if ch.AddrIndex != nil {
+		ch.AddrIndex.Sync()
+	}
 }
 
 // Call this function periodically (i.e. each second)
 // when your client is idle, to defragment databases.
 func (ch *Chain) Idle() bool {
+	if ch.TxIndex != nil && ch.TxIndex.Idle() {
+		return true
+	}
+	if ch.AddrIndex != nil && ch.AddrIndex.Idle() {
+		return true
+	}
 	return ch.Unspent.Idle()
 }
 
@@ -114,6 +153,19 @@ func (ch *Chain) Idle() bool {
 func (ch *Chain) Save() {
 	ch.Blocks.Sync()
 	ch.Unspent.Save()
+	if ch.TxIndex != nil {
+		ch.TxIndex.Sync()
+	}
+	if ch.AddrIndex != nil {
+		ch.AddrIndex.Sync()
+	}
+}
+
+// Removes data of the old blocks, if the block database is over its PruneTarget
+func (ch *Chain) pruneBlocks() {
+	if ch.BlockTreeEnd.Height > MinBlocksToKeep {
+		ch.Blocks.Prune(ch.BlockTreeEnd.Height - MinBlocksToKeep)
+	}
 }
 
 // Returns detauils of an unspent output, it there is such.
@@ -133,16 +185,25 @@ func (ch *Chain) Stats() (s string) {
 	ch.BlockIndexAccess.Unlock()
 	s += ch.Blocks.GetStats()
 	s += ch.Unspent.GetStats()
+	if ch.TxIndex != nil {
+		s += ch.TxIndex.GetStats()
+	}
+	if ch.AddrIndex != nil {
+		s += ch.AddrIndex.GetStats()
+	}
 	return
 }
 
 // Close the databases.
 func (ch *Chain) Close() {
 	ch.Blocks.Close()
-	ch.Unspent.Close()
-}
-
-// Returns true if we are on Testnet3 chain
-func (ch *Chain) testnet() bool {
-	return ch.Genesis.Hash[0] == 0x43 // it's simple, but works
+	if ch.Unspent != nil {
+		ch.Unspent.Close()
+	}
+	if ch.TxIndex != nil {
+		ch.TxIndex.Close()
+	}
+	if ch.AddrIndex != nil {
+		ch.AddrIndex.Close()
+	}
 }
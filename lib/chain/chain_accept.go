@@ -6,6 +6,7 @@ import (
 	"github.com/wchh/gocoin/lib/btc"
 	"github.com/wchh/gocoin/lib/others/sys"
 	"github.com/wchh/gocoin/lib/script"
+	"math/big"
 )
 
 // TrustedTxChecker is meant to speed up verifying transactions that had
@@ -23,7 +24,7 @@ func (ch *Chain) ProcessBlockTransactions(bl *btc.Block, height, lknown uint32)
 
 // This function either appends a new block at the end of the existing chain
 // in which case it also applies all the transactions to the unspent database.
-// If the block does is not the heighest, it is added to the chain, but maked
+// If the block does not have the most work, it is added to the chain, but maked
 // as an orphan - its transaction will be verified only if the chain would swap
 // to its branch later on.
 func (ch *Chain) AcceptBlock(bl *btc.Block) (e error) {
@@ -41,6 +42,8 @@ func (ch *Chain) AcceptBlock(bl *btc.Block) (e error) {
 	cur.BlockSize = uint32(len(bl.Raw))
 	cur.TxCount = uint32(bl.TxCount)
 	copy(cur.BlockHeader[:], bl.Raw[:80])
+	cur.SumWork = new(big.Int).Add(prevblk.SumWork, BlockWork(cur.Bits()))
+	cur.noSwitch = prevblk.noSwitch
 
 	// Add this block to the block index
 	ch.BlockIndexAccess.Lock()
@@ -69,6 +72,7 @@ func (ch *Chain) AcceptBlock(bl *btc.Block) (e error) {
 				ch.Blocks.Sync()
 			}
 			ch.BlockTreeEnd = cur // Advance the head
+			ch.pruneBlocks()
 		}
 	} else {
 		// The block's parent is not the current head of the chain...
@@ -76,10 +80,10 @@ func (ch *Chain) AcceptBlock(bl *btc.Block) (e error) {
 		// Save the block, though do not makt it as "trusted" just yet
 		ch.Blocks.BlockAdd(cur.Height, bl)
 
-		// If it has a bigger height than the current head,
+		// If it has more work than the current head (a tie goes to the first seen),
 		// ... move the coin state into a new branch.
-		if cur.Height > ch.BlockTreeEnd.Height {
-			ch.MoveToBlock(cur)
+		if cur.SumWork.Cmp(ch.BlockTreeEnd.SumWork) > 0 && !cur.noSwitch {
+			e = ch.MoveToBlock(cur)
 		}
 	}
 
@@ -88,13 +92,25 @@ func (ch *Chain) AcceptBlock(bl *btc.Block) (e error) {
 
 // This isusually the most time consuming process when applying a new block
 func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
-	sumblockin := btc.GetBlockReward(changes.Height)
+	sumblockin := ch.Params.BlockReward(changes.Height)
 	var txoutsum, txinsum, sumblockout uint64
 
 	if int(changes.Height)+UnwindBufferMaxHistory >= int(changes.LastKnownHeight) {
 		changes.UndoData = make(map[[32]byte]*QdbRec)
 	}
 
+	// BIP-30: do not allow a tx to overwrite an older one, which is not fully spent yet
+	// (the block is always being applied on top of BlockTreeEnd)
+	if ch.bip30Needed(ch.BlockTreeEnd) {
+		if exp, ok := ch.Params.BIP30Exceptions[changes.Height]; !ok || exp != bl.Hash.String() {
+			for i := range bl.Txs {
+				if ch.Unspent.TxPresent(bl.Txs[i].Hash) {
+					return errors.New("BIP-30 violation: TxID " + bl.Txs[i].Hash.String() + " already unspent")
+				}
+			}
+		}
+	}
+
 	// Add each tx outs from the current block to the temporary pool
 	blUnsp := make(map[[32]byte][]*btc.TxOut, 4*len(bl.Txs))
 	for i := range bl.Txs {
@@ -106,8 +122,11 @@ func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 	// create a channnel to receive results from VerifyScript threads:
 	done := make(chan bool, sys.UseThreads)
 
+	var sigopscost int
+
 	for i := range bl.Txs {
 		txoutsum, txinsum = 0, 0
+		prevouts := make([]*btc.TxOut, len(bl.Txs[i].TxIn))
 
 		// Check each tx for a valid input, except from the first one
 		if i > 0 {
@@ -123,6 +142,7 @@ func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 			}
 
 			for j := 0; j < len(bl.Txs[i].TxIn); /*&& e==nil*/ j++ {
+				var inheight uint32 // height of the block that has created the input
 				inp := &bl.Txs[i].TxIn[j].Input
 				spendrec, waspent := changes.DeledTxs[inp.Hash]
 				if waspent && spendrec[inp.Vout] {
@@ -157,7 +177,9 @@ func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 
 					tout = t[inp.Vout]
 					t[inp.Vout] = nil // and now mark it as spent:
+					inheight = changes.Height
 				} else {
+					inheight = tout.BlockHeight
 					if tout.WasCoinbase && changes.Height-tout.BlockHeight < COINBASE_MATURITY {
 						e = errors.New("Trying to spend prematured coinbase: " + btc.NewUint256(inp.Hash[:]).String())
 						break
@@ -188,6 +210,11 @@ func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 					}
 				}
 
+				if (bl.VerifyFlags&script.VER_CSV) != 0 && !ch.CheckSequenceLock(bl.Txs[i], j, inheight, changes.Height) {
+					e = errors.New("Relative lock time not reached in TxID: " + bl.Txs[i].Hash.String())
+					break
+				}
+
 				if !(<-done) {
 					println("VerifyScript error 1")
 					scripts_ok = false
@@ -197,12 +224,13 @@ func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 				if tx_trusted {
 					done <- true
 				} else {
-					go func(sig []byte, prv []byte, i int, tx *btc.Tx) {
-						done <- script.VerifyTxScript(sig, prv, i, tx, bl.VerifyFlags)
-					}(bl.Txs[i].TxIn[j].ScriptSig, tout.Pk_script, j, bl.Txs[i])
+					go func(sig []byte, prv []byte, amount uint64, i int, tx *btc.Tx) {
+						done <- script.VerifyTxScript(sig, prv, amount, i, tx, bl.VerifyFlags)
+					}(bl.Txs[i].TxIn[j].ScriptSig, tout.Pk_script, tout.Value, j, bl.Txs[i])
 				}
 
 				txinsum += tout.Value
+				prevouts[j] = tout
 			}
 
 			if scripts_ok {
@@ -230,6 +258,13 @@ func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 		}
 		sumblockin += txinsum
 
+		if e == nil {
+			sigopscost += script.GetSigOpCost(bl.Txs[i], prevouts, bl.VerifyFlags)
+			if sigopscost > btc.MAX_BLOCK_SIGOPS_COST {
+				return errors.New("Too many sigops in the block")
+			}
+		}
+
 		for j := range bl.Txs[i].TxOut {
 			txoutsum += bl.Txs[i].TxOut[j].Value
 		}
@@ -268,9 +303,39 @@ func (ch *Chain) commitTxs(bl *btc.Block, changes *BlockChanges) (e error) {
 		}
 	}
 
+	if ch.TxIndex != nil {
+		ch.TxIndex.AddBlock(bl, changes.Height, changes.LastKnownHeight <= changes.Height)
+	}
+	if ch.AddrIndex != nil {
+		ch.AddrIndex.AddBlock(bl, changes.Height, changes.LastKnownHeight <= changes.Height)
+	}
+
 	return nil
 }
 
+// Checks BIP-68 relative lock time of the given input, spending an output
+// created at inheight, in a block at the given height on top of BlockTreeEnd.
+func (ch *Chain) CheckSequenceLock(tx *btc.Tx, inp int, inheight, height uint32) bool {
+	if tx.Version < 2 {
+		return true
+	}
+	seq := tx.TxIn[inp].Sequence
+	if (seq & btc.SEQUENCE_LOCKTIME_DISABLE_FLAG) != 0 {
+		return true
+	}
+	val := int64(seq & btc.SEQUENCE_LOCKTIME_MASK)
+	if (seq & btc.SEQUENCE_LOCKTIME_TYPE_FLAG) != 0 {
+		// Time based lock is counted from the median time past of the block before the input's one
+		if inheight > 0 {
+			inheight--
+		}
+		mintime := int64(ch.BlockTreeEnd.FindAncestor(inheight).MedianTimePast()) +
+			val<<btc.SEQUENCE_LOCKTIME_GRANULARITY - 1
+		return mintime < int64(ch.BlockTreeEnd.MedianTimePast())
+	}
+	return int64(inheight)+val-1 < int64(height)
+}
+
 // Check transactions for consistency and finality. Return true if OK
 func CheckTransactions(txs []*btc.Tx, height, btime uint32) bool {
 	ok := true
@@ -5,36 +5,46 @@ import (
 	"math/big"
 )
 
-var MaxPOWValue *big.Int // it's var but used as a constant
-
 const (
 	POWRetargetSpam = 14 * 24 * 60 * 60 // two weeks
 	TargetSpacing   = 10 * 60
 	targetInterval  = POWRetargetSpam / TargetSpacing
-	MaxPOWBits      = 0x1d00ffff
 )
 
-func init() {
-	MaxPOWValue, _ = new(big.Int).SetString("00000000FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", 16)
+// Returns the amount of work represented by a block with the given bits,
+// which is 2^256 / (target+1)
+func BlockWork(bits uint32) *big.Int {
+	target := btc.SetCompact(bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	res := new(big.Int).Lsh(big.NewInt(1), 256)
+	return res.Div(res, target.Add(target, big.NewInt(1)))
 }
 
 func (ch *Chain) GetNextWorkRequired(lst *BlockTreeNode, ts uint32) (res uint32) {
+	powLimitBits := ch.Params.PowLimitBits
+
 	// Genesis block
 	if lst.Parent == nil {
-		return MaxPOWBits
+		return powLimitBits
+	}
+
+	if ch.Params.PowNoRetargeting {
+		return lst.Bits()
 	}
 
 	if ((lst.Height + 1) % targetInterval) != 0 {
 		// Special difficulty rule for testnet:
-		if ch.testnet() {
+		if ch.Params.PowAllowMinDifficulty {
 			// If the new block's timestamp is more than 2* 10 minutes
 			// then allow mining of a min-difficulty block.
 			if ts > lst.Timestamp()+TargetSpacing*2 {
-				return MaxPOWBits
+				return powLimitBits
 			} else {
 				// Return the last non-special-min-difficulty-rules-block
 				prv := lst
-				for prv.Parent != nil && (prv.Height%targetInterval) != 0 && prv.Bits() == MaxPOWBits {
+				for prv.Parent != nil && (prv.Height%targetInterval) != 0 && prv.Bits() == powLimitBits {
 					prv = prv.Parent
 				}
 				return prv.Bits()
@@ -62,8 +72,8 @@ func (ch *Chain) GetNextWorkRequired(lst *BlockTreeNode, ts uint32) (res uint32)
 	bnewbn.Mul(bnewbn, big.NewInt(actualTimespan))
 	bnewbn.Div(bnewbn, big.NewInt(POWRetargetSpam))
 
-	if bnewbn.Cmp(MaxPOWValue) > 0 {
-		bnewbn = MaxPOWValue
+	if bnewbn.Cmp(btc.SetCompact(powLimitBits)) > 0 {
+		return powLimitBits
 	}
 
 	res = btc.GetCompact(bnewbn)
@@ -1,6 +1,7 @@
 package chain
 
 import (
+	"encoding/binary"
 	"github.com/wchh/gocoin/lib/btc"
 )
 
@@ -19,12 +20,23 @@ func nextBlock(ch *Chain, hash, header []byte, height, blen, txs uint32) {
 	ch.BlockIndex[v.BlockHash.BIdx()] = v
 }
 
+// Returns the tree node of the genesis block
+func genesisNode(params *btc.ChainParams) (n *BlockTreeNode) {
+	n = new(BlockTreeNode)
+	n.BlockHash = params.Genesis
+	// The genesis block is not in the database, so only fill in the header fields we need
+	binary.LittleEndian.PutUint32(n.BlockHeader[0:4], 1)
+	binary.LittleEndian.PutUint32(n.BlockHeader[68:72], params.GenesisTime)
+	binary.LittleEndian.PutUint32(n.BlockHeader[72:76], params.PowLimitBits)
+	n.SumWork = BlockWork(n.Bits())
+	return
+}
+
 // Loads block index from the disk
 func (ch *Chain) loadBlockIndex() {
 	ch.BlockIndex = make(map[[btc.Uint256IdxLen]byte]*BlockTreeNode, BlockMapInitLen)
-	ch.BlockTreeRoot = new(BlockTreeNode)
-	ch.BlockTreeRoot.BlockHash = ch.Genesis
-	ch.BlockIndex[ch.Genesis.BIdx()] = ch.BlockTreeRoot
+	ch.BlockTreeRoot = genesisNode(ch.Params)
+	ch.BlockIndex[ch.Params.Genesis.BIdx()] = ch.BlockTreeRoot
 
 	ch.Blocks.LoadBlockIndex(ch, nextBlock)
 	tlb := ch.Unspent.LastBlockHash
@@ -48,6 +60,8 @@ func (ch *Chain) loadBlockIndex() {
 		v.Parent = par
 		v.Parent.addChild(v)
 	}
+	// The chain work is not stored in the index, so rebuild it from the headers
+	ch.BlockTreeRoot.setChildsWork()
 	if tlb == nil {
 		//println("No last block - full rescan will be needed")
 		ch.BlockTreeEnd = ch.BlockTreeRoot
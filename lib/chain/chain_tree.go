@@ -2,8 +2,11 @@ package chain
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/wchh/gocoin/lib/btc"
+	"math/big"
+	"sort"
 	"time"
 )
 
@@ -15,6 +18,10 @@ type BlockTreeNode struct {
 	BlockSize   uint32
 	TxCount     uint32
 	BlockHeader [80]byte
+	SumWork     *big.Int // accumulated chain work, including this block
+
+	vbStates []byte // BIP-9 deployment states for the next period (cached in period's last block)
+	noSwitch bool   // the chain could not be moved to this branch (its fork point could not be reverted to)
 }
 
 func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
@@ -53,6 +60,7 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 		}
 
 		bl.Trusted = trusted
+		bl.VerifyFlags = ch.GetBlockFlags(nxt.Parent, bl.BlockTime())
 
 		changes, er := ch.ProcessBlockTransactions(bl, nxt.Height, end.Height)
 		if er != nil {
@@ -67,31 +75,54 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 		ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
 
 		ch.BlockTreeEnd = nxt
+		ch.pruneBlocks()
 	}
 
 	if !AbortNow && ch.BlockTreeEnd != end {
-		end, _ = ch.BlockTreeRoot.FindFarthestNode()
+		end = ch.BlockTreeRoot.FindBestNode()
 		fmt.Println("ParseTillBlock failed - now go to", end.Height)
-		ch.MoveToBlock(end)
+		if e := ch.MoveToBlock(end); e != nil {
+			println("ParseTillBlock:", e.Error())
+		}
 	}
 	ch.Unspent.Sync()
 	ch.Save()
 }
 
 func (n *BlockTreeNode) Timestamp() uint32 {
-	if n.Height == 0 {
-		return GenesisBlockTime
-	} else {
-		return binary.LittleEndian.Uint32(n.BlockHeader[68:72])
-	}
+	return binary.LittleEndian.Uint32(n.BlockHeader[68:72])
 }
 
 func (n *BlockTreeNode) Bits() uint32 {
-	if n.Height == 0 {
-		return MaxPOWBits
-	} else {
-		return binary.LittleEndian.Uint32(n.BlockHeader[72:76])
+	return binary.LittleEndian.Uint32(n.BlockHeader[72:76])
+}
+
+// Returns the median timestamp of the last MedianTimeSpan blocks, ending with this one
+func (n *BlockTreeNode) MedianTimePast() uint32 {
+	var times []uint32
+	for cnt := 0; cnt < MedianTimeSpan && n != nil; cnt++ {
+		times = append(times, n.Timestamp())
+		n = n.Parent
+	}
+	sort.Sort(timeList(times))
+	return times[len(times)/2]
+}
+
+type timeList []uint32
+
+func (t timeList) Len() int           { return len(t) }
+func (t timeList) Less(i, j int) bool { return t[i] < t[j] }
+func (t timeList) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// Returns the node at the given height, from the branch leading to this one
+func (n *BlockTreeNode) FindAncestor(height uint32) *BlockTreeNode {
+	if height > n.Height {
+		return nil
+	}
+	for n.Height > height {
+		n = n.Parent
 	}
+	return n
 }
 
 // Looks for the fartherst node
@@ -113,6 +144,26 @@ func (n *BlockTreeNode) FindFarthestNode() (*BlockTreeNode, int) {
 	return res, depth + 1
 }
 
+// Looks for the node with the most accumulated work.
+// In case of a tie, the branch which had been seen first wins.
+func (n *BlockTreeNode) FindBestNode() (res *BlockTreeNode) {
+	res = n
+	for i := range n.Childs {
+		if _re := n.Childs[i].FindBestNode(); _re.SumWork.Cmp(res.SumWork) > 0 {
+			res = _re
+		}
+	}
+	return
+}
+
+// Calculates SumWork of all the children, assuming the node's own is already set
+func (n *BlockTreeNode) setChildsWork() {
+	for i := range n.Childs {
+		n.Childs[i].SumWork = new(big.Int).Add(n.SumWork, BlockWork(n.Childs[i].Bits()))
+		n.Childs[i].setChildsWork()
+	}
+}
+
 // Returns the next node that leads to the given destiantion
 func (n *BlockTreeNode) FindPathTo(end *BlockTreeNode) *BlockTreeNode {
 	if n == end {
@@ -142,36 +193,33 @@ func (n *BlockTreeNode) FindPathTo(end *BlockTreeNode) *BlockTreeNode {
 	return nil
 }
 
-func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
-	cur := dst
-	for cur.Height > ch.BlockTreeEnd.Height {
-		cur = cur.Parent
+// Moves the chain to the given block, reverting the current branch down to the fork point first.
+// If it cannot be reverted (i.e. undo data cannot be rebuilt), the chain stays on the current
+// branch and the destination one is marked, so the next blocks on it do not try it again.
+func (ch *Chain) MoveToBlock(dst *BlockTreeNode) (e error) {
+	if dst.noSwitch {
+		return errors.New(fmt.Sprint("MoveToBlock: cannot switch to the branch of block ", dst.Height))
 	}
-	// At this point both "ch.BlockTreeEnd" and "cur" should be at the same height
-	for ch.BlockTreeEnd != cur {
-		if cur.Height != ch.BlockTreeEnd.Height {
-			panic("WTF??")
-		}
-		if AbortNow {
-			return
+	// The destination branch may be shorter than the current one (but have more work)
+	cur := ch.BlockTreeEnd.FirstCommonParent(dst)
+	if e = ch.undoTillBlock(cur); e != nil {
+		// Stay on the current branch (or whatever is left of it, if aborted)
+		if !AbortNow {
+			for n := dst; n != cur; n = n.Parent {
+				n.noSwitch = true
+			}
 		}
-		ch.UndoLastBlock()
-		cur = cur.Parent
+		e = errors.New(fmt.Sprint("MoveToBlock: cannot revert the chain to block ", cur.Height, " - ", e.Error()))
+		return
 	}
 	ch.ParseTillBlock(dst)
+	return
 }
 
 func (ch *Chain) UndoLastBlock() {
-	fmt.Println("Undo block", ch.BlockTreeEnd.Height, ch.BlockTreeEnd.BlockHash.String(),
-		ch.BlockTreeEnd.BlockSize>>10, "KB")
-
-	raw, _, _ := ch.Blocks.BlockGet(ch.BlockTreeEnd.BlockHash)
-
-	bl, _ := btc.NewBlock(raw)
-	bl.BuildTxList()
-
-	ch.Unspent.UndoBlockTxs(bl, ch.BlockTreeEnd.Parent.BlockHash.Hash[:])
-	ch.BlockTreeEnd = ch.BlockTreeEnd.Parent
+	if e := ch.undoTillBlock(ch.BlockTreeEnd.Parent); e != nil {
+		println("UndoLastBlock:", e.Error())
+	}
 }
 
 // Returns a common parent with the highest height
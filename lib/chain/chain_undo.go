@@ -0,0 +1,156 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wchh/gocoin/lib/btc"
+	"time"
+)
+
+// A block to be reverted. If its undo data needs to be rebuilt,
+// spent lists the inputs, whose outputs must be put back.
+type undoBlock struct {
+	node    *BlockTreeNode
+	spent   []btc.TxPrevOut
+	addback []*QdbRec
+}
+
+func (ch *Chain) getBlock(n *BlockTreeNode) (bl *btc.Block, e error) {
+	raw, _, e := ch.Blocks.BlockGet(n.BlockHash)
+	if e != nil {
+		e = errors.New(fmt.Sprint("Block ", n.Height, " not available: ", e.Error()))
+		return
+	}
+	if bl, e = btc.NewBlock(raw); e != nil {
+		return
+	}
+	e = bl.BuildTxList()
+	return
+}
+
+// Prepares reverting of the chain from the end block down to the cur one.
+// Undo data of the blocks that went beyond the unwind buffer (UnwindBufferMaxHistory)
+// gets rebuilt from the block database: going back the chain, we look for the transactions
+// whose outputs had been spent. Nothing is changed if it fails (i.e. a block is missing).
+func (ch *Chain) prepareUndo(end, cur *BlockTreeNode) (res []*undoBlock, e error) {
+	needed := make(map[[32]byte]*QdbRec) // spent transactions still to be found
+	var missing int
+	var rebuilding bool
+
+	prv := time.Now().UnixNano()
+	for n := end; n.Height > cur.Height || missing > 0; n = n.Parent {
+		if AbortNow {
+			e = errors.New("Aborted")
+			return
+		}
+		if n.Parent == nil {
+			e = errors.New(fmt.Sprint(missing, " spent transactions not found in the chain"))
+			return
+		}
+
+		if now := time.Now().UnixNano(); now-prv >= 10e9 {
+			fmt.Println("Rebuilding undo data ...", n.Height, "-", missing, "transactions still missing")
+			prv = now
+		}
+
+		var bl *btc.Block
+		if bl, e = ch.getBlock(n); e != nil {
+			return
+		}
+
+		if missing > 0 {
+			for i, tx := range bl.Txs {
+				if r, ok := needed[tx.Hash.Hash]; ok && r.Outs == nil {
+					r.Coinbase = i == 0
+					r.InBlock = n.Height
+					r.Outs = make([]*QdbTxOut, len(tx.TxOut))
+					for j := range tx.TxOut {
+						r.Outs[j] = &QdbTxOut{Value: tx.TxOut[j].Value,
+							PKScr: append([]byte(nil), tx.TxOut[j].Pk_script...)} // do not keep the block in memory
+					}
+					missing--
+				}
+			}
+		}
+
+		if n.Height <= cur.Height {
+			continue // below the fork point we only look for the missing transactions
+		}
+
+		ub := &undoBlock{node: n}
+		res = append(res, ub)
+		if _, er := ch.Unspent.GetUndoData(bl, n.Height); er == nil {
+			continue
+		}
+
+		// The block's undo data is not there, so we will need all its inputs
+		if !rebuilding {
+			fmt.Println("No undo data for block", n.Height, "- rebuilding it from the block database")
+			rebuilding = true
+		}
+		inblock := make(map[[32]byte]bool, len(bl.Txs))
+		for _, tx := range bl.Txs {
+			inblock[tx.Hash.Hash] = true
+		}
+		ub.spent = make([]btc.TxPrevOut, 0)
+		for _, tx := range bl.Txs[1:] {
+			for _, in := range tx.TxIn {
+				if inblock[in.Input.Hash] {
+					continue
+				}
+				ub.spent = append(ub.spent, in.Input)
+				if _, ok := needed[in.Input.Hash]; !ok {
+					needed[in.Input.Hash] = &QdbRec{TxID: in.Input.Hash}
+					missing++
+				}
+			}
+		}
+	}
+
+	// Now build the undo data of the blocks that did not have it
+	for _, ub := range res {
+		recs := make(map[[32]byte]*QdbRec)
+		for _, inp := range ub.spent {
+			src := needed[inp.Hash]
+			if int(inp.Vout) >= len(src.Outs) {
+				e = errors.New("Spent output not found: " + inp.String())
+				return
+			}
+			r := recs[inp.Hash]
+			if r == nil {
+				r = &QdbRec{TxID: src.TxID, Coinbase: src.Coinbase, InBlock: src.InBlock}
+				r.Outs = make([]*QdbTxOut, len(src.Outs))
+				recs[inp.Hash] = r
+				ub.addback = append(ub.addback, r)
+			}
+			r.Outs[inp.Vout] = src.Outs[inp.Vout]
+		}
+	}
+	return
+}
+
+// Reverts the chain down to the given block
+func (ch *Chain) undoTillBlock(cur *BlockTreeNode) (e error) {
+	ubs, e := ch.prepareUndo(ch.BlockTreeEnd, cur)
+	if e != nil {
+		return
+	}
+	for _, ub := range ubs {
+		if AbortNow {
+			return errors.New("Aborted")
+		}
+		fmt.Println("Undo block", ub.node.Height, ub.node.BlockHash.String(), ub.node.BlockSize>>10, "KB")
+		var bl *btc.Block
+		if bl, e = ch.getBlock(ub.node); e != nil {
+			return
+		}
+		if ub.spent == nil {
+			if ub.addback, e = ch.Unspent.GetUndoData(bl, ub.node.Height); e != nil {
+				return
+			}
+		}
+		ch.Unspent.UndoBlockTxs(bl, ub.node.Parent.BlockHash.Hash[:], ub.addback)
+		ch.BlockTreeEnd = ub.node.Parent
+	}
+	return
+}
@@ -3,7 +3,7 @@ package chain
 const(
 	BlockMapInitLen = 500e3
 	MovingCheckopintDepth = 2016  // Do not accept forks that wold go deeper in a past
-	GenesisBlockTime = 1231006505
-	BIP16SwitchTime = 1333238400 // BIP16 didn't become active until Apr 1 2012
 	COINBASE_MATURITY = 100
+	MedianTimeSpan = 11 // number of blocks used to calculate the median time past
+	BIP34ImpliesBIP30Limit = 1983702 // from here on, coinbases of old blocks may repeat BIP-34 heights
 )
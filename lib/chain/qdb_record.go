@@ -215,6 +215,14 @@ func (r *QdbTxOut) IsP2SH() bool {
 	return len(r.PKScr) == 23 && r.PKScr[0] == 0xa9 && r.PKScr[1] == 0x14 && r.PKScr[22] == 0x87
 }
 
+func (r *QdbTxOut) IsP2WPKH() bool {
+	return len(r.PKScr) == 22 && r.PKScr[0] == 0x00 && r.PKScr[1] == 0x14
+}
+
+func (r *QdbTxOut) IsP2WSH() bool {
+	return len(r.PKScr) == 34 && r.PKScr[0] == 0x00 && r.PKScr[1] == 0x20
+}
+
 func (r *QdbTxOut) IsStealthIdx() bool {
 	return len(r.PKScr) == 40 && r.PKScr[0] == 0x6a && r.PKScr[1] == 0x26 && r.PKScr[2] == 0x06
 }
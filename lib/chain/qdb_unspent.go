@@ -16,8 +16,18 @@ import (
 const (
 	NumberOfUnspentSubDBs  = 0x10
 	UnwindBufferMaxHistory = 256 // Let's keep unwind history for so may last blocks
+
+	// Commit the changes (during the initial sync) when so many records are pending
+	unspentMaxPending = 0x40000
 )
 
+/*
+	All the sub-DBs of the unspent folder belong to one qdb.Batch, so their changes go to disk
+	in commits, together with the "lastblock" marker file (hash of the block + LSB height)
+	and the state of the UTXO set's MuHash. After a crash, the folder is at the last commit.
+	Each file named as a block height keeps hash of the block and its undo data.
+*/
+
 type FunctionWalkUnspent func(*QdbRec)
 
 // Used to pass block's changes to UnspentDB
@@ -30,24 +40,37 @@ type BlockChanges struct {
 }
 
 type UnspentDB struct {
-	LastBlockHash    []byte
-	LastBlockHeight  uint32
-	dir              string
-	tdb              [NumberOfUnspentSubDBs]*qdb.DB
-	defragIndex      int
-	defragCount      uint64
-	nosyncinprogress bool
-	ch               *Chain
+	LastBlockHash   []byte
+	LastBlockHeight uint32
+	dir             string
+	tdb             [NumberOfUnspentSubDBs]*qdb.DB
+	defragIndex     int
+	defragCount     uint64
+	ch              *Chain
+	muhash          *btc.MuHash // hash of the whole set, updated with each change
+	batch           *qdb.Batch
+	committed       []byte // hash of the last block, as in the "lastblock" file
 }
 
 func NewUnspentDb(dir string, init bool, ch *Chain) (db *UnspentDB, undo_last_block bool) {
 	var maxbl_fn string
 	db = new(UnspentDB)
 	db.dir = dir + "unspent4" + string(os.PathSeparator)
+	db.batch = qdb.NewBatch(db.dir + "batch")
 
 	if init {
 		os.RemoveAll(db.dir)
+	} else if e := qdb.RecoverBatch(db.dir + "batch"); e != nil {
+		fmt.Println("UTXO database not recovered:", e.Error())
+		AbortNow = true
+		return
+	} else if d, _ := ioutil.ReadFile(db.dir + "lastblock"); len(d) == 36 {
+		db.LastBlockHash = d[:32]
+		db.LastBlockHeight = binary.LittleEndian.Uint32(d[32:36])
+		db.committed = append([]byte{}, db.LastBlockHash...)
+		db.removeUndoAbove(db.LastBlockHeight)
 	} else {
+		// Older version of the folder - the last block is the highest undo file
 		fis, _ := ioutil.ReadDir(db.dir)
 		var maxbl, undobl int
 		for _, fi := range fis {
@@ -86,6 +109,8 @@ func NewUnspentDb(dir string, init bool, ch *Chain) (db *UnspentDB, undo_last_bl
 	}
 	fmt.Print("\r                                                              \r")
 
+	db.loadMuHash()
+
 	return
 }
 
@@ -103,23 +128,21 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 				bu.Write(bin)
 			}
 		}
+		// If we crash before the commit, the file gets removed when loading
 		ioutil.WriteFile(db.dir+"tmp", bu.Bytes(), 0666)
-		os.Rename(db.dir+"tmp", undo_fn+".tmp")
+		os.Rename(db.dir+"tmp", undo_fn)
 	}
 
-	db.nosync()
 	db.commit(changes)
-	if changes.LastKnownHeight <= changes.Height {
-		db.Sync()
-	}
-
-	os.Rename(undo_fn+".tmp", undo_fn)
 
 	if db.LastBlockHash == nil {
 		db.LastBlockHash = make([]byte, 32)
 	}
 	copy(db.LastBlockHash, blhash)
 	db.LastBlockHeight = changes.Height
+	if changes.LastKnownHeight <= changes.Height || db.batch.Pending() > unspentMaxPending {
+		db.Sync()
+	}
 
 	if changes.Height > UnwindBufferMaxHistory {
 		os.Remove(fmt.Sprint(db.dir, changes.Height-UnwindBufferMaxHistory))
@@ -127,25 +150,25 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 	return
 }
 
-func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
-	for _, tx := range bl.Txs {
-		lst := make([]bool, len(tx.TxOut))
-		for i := range lst {
-			lst[i] = true
-		}
-		db.del(tx.Hash.Hash[:], lst)
-	}
-
-	fn := fmt.Sprint(db.dir, db.LastBlockHeight)
-	var addback []*QdbRec
-
+// Returns name of the file with the undo data of the block at the given height
+func (db *UnspentDB) undoFile(height uint32) string {
+	fn := fmt.Sprint(db.dir, height)
 	if _, er := os.Stat(fn); er != nil {
 		fn += ".tmp"
 	}
+	return fn
+}
 
-	dat, er := ioutil.ReadFile(fn)
-	if er != nil {
-		panic(er.Error())
+// Returns the outputs spent by the block at the given height, as stored by CommitBlockTxs.
+// Fails if they are not available (anymore) or if they do not cover all the block's inputs.
+func (db *UnspentDB) GetUndoData(bl *btc.Block, height uint32) (addback []*QdbRec, e error) {
+	dat, e := ioutil.ReadFile(db.undoFile(height))
+	if e != nil {
+		return
+	}
+	if len(dat) < 32 || !bytes.Equal(dat[:32], bl.Hash.Hash[:]) {
+		e = errors.New(fmt.Sprint("No undo data for block ", height))
+		return
 	}
 
 	off := 32 // ship the block hash
@@ -157,6 +180,48 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 		addback = append(addback, qr)
 	}
 
+	if !undoCovers(bl, addback) {
+		addback = nil
+		e = errors.New(fmt.Sprint("Incomplete undo data for block ", height))
+	}
+	return
+}
+
+// Checks whether every input of the block (except for the ones spending
+// outputs of the same block) has its spent output in the given records
+func undoCovers(bl *btc.Block, addback []*QdbRec) bool {
+	recs := make(map[[32]byte]*QdbRec, len(addback))
+	for _, r := range addback {
+		recs[r.TxID] = r
+	}
+	inblock := make(map[[32]byte]bool, len(bl.Txs))
+	for _, tx := range bl.Txs {
+		inblock[tx.Hash.Hash] = true
+	}
+	for _, tx := range bl.Txs[1:] {
+		for _, in := range tx.TxIn {
+			if inblock[in.Input.Hash] {
+				continue
+			}
+			r := recs[in.Input.Hash]
+			if r == nil || int(in.Input.Vout) >= len(r.Outs) || r.Outs[in.Input.Vout] == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Reverts the last block, putting back the outputs that it had spent
+func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte, addback []*QdbRec) {
+	for _, tx := range bl.Txs {
+		lst := make([]bool, len(tx.TxOut))
+		for i := range lst {
+			lst[i] = true
+		}
+		db.del(tx.Hash.Hash[:], lst)
+	}
+
 	for _, tx := range addback {
 		if db.ch.CB.NotifyTxAdd != nil {
 			db.ch.CB.NotifyTxAdd(tx)
@@ -165,62 +230,79 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 		ind := qdb.KeyType(binary.LittleEndian.Uint64(tx.TxID[:8]))
 		_db := db.dbN(int(tx.TxID[31]) % NumberOfUnspentSubDBs)
 		v := _db.Get(ind)
+		var oldrec *QdbRec
 		if v != nil {
-			oldrec := NewQdbRec(ind, v)
-			for a := range tx.Outs {
-				if tx.Outs[a] == nil {
-					tx.Outs[a] = oldrec.Outs[a]
+			oldrec = NewQdbRec(ind, v)
+		}
+		for a := range tx.Outs {
+			if tx.Outs[a] != nil {
+				if oldrec != nil && a < len(oldrec.Outs) && oldrec.Outs[a] != nil {
+					db.hashRemove(oldrec, a)
 				}
+				db.hashInsert(tx, a)
+			} else if oldrec != nil {
+				tx.Outs[a] = oldrec.Outs[a]
 			}
 		}
 		_db.PutExt(ind, tx.Bytes(), 0)
 	}
 
-	os.Remove(fn)
+	if db.ch.TxIndex != nil {
+		db.ch.TxIndex.UndoBlock(bl)
+	}
+	if db.ch.AddrIndex != nil {
+		db.ch.AddrIndex.UndoBlock(bl, addback)
+	}
+
+	undo_fn := db.undoFile(db.LastBlockHeight)
 	db.LastBlockHeight--
 	copy(db.LastBlockHash, newhash)
+	db.Sync()
+	os.Remove(undo_fn)
 }
 
-// Flush all the data to files
-func (db *UnspentDB) Sync() {
-	db.nosyncinprogress = false
-	for i := range db.tdb {
-		if db.tdb[i] != nil {
-			db.tdb[i].Sync()
+// Removes undo files of the blocks above the given height (left after a crash)
+func (db *UnspentDB) removeUndoAbove(height uint32) {
+	fis, _ := ioutil.ReadDir(db.dir)
+	for _, fi := range fis {
+		ss := strings.SplitN(fi.Name(), ".", 2)
+		if cb, er := strconv.ParseUint(ss[0], 10, 32); er == nil && uint32(cb) > height {
+			os.Remove(db.dir + fi.Name())
 		}
 	}
-	db.syncUnpent()
 }
 
-func (db *UnspentDB) syncUnpent() {
-	if db.LastBlockHash != nil {
-		fn := fmt.Sprint(db.dir, db.LastBlockHeight)
-		fi, er := os.Stat(fn)
-		if er != nil || fi.Size() < 32 {
-			ioutil.WriteFile(fn, db.LastBlockHash, 0666)
-		}
-	}
+// Returns content of the "lastblock" file
+func lastBlockMarker(hash []byte, height uint32) (d []byte) {
+	d = make([]byte, 36)
+	copy(d, hash)
+	binary.LittleEndian.PutUint32(d[32:36], height)
+	return
 }
 
-// Hold on writing data to disk untill next sync is called
-func (db *UnspentDB) nosync() {
-	db.nosyncinprogress = true
-	for i := range db.tdb {
-		if db.tdb[i] != nil {
-			db.tdb[i].NoSync()
-		}
+// Commit all the changes to disk, together with the last block and the UTXO set hash
+func (db *UnspentDB) Sync() {
+	if db.LastBlockHash == nil || bytes.Equal(db.LastBlockHash, db.committed) && db.batch.Pending() == 0 {
+		return
+	}
+	db.batch.WriteFile("lastblock", lastBlockMarker(db.LastBlockHash, db.LastBlockHeight))
+	db.batch.WriteFile("muhash", db.muhashFile())
+	if e := db.batch.Commit(); e != nil {
+		println("UnspentDB commit failed:", e.Error())
+		return
 	}
+	db.committed = append(db.committed[:0], db.LastBlockHash...)
 }
 
-// Flush the data and close all the files
+// Commit the data and close all the files
 func (db *UnspentDB) Close() {
+	db.Sync()
 	for i := range db.tdb {
 		if db.tdb[i] != nil {
 			db.tdb[i].Close()
 			db.tdb[i] = nil
 		}
 	}
-	db.syncUnpent()
 }
 
 // Call it when the main thread is idle - this will do DB defrag
@@ -238,14 +320,9 @@ func (db *UnspentDB) Idle() bool {
 	return false
 }
 
-// Flush all the data to disk
+// Commit all the data to disk
 func (db *UnspentDB) Save() {
-	for i := range db.tdb {
-		if db.tdb[i] != nil {
-			db.tdb[i].Flush()
-		}
-	}
-	db.syncUnpent()
+	db.Sync()
 }
 
 // Get ne unspent output
@@ -271,6 +348,13 @@ func (db *UnspentDB) UnspentGet(po *btc.TxPrevOut) (res *btc.TxOut, e error) {
 	return
 }
 
+// Returns true if there are unspent outputs of the given transaction
+func (db *UnspentDB) TxPresent(txid *btc.Uint256) bool {
+	ind := qdb.KeyType(binary.LittleEndian.Uint64(txid.Hash[:8]))
+	v := db.dbN(int(txid.Hash[31]) % NumberOfUnspentSubDBs).Get(ind)
+	return len(v) >= 24 && bytes.Equal(v[:24], txid.Hash[8:32])
+}
+
 // Browse through all unspent outputs
 func (db *UnspentDB) BrowseUTXO(quick bool, walk FunctionWalkUnspent) {
 	var i int
@@ -299,9 +383,7 @@ func (db *UnspentDB) dbN(i int) *qdb.DB {
 			return 0
 		}, 200000 /*size of pre-allocated map*/)
 
-		if db.nosyncinprogress {
-			db.tdb[i].NoSync()
-		}
+		db.batch.Add(db.tdb[i])
 	}
 	return db.tdb[i]
 }
@@ -320,6 +402,9 @@ func (db *UnspentDB) del(hash []byte, outs []bool) {
 	var anyout bool
 	for i, rm := range outs {
 		if rm {
+			if rec.Outs[i] != nil {
+				db.hashRemove(rec, i)
+			}
 			rec.Outs[i] = nil
 		} else if rec.Outs[i] != nil {
 			anyout = true
@@ -339,7 +424,9 @@ func (db *UnspentDB) commit(changes *BlockChanges) {
 		if db.ch.CB.NotifyTxAdd != nil {
 			db.ch.CB.NotifyTxAdd(rec)
 		}
-		db.dbN(int(rec.TxID[31])%NumberOfUnspentSubDBs).PutExt(ind, rec.Bytes(), 0)
+		_db := db.dbN(int(rec.TxID[31]) % NumberOfUnspentSubDBs)
+		db.hashReplace(_db, ind, rec)
+		_db.PutExt(ind, rec.Bytes(), 0)
 	}
 	for k, v := range changes.DeledTxs {
 		db.del(k[:], v)
@@ -0,0 +1,142 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/script"
+	"io"
+)
+
+// The solution is pushed after this header, in the witness commitment output of the coinbase
+var SignetHeader = []byte{0xec, 0xc7, 0xda, 0xa2}
+
+const signetVerifyFlags = script.VER_P2SH | script.VER_DERSIG | script.VER_WITNESS
+
+// Takes the signet solution out of the witness commitment script.
+// Returns the solution and the script without it (which is what got signed).
+func signetSolution(scr []byte) (sol, stripped []byte, found bool) {
+	for idx := 0; idx < len(scr); {
+		op, pv, le, e := btc.GetOpcode(scr[idx:])
+		if e != nil {
+			break
+		}
+		if len(pv) > 0 {
+			if !found && len(pv) > len(SignetHeader) && bytes.Equal(pv[:len(SignetHeader)], SignetHeader) {
+				sol = pv[len(SignetHeader):]
+				pv = SignetHeader
+				found = true
+			}
+			stripped = append(stripped, script.PushData(pv)...)
+		} else {
+			stripped = append(stripped, byte(op))
+		}
+		idx += le
+	}
+	return
+}
+
+// Reads the scriptSig and the witness stack of the signet solution
+func parseSignetSolution(sol []byte, in *btc.TxIn) (e error) {
+	rd := bytes.NewReader(sol)
+	readBytes := func() (b []byte, e error) {
+		var le uint64
+		if le, e = btc.ReadVLen(rd); e != nil {
+			return
+		}
+		if le > uint64(rd.Len()) {
+			e = errors.New("signet solution too short")
+			return
+		}
+		b = make([]byte, le)
+		_, e = io.ReadFull(rd, b)
+		return
+	}
+
+	if in.ScriptSig, e = readBytes(); e != nil {
+		return
+	}
+	var cnt uint64
+	if cnt, e = btc.ReadVLen(rd); e != nil {
+		return
+	}
+	if cnt > uint64(rd.Len()) {
+		return errors.New("signet solution too short")
+	}
+	in.Witness = make([][]byte, cnt)
+	for i := range in.Witness {
+		if in.Witness[i], e = readBytes(); e != nil {
+			return
+		}
+	}
+	if rd.Len() != 0 {
+		e = errors.New("extra data after the signet solution")
+	}
+	return
+}
+
+// Returns the virtual transactions of BIP-325: to_spend, whose output is the challenge script,
+// and to_sign, which spends it with the block's signet solution.
+// Signing to_sign (with the solution left out) is how the signet blocks get their signatures.
+func SignetTxs(bl *btc.Block, challenge []byte) (to_spend, to_sign *btc.Tx, e error) {
+	cb := bl.Txs[0]
+	cidx := -1
+	for i := len(cb.TxOut) - 1; i >= 0; i-- {
+		scr := cb.TxOut[i].Pk_script
+		if len(scr) >= 38 && bytes.Equal(scr[:6], btc.WitnessCommitmentHeader) {
+			cidx = i
+			break
+		}
+	}
+	if cidx < 0 {
+		e = errors.New("signet block without witness commitment")
+		return
+	}
+
+	to_sign = new(btc.Tx)
+	to_sign.TxIn = []*btc.TxIn{new(btc.TxIn)}
+	to_sign.TxOut = []*btc.TxOut{&btc.TxOut{Pk_script: []byte{btc.OP_RETURN}}}
+
+	// The signed block data has the merkle root calculated without the solution
+	sol, stripped, found := signetSolution(cb.TxOut[cidx].Pk_script)
+	if found {
+		if e = parseSignetSolution(sol, to_sign.TxIn[0]); e != nil {
+			return
+		}
+	}
+	mcb := *cb
+	mcb.TxOut = make([]*btc.TxOut, len(cb.TxOut))
+	copy(mcb.TxOut, cb.TxOut)
+	mcb.TxOut[cidx] = &btc.TxOut{Value: cb.TxOut[cidx].Value, Pk_script: stripped}
+	mcb.SetHash(nil)
+	txs := make([]*btc.Tx, len(bl.Txs))
+	copy(txs, bl.Txs)
+	txs[0] = &mcb
+
+	blockdata := new(bytes.Buffer)
+	blockdata.Write(bl.Raw[:36]) // version and parent hash
+	blockdata.Write(btc.GetMerkel(txs))
+	blockdata.Write(bl.Raw[68:72]) // timestamp
+
+	to_spend = new(btc.Tx)
+	to_spend.TxIn = []*btc.TxIn{&btc.TxIn{Input: btc.TxPrevOut{Vout: 0xffffffff},
+		ScriptSig: append([]byte{0}, script.PushData(blockdata.Bytes())...)}}
+	to_spend.TxOut = []*btc.TxOut{&btc.TxOut{Pk_script: challenge}}
+	to_spend.SetHash(nil)
+
+	to_sign.TxIn[0].Input.Hash = to_spend.Hash.Hash
+	to_sign.SetHash(nil)
+	return
+}
+
+// Checks whether the block is properly signed, as required by the signet's challenge (BIP-325)
+func (ch *Chain) CheckSignetSolution(bl *btc.Block) error {
+	_, to_sign, e := SignetTxs(bl, ch.Params.SignetChallenge)
+	if e != nil {
+		return errors.New("CheckBlock() : " + e.Error())
+	}
+	if !script.VerifyTxScript(to_sign.TxIn[0].ScriptSig, ch.Params.SignetChallenge, 0, 0, to_sign, signetVerifyFlags) {
+		return errors.New("CheckBlock() : invalid signet block solution")
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package chain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/qdb"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	UtxoSnapshotVersion = 3
+
+	utxoSnapshotMagic   = "GOCUTXOS"
+	utxoSnapshotHdrSize = 88
+)
+
+/*
+UTXO snapshot file starts with a header of 88 bytes (all LSB):
+
+	[0:8]   - "GOCUTXOS"
+	[8:12]  - version of the file format
+	[12:44] - hash of the last block applied to the set
+	[44:48] - height of the block
+	[48:56] - number of records
+	[56:88] - MuHash of the set (the same as UnspentDB.MuHash of the snapshot's block)
+
+It is followed by the headers of all the blocks from height 1 to the snapshot's one (80 bytes each),
+so a new node can start from the snapshot, having the blocks known only from their headers.
+Then come the records, each one being var_len + QdbRec.Serialize(true)
+*/
+type UtxoSnapshotHeader struct {
+	BlockHash *btc.Uint256
+	Height    uint32
+	Records   uint64
+	Hash      *btc.Uint256
+}
+
+func (hdr *UtxoSnapshotHeader) bytes() []byte {
+	b := make([]byte, utxoSnapshotHdrSize)
+	copy(b[0:8], utxoSnapshotMagic)
+	binary.LittleEndian.PutUint32(b[8:12], UtxoSnapshotVersion)
+	copy(b[12:44], hdr.BlockHash.Hash[:])
+	binary.LittleEndian.PutUint32(b[44:48], hdr.Height)
+	binary.LittleEndian.PutUint64(b[48:56], hdr.Records)
+	copy(b[56:88], hdr.Hash.Hash[:])
+	return b
+}
+
+func readUtxoSnapshotHeader(rd io.Reader) (hdr *UtxoSnapshotHeader, e error) {
+	b := make([]byte, utxoSnapshotHdrSize)
+	if _, e = io.ReadFull(rd, b); e != nil {
+		return
+	}
+	if string(b[0:8]) != utxoSnapshotMagic {
+		e = errors.New("Not a UTXO snapshot file")
+		return
+	}
+	if v := binary.LittleEndian.Uint32(b[8:12]); v != UtxoSnapshotVersion {
+		e = errors.New(fmt.Sprint("Unsupported version of UTXO snapshot: ", v))
+		return
+	}
+	hdr = new(UtxoSnapshotHeader)
+	hdr.BlockHash = btc.NewUint256(b[12:44])
+	hdr.Height = binary.LittleEndian.Uint32(b[44:48])
+	hdr.Records = binary.LittleEndian.Uint64(b[48:56])
+	hdr.Hash = btc.NewUint256(b[56:88])
+	return
+}
+
+// Reads the header of the given UTXO snapshot file
+func ReadUtxoSnapshotHeader(fn string) (hdr *UtxoSnapshotHeader, e error) {
+	f, e := os.Open(fn)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	return readUtxoSnapshotHeader(f)
+}
+
+// Writes the headers of the chain and all the unspent records into the given snapshot file.
+// Call it from the chain's thread, so the database does not change meanwhile.
+func (db *UnspentDB) ExportSnapshot(fn string) (hdr *UtxoSnapshotHeader, e error) {
+	hdr = new(UtxoSnapshotHeader)
+	hdr.BlockHash = btc.NewUint256(db.LastBlockHash)
+	hdr.Height = db.LastBlockHeight
+
+	db.ch.BlockIndexAccess.Lock()
+	n := db.ch.BlockIndex[hdr.BlockHash.BIdx()]
+	var hdrs []byte
+	if n != nil && n.Height == hdr.Height {
+		hdrs = make([]byte, 80*int(n.Height))
+		for ; n.Parent != nil; n = n.Parent {
+			copy(hdrs[80*int(n.Height-1):], n.BlockHeader[:])
+		}
+	}
+	db.ch.BlockIndexAccess.Unlock()
+	if hdrs == nil && hdr.Height > 0 {
+		return nil, errors.New("Last block of the unspent database not in the block index")
+	}
+
+	f, e := os.Create(fn + ".tmp")
+	if e != nil {
+		return nil, e
+	}
+	wr := bufio.NewWriterSize(f, 0x100000)
+	wr.Write(make([]byte, utxoSnapshotHdrSize)) // the header is written once we know the hash
+	wr.Write(hdrs)
+	mh := btc.NewMuHash()
+	db.BrowseUTXO(false, func(rec *QdbRec) {
+		if e != nil {
+			return
+		}
+		bin := rec.Serialize(true)
+		muhashInsertRec(mh, rec)
+		hdr.Records++
+		btc.WriteVlen(wr, uint64(len(bin)))
+		_, e = wr.Write(bin)
+	})
+	if e == nil {
+		e = wr.Flush()
+	}
+	if e == nil {
+		hdr.Hash = mh.Finalize()
+		_, e = f.WriteAt(hdr.bytes(), 0)
+	}
+	if er := f.Close(); e == nil {
+		e = er
+	}
+	if e == nil {
+		e = os.Rename(fn+".tmp", fn)
+	}
+	if e != nil {
+		os.Remove(fn + ".tmp")
+		hdr = nil
+	}
+	return
+}
+
+func parseSnapshotRec(bin []byte) (rec *QdbRec, e error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e = errors.New("Broken record in the snapshot")
+		}
+	}()
+	rec = FullQdbRec(bin)
+	return
+}
+
+// Reads the headers of the blocks from the snapshot, checking that they make a valid chain
+// (the same checks as CheckBlock does for headers), which leads to the snapshot's block
+func (ch *Chain) readSnapshotHeaders(rd io.Reader, hdr *UtxoSnapshotHeader) (hdrs []byte, e error) {
+	hdrs = make([]byte, 80*int(hdr.Height))
+	if _, e = io.ReadFull(rd, hdrs); e != nil {
+		return nil, e
+	}
+	var recent [2 * targetInterval]*BlockTreeNode // the checks do not go deeper than this
+	prev := genesisNode(ch.Params)
+	for h := uint32(1); h <= hdr.Height; h++ {
+		n := &BlockTreeNode{Height: h, Parent: prev}
+		copy(n.BlockHeader[:], hdrs[80*int(h-1):80*int(h)])
+		n.BlockHash = btc.NewSha2Hash(n.BlockHeader[:])
+		if !bytes.Equal(n.BlockHeader[4:36], prev.BlockHash.Hash[:]) {
+			return nil, errors.New(fmt.Sprint("Header of block ", h, " does not follow its parent"))
+		}
+		if n.Timestamp() <= prev.MedianTimePast() {
+			return nil, errors.New(fmt.Sprint("Header of block ", h, " has its timestamp too early"))
+		}
+		if n.Bits() != ch.GetNextWorkRequired(prev, n.Timestamp()) &&
+			(!ch.Params.PowAllowMinDifficulty || h%targetInterval != 0) {
+			return nil, errors.New(fmt.Sprint("Header of block ", h, " has incorrect proof of work"))
+		}
+		if n.BlockHash.BigInt().Cmp(btc.SetCompact(n.Bits())) > 0 {
+			return nil, errors.New(fmt.Sprint("Hash of block ", h, " does not meet its target"))
+		}
+		if exp, ok := ch.Params.Checkpoints[h]; ok && exp != n.BlockHash.String() {
+			return nil, errors.New(fmt.Sprint("Header of block ", h, " does not match the checkpoint"))
+		}
+		if old := recent[h%uint32(len(recent))]; old != nil {
+			old.Parent = nil // so the older nodes can go
+		}
+		recent[h%uint32(len(recent))] = n
+		prev = n
+	}
+	if !prev.BlockHash.Equal(hdr.BlockHash) {
+		return nil, errors.New("Headers in the snapshot do not lead to its block " + hdr.BlockHash.String())
+	}
+	return
+}
+
+// Builds the unspent database from the snapshot file (see NewChanOpts.UtxoSnapshot).
+// It fails if the content does not match the hash from the header, if the hash is not
+// the expected one, or if the headers do not make a valid chain up to the snapshot's block.
+// The current unspent database is only replaced after all the checks have passed.
+// The blocks not in the block database yet get into its index only with their headers.
+func (ch *Chain) importUtxoSnapshot(dir string) (e error) {
+	f, e := os.Open(ch.CB.UtxoSnapshot)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	rd := bufio.NewReaderSize(f, 0x100000)
+
+	hdr, e := readUtxoSnapshotHeader(rd)
+	if e != nil {
+		return
+	}
+	if ch.CB.UtxoSnapshotHash == nil {
+		return errors.New("No expected hash given. The snapshot claims " + hdr.Hash.String())
+	}
+	if !hdr.Hash.Equal(ch.CB.UtxoSnapshotHash) {
+		return errors.New("Snapshot's hash " + hdr.Hash.String() + " is not the expected one")
+	}
+	hdrs, e := ch.readSnapshotHeaders(rd, hdr)
+	if e != nil {
+		return
+	}
+	known := ch.Blocks.indexHeights()
+	if height, ok := known[hdr.BlockHash.BIdx()]; ok && height != hdr.Height {
+		return errors.New(fmt.Sprint("Block ", hdr.BlockHash.String(), " is in the block database at height ",
+			height, " instead of ", hdr.Height))
+	}
+
+	fmt.Println("Loading UTXO snapshot of block", hdr.Height, "with", hdr.Records, "records...")
+	tmpdir := dir + "unspent4.tmp" + string(os.PathSeparator)
+	os.RemoveAll(tmpdir)
+	var tdb [NumberOfUnspentSubDBs]*qdb.DB
+	for i := range tdb {
+		qdb.NewDBExt(&tdb[i], tmpdir+fmt.Sprintf("%06d", i), false, nil, 200000)
+		tdb[i].NoSync()
+	}
+
+	mh := btc.NewMuHash()
+	var cnt uint64
+	var le uint64
+	var buf []byte
+	prv := time.Now().UnixNano()
+	for cnt < hdr.Records {
+		if AbortNow {
+			e = errors.New("Aborted")
+			break
+		}
+		if le, e = btc.ReadVLen(rd); e != nil {
+			break
+		}
+		if le < 32+2 || le > 0x1000000 {
+			e = errors.New("Broken record in the snapshot")
+			break
+		}
+		if uint64(len(buf)) < le {
+			buf = make([]byte, le)
+		}
+		if _, e = io.ReadFull(rd, buf[:le]); e != nil {
+			break
+		}
+		var rec *QdbRec
+		if rec, e = parseSnapshotRec(buf[:le]); e != nil {
+			break
+		}
+		muhashInsertRec(mh, rec)
+		ind := qdb.KeyType(binary.LittleEndian.Uint64(rec.TxID[:8]))
+		tdb[int(rec.TxID[31])%NumberOfUnspentSubDBs].PutExt(ind, rec.Bytes(), qdb.NO_CACHE)
+		cnt++
+		if now := time.Now().UnixNano(); now-prv >= 10e9 {
+			fmt.Println("Loading UTXO snapshot ...", cnt, "/", hdr.Records)
+			prv = now
+		}
+	}
+	if e == nil {
+		if _, er := rd.ReadByte(); er != io.EOF {
+			e = errors.New("Unexpected data at the end of the snapshot")
+		} else if !mh.Finalize().Equal(hdr.Hash) {
+			e = errors.New("Snapshot's content does not match its hash")
+		}
+	}
+	for i := range tdb {
+		tdb[i].Close()
+	}
+	if e == nil {
+		e = ioutil.WriteFile(tmpdir+"lastblock", lastBlockMarker(hdr.BlockHash.Hash[:], hdr.Height), 0666)
+	}
+	if e == nil {
+		// so the hash does not need to be calculated again when loading
+		e = ioutil.WriteFile(tmpdir+"muhash", append(append([]byte{}, hdr.BlockHash.Hash[:]...), mh.Bytes()...), 0666)
+	}
+	if e == nil {
+		os.RemoveAll(dir + "unspent4")
+		e = os.Rename(dir+"unspent4.tmp", dir+"unspent4")
+	}
+	if e != nil {
+		os.RemoveAll(tmpdir)
+		return
+	}
+	if e = ch.Blocks.addHeaders(1, hdrs, known); e != nil {
+		os.RemoveAll(dir + "unspent4") // its last block would not be in the index
+		return
+	}
+	fmt.Println("UTXO set replaced with the snapshot of block", hdr.Height, hdr.BlockHash.String())
+	return
+}
@@ -0,0 +1,284 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/qdb"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const NumberOfTxIndexSubDBs = 0x10
+
+/*
+	Optional index of the transactions from the main chain, kept in the "txindex" folder.
+	The key of each record is the first 8 bytes of the txid. The value (all LSB):
+		[0:24]  - the remaining 24 bytes of the txid
+		[24:28] - height of the block with the transaction
+		[28:32] - position of the transaction in the block's raw data
+		[32:36] - size of the transaction
+	The "tip" file keeps the hash of the last indexed block, followed by its 32-bit height.
+	A coinbase repeating the txid of an older one (BIP-30 exceptions) does not replace its record.
+*/
+type TxIndex struct {
+	LastBlockHash    []byte
+	LastBlockHeight  uint32
+	dir              string
+	tdb              [NumberOfTxIndexSubDBs]*qdb.DB
+	nosyncinprogress bool
+	mutex            sync.Mutex // protects tdb, as Get is also called from outside the chain's thread
+}
+
+func NewTxIndex(dir string) (ti *TxIndex) {
+	ti = new(TxIndex)
+	ti.dir = dir + "txindex" + string(os.PathSeparator)
+	os.MkdirAll(ti.dir, 0770)
+	if d, _ := ioutil.ReadFile(ti.dir + "tip"); len(d) == 36 {
+		ti.LastBlockHash = d[:32]
+		ti.LastBlockHeight = binary.LittleEndian.Uint32(d[32:36])
+	}
+	return
+}
+
+func (ti *TxIndex) dbN(i int) (db *qdb.DB) {
+	ti.mutex.Lock()
+	if ti.tdb[i] == nil {
+		qdb.NewDBExt(&ti.tdb[i], ti.dir+fmt.Sprintf("%06d", i), true, nil, 100000)
+		if ti.nosyncinprogress {
+			ti.tdb[i].NoSync()
+		}
+	}
+	db = ti.tdb[i]
+	ti.mutex.Unlock()
+	return
+}
+
+// Adds transactions of the block, that has just been put on top of the main chain
+func (ti *TxIndex) AddBlock(bl *btc.Block, height uint32, sync bool) {
+	ti.nosync()
+	offs := uint32(bl.TxOffset)
+	var val [36]byte
+	for i, tx := range bl.Txs {
+		copy(val[:24], tx.Hash.Hash[8:32])
+		binary.LittleEndian.PutUint32(val[24:28], height)
+		binary.LittleEndian.PutUint32(val[28:32], offs)
+		binary.LittleEndian.PutUint32(val[32:36], tx.Size)
+		offs += tx.Size
+		ind := qdb.KeyType(binary.LittleEndian.Uint64(tx.Hash.Hash[:8]))
+		_db := ti.dbN(int(tx.Hash.Hash[31]) % NumberOfTxIndexSubDBs)
+		if i == 0 {
+			// Keep the record of an older coinbase with the same txid, so undoing this block does not lose it
+			if v := _db.Get(ind); v != nil && bytes.Equal(v[:24], val[:24]) {
+				continue
+			}
+		}
+		_db.PutExt(ind, val[:], qdb.NO_CACHE)
+	}
+	ti.LastBlockHash = bl.Hash.Hash[:]
+	ti.LastBlockHeight = height
+	if sync {
+		ti.Sync()
+	}
+}
+
+// Removes transactions of the block, that has just been reverted
+func (ti *TxIndex) UndoBlock(bl *btc.Block) {
+	for _, tx := range bl.Txs {
+		ind := qdb.KeyType(binary.LittleEndian.Uint64(tx.Hash.Hash[:8]))
+		_db := ti.dbN(int(tx.Hash.Hash[31]) % NumberOfTxIndexSubDBs)
+		// Do not remove a duplicate txid (BIP-30), that is still there from an older block
+		if v := _db.Get(ind); v != nil && binary.LittleEndian.Uint32(v[24:28]) == ti.LastBlockHeight {
+			_db.Del(ind)
+		}
+	}
+	ti.LastBlockHash = btc.NewUint256(bl.ParentHash()).Hash[:]
+	ti.LastBlockHeight--
+}
+
+// Returns the height of the block with the given transaction, as well as its position and size
+func (ti *TxIndex) Get(txid *btc.Uint256) (height, offs, size uint32, e error) {
+	ind := qdb.KeyType(binary.LittleEndian.Uint64(txid.Hash[:8]))
+	v := ti.dbN(int(txid.Hash[31]) % NumberOfTxIndexSubDBs).Get(ind)
+	if v == nil || !bytes.Equal(v[:24], txid.Hash[8:32]) {
+		e = errors.New("Transaction not found in the index")
+		return
+	}
+	height = binary.LittleEndian.Uint32(v[24:28])
+	offs = binary.LittleEndian.Uint32(v[28:32])
+	size = binary.LittleEndian.Uint32(v[32:36])
+	return
+}
+
+func (ti *TxIndex) nosync() {
+	ti.mutex.Lock()
+	if !ti.nosyncinprogress {
+		ti.nosyncinprogress = true
+		for i := range ti.tdb {
+			if ti.tdb[i] != nil {
+				ti.tdb[i].NoSync()
+			}
+		}
+	}
+	ti.mutex.Unlock()
+}
+
+func (ti *TxIndex) saveTip() {
+	if ti.LastBlockHash != nil {
+		d := make([]byte, 36)
+		copy(d[:32], ti.LastBlockHash)
+		binary.LittleEndian.PutUint32(d[32:36], ti.LastBlockHeight)
+		ioutil.WriteFile(ti.dir+"tip.tmp", d, 0666)
+		os.Rename(ti.dir+"tip.tmp", ti.dir+"tip")
+	}
+}
+
+// Flush all the data to files
+func (ti *TxIndex) Sync() {
+	ti.mutex.Lock()
+	ti.nosyncinprogress = false
+	for i := range ti.tdb {
+		if ti.tdb[i] != nil {
+			ti.tdb[i].Sync()
+		}
+	}
+	ti.mutex.Unlock()
+	ti.saveTip()
+}
+
+// Call it when the main thread is idle - this will do DB defrag
+func (ti *TxIndex) Idle() bool {
+	for i := range ti.tdb {
+		if db := ti.opened(i); db != nil && db.Defrag() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the i-th database, if it has been opened
+func (ti *TxIndex) opened(i int) (db *qdb.DB) {
+	ti.mutex.Lock()
+	db = ti.tdb[i]
+	ti.mutex.Unlock()
+	return
+}
+
+func (ti *TxIndex) closeDBs() {
+	ti.mutex.Lock()
+	for i := range ti.tdb {
+		if ti.tdb[i] != nil {
+			ti.tdb[i].Close()
+			ti.tdb[i] = nil
+		}
+	}
+	ti.mutex.Unlock()
+}
+
+// Flush the data and close all the files
+func (ti *TxIndex) Close() {
+	ti.closeDBs()
+	ti.saveTip()
+}
+
+func (ti *TxIndex) GetStats() (s string) {
+	var cnt int
+	for i := range ti.tdb {
+		cnt += ti.dbN(i).Count()
+	}
+	return fmt.Sprintf("TXINDEX: %d transactions.  Last block: %d\n", cnt, ti.LastBlockHeight)
+}
+
+// Brings the transaction index in line with the main chain, using the block database.
+// Indexed blocks that are not in the main chain anymore get reverted first. If the last
+// indexed block is unknown (or cannot be reverted), the index is built from scratch.
+func (ch *Chain) syncTxIndex() (e error) {
+	ti := ch.TxIndex
+	var start *BlockTreeNode
+	if ti.LastBlockHash != nil {
+		start = ch.BlockIndex[btc.NewUint256(ti.LastBlockHash).BIdx()]
+	}
+	for start != nil && (start.Height > ch.BlockTreeEnd.Height || ch.BlockTreeEnd.FindAncestor(start.Height) != start) {
+		bl, er := ch.getBlock(start)
+		if er != nil {
+			start = nil
+			break
+		}
+		ti.UndoBlock(bl)
+		start = start.Parent
+	}
+
+	if start == nil {
+		if ch.BlockTreeEnd != ch.BlockTreeRoot {
+			fmt.Println("Building the transaction index from the block database...")
+		}
+		ti.closeDBs()
+		os.RemoveAll(ti.dir)
+		os.MkdirAll(ti.dir, 0770)
+		start = ch.BlockTreeRoot
+	}
+
+	prv := time.Now().UnixNano()
+	for n := start.FindPathTo(ch.BlockTreeEnd); n != nil; n = n.FindPathTo(ch.BlockTreeEnd) {
+		if AbortNow {
+			return errors.New("Aborted")
+		}
+		var bl *btc.Block
+		if bl, e = ch.getBlock(n); e != nil {
+			return
+		}
+		ti.AddBlock(bl, n.Height, false)
+		if now := time.Now().UnixNano(); now-prv >= 10e9 {
+			fmt.Println("Indexing transactions ...", n.Height, "/", ch.BlockTreeEnd.Height)
+			prv = now
+		}
+	}
+	ti.Sync()
+	return
+}
+
+// Returns a transaction from the main chain (also its raw data), with the block's height.
+// It needs the transaction index (see NewChanOpts.TxIndex).
+func (ch *Chain) GetTx(txid *btc.Uint256) (tx *btc.Tx, raw []byte, height uint32, e error) {
+	if ch.TxIndex == nil {
+		e = errors.New("Transaction index is not enabled")
+		return
+	}
+	height, offs, size, e := ch.TxIndex.Get(txid)
+	if e != nil {
+		return
+	}
+	ch.BlockIndexAccess.Lock()
+	var n *BlockTreeNode
+	if height <= ch.BlockTreeEnd.Height {
+		n = ch.BlockTreeEnd.FindAncestor(height)
+	}
+	ch.BlockIndexAccess.Unlock()
+	if n == nil {
+		e = errors.New("Block not in the main chain")
+		return
+	}
+	bl, _, e := ch.Blocks.BlockGet(n.BlockHash)
+	if e != nil {
+		return
+	}
+	if uint64(offs)+uint64(size) > uint64(len(bl)) {
+		e = errors.New("Transaction outside of its block's data")
+		return
+	}
+	raw = bl[offs : offs+size]
+	if tx, _ = btc.NewTx(raw); tx == nil {
+		e = errors.New("Transaction data broken")
+		return
+	}
+	tx.Size = size
+	tx.SetHash(raw)
+	if !tx.Hash.Equal(txid) {
+		e = errors.New("Transaction index does not match the block")
+	}
+	return
+}
@@ -0,0 +1,167 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/wchh/gocoin/lib/btc"
+	"github.com/wchh/gocoin/lib/qdb"
+	"io/ioutil"
+	"time"
+)
+
+/*
+	The "muhash" file in the unspent folder keeps the state of UTXO set's MuHash:
+		[0:32]   - hash of the last block that the state applies to
+		[32:800] - btc.MuHash state
+	It is written with each commit of the database. If it does not match the database
+	(e.g. older version of the folder), the hash is calculated from scratch when loading.
+*/
+
+// Statistics of the UTXO set, comparable with Bitcoin Core's gettxoutsetinfo.
+// Unspendable outputs (OP_RETURN or too long scripts) are not counted, as they are not in Core's set.
+type UtxoStats struct {
+	Height         uint32
+	BlockHash      *btc.Uint256
+	Transactions   uint64 // with at least one spendable output
+	Outputs        uint64
+	TotalAmount    uint64
+	BogoSize       uint64 // calculated the same way as by Core
+	SerializedSize uint64 // size of the records in the unspent database
+	MuHash         *btc.Uint256
+}
+
+func isUnspendable(pkscr []byte) bool {
+	return len(pkscr) > 0 && pkscr[0] == 0x6a || len(pkscr) > 10000
+}
+
+// Serializes an unspent output the way Bitcoin Core does it for the UTXO set hash
+func utxoHashElement(rec *QdbRec, vout int) []byte {
+	out := rec.Outs[vout]
+	b := new(bytes.Buffer)
+	b.Write(rec.TxID[:])
+	binary.Write(b, binary.LittleEndian, uint32(vout))
+	code := rec.InBlock << 1
+	if rec.Coinbase {
+		code |= 1
+	}
+	binary.Write(b, binary.LittleEndian, code)
+	binary.Write(b, binary.LittleEndian, out.Value)
+	btc.WriteVlen(b, uint64(len(out.PKScr)))
+	b.Write(out.PKScr)
+	return b.Bytes()
+}
+
+// Adds all the spendable outputs of the record to the hash
+func muhashInsertRec(m *btc.MuHash, rec *QdbRec) {
+	for i := range rec.Outs {
+		if rec.Outs[i] != nil && !isUnspendable(rec.Outs[i].PKScr) {
+			m.Insert(utxoHashElement(rec, i))
+		}
+	}
+}
+
+func (db *UnspentDB) hashInsert(rec *QdbRec, vout int) {
+	if !isUnspendable(rec.Outs[vout].PKScr) {
+		db.muhash.Insert(utxoHashElement(rec, vout))
+	}
+}
+
+func (db *UnspentDB) hashRemove(rec *QdbRec, vout int) {
+	if !isUnspendable(rec.Outs[vout].PKScr) {
+		db.muhash.Remove(utxoHashElement(rec, vout))
+	}
+}
+
+// Replacing the record at the given key - the old outputs go away, the new ones come in
+func (db *UnspentDB) hashReplace(_db *qdb.DB, ind qdb.KeyType, rec *QdbRec) {
+	if v := _db.Get(ind); v != nil {
+		old := NewQdbRec(ind, v)
+		for i := range old.Outs {
+			if old.Outs[i] != nil {
+				db.hashRemove(old, i)
+			}
+		}
+	}
+	for i := range rec.Outs {
+		if rec.Outs[i] != nil {
+			db.hashInsert(rec, i)
+		}
+	}
+}
+
+// Loads the state of the UTXO set hash, or calculates it if the file is not up to date
+func (db *UnspentDB) loadMuHash() {
+	if d, _ := ioutil.ReadFile(db.dir + "muhash"); len(d) == 32+btc.MuHashStateSize &&
+		db.LastBlockHash != nil && bytes.Equal(d[:32], db.LastBlockHash) {
+		if m, e := btc.NewMuHashFromBytes(d[32:]); e == nil {
+			db.muhash = m
+			return
+		}
+	}
+	db.muhash = btc.NewMuHash()
+	if db.LastBlockHash == nil {
+		return
+	}
+	fmt.Println("Calculating hash of the UTXO set...")
+	var cnt uint64
+	prv := time.Now().UnixNano()
+	db.BrowseUTXO(false, func(rec *QdbRec) {
+		for i := range rec.Outs {
+			if rec.Outs[i] != nil {
+				db.hashInsert(rec, i)
+				cnt++
+			}
+		}
+		if now := time.Now().UnixNano(); now-prv >= 10e9 {
+			fmt.Println("Hashing UTXO set ...", cnt, "outputs so far")
+			prv = now
+		}
+	})
+	db.batch.WriteFile("muhash", db.muhashFile())
+	db.batch.Commit()
+}
+
+// Returns content of the "muhash" file
+func (db *UnspentDB) muhashFile() (d []byte) {
+	d = make([]byte, 32, 32+btc.MuHashStateSize)
+	copy(d, db.LastBlockHash)
+	d = append(d, db.muhash.Bytes()...)
+	return
+}
+
+// Returns MuHash of the current UTXO set (the same value as Core's gettxoutsetinfo muhash)
+func (db *UnspentDB) MuHash() *btc.Uint256 {
+	return db.muhash.Finalize()
+}
+
+// Goes through the whole UTXO set to calculate its statistics.
+// Call it from the chain's thread, so the database does not change meanwhile.
+func (db *UnspentDB) GetUtxoStats() (s *UtxoStats) {
+	s = new(UtxoStats)
+	s.Height = db.LastBlockHeight
+	if db.LastBlockHash != nil {
+		s.BlockHash = btc.NewUint256(db.LastBlockHash)
+	}
+	for i := range db.tdb {
+		db.dbN(i).BrowseAll(func(k qdb.KeyType, v []byte) uint32 {
+			rec := NewQdbRecStatic(k, v)
+			var any bool
+			for _, out := range rec.Outs {
+				if out != nil && !isUnspendable(out.PKScr) {
+					any = true
+					s.Outputs++
+					s.TotalAmount += out.Value
+					s.BogoSize += 32 + 4 + 4 + 8 + 2 + uint64(len(out.PKScr))
+				}
+			}
+			if any {
+				s.Transactions++
+			}
+			s.SerializedSize += 8 + uint64(len(v))
+			return 0
+		})
+	}
+	s.MuHash = db.MuHash()
+	return
+}
@@ -0,0 +1,147 @@
+package chain
+
+import (
+	"encoding/binary"
+)
+
+// BIP-9 deployment states
+const (
+	THRESHOLD_DEFINED = iota
+	THRESHOLD_STARTED
+	THRESHOLD_LOCKED_IN
+	THRESHOLD_ACTIVE
+	THRESHOLD_FAILED
+
+	vbStateUnknown = 0xff // not cached yet
+)
+
+const (
+	VERSIONBITS_TOP_MASK = 0xe0000000
+	VERSIONBITS_TOP_BITS = 0x20000000 // blocks signalling any deployment need these top bits
+)
+
+var VBStateNames = []string{"DEFINED", "STARTED", "LOCKED_IN", "ACTIVE", "FAILED"}
+
+// Returns true if the block signals readiness for the given bit
+func (n *BlockTreeNode) signals(bit uint) bool {
+	ver := binary.LittleEndian.Uint32(n.BlockHeader[0:4])
+	return (ver&VERSIONBITS_TOP_MASK) == VERSIONBITS_TOP_BITS && (ver&(1<<bit)) != 0
+}
+
+// Returns the state of deployment d for the block following prev.
+// The state only changes at period boundaries, so it is cached in the last node of each period.
+func (ch *Chain) DeploymentState(prev *BlockTreeNode, d int) byte {
+	ch.vbMutex.Lock()
+	defer ch.vbMutex.Unlock()
+	return ch.deploymentState(prev, d)
+}
+
+func (ch *Chain) deploymentState(prev *BlockTreeNode, d int) (state byte) {
+	dep := &ch.Params.Deployments[d]
+	period := ch.Params.MinerConfirmationWindow
+
+	// The state for a period is the one cached in the last node of the previous period
+	if prev != nil {
+		if back := (prev.Height + 1) % period; back > prev.Height {
+			prev = nil
+		} else {
+			prev = prev.FindAncestor(prev.Height - back)
+		}
+	}
+
+	// Go back until we find a period with a known state
+	var todo []*BlockTreeNode
+	state = THRESHOLD_DEFINED
+	for prev != nil {
+		if st := prev.vbState(d, len(ch.Params.Deployments)); st != vbStateUnknown {
+			state = st
+			break
+		}
+		if prev.MedianTimePast() < dep.StartTime {
+			// Nothing can happen before the start time
+			prev.vbStates[d] = THRESHOLD_DEFINED
+			break
+		}
+		todo = append(todo, prev)
+		if prev.Height < period {
+			prev = nil
+		} else {
+			prev = prev.FindAncestor(prev.Height - period)
+		}
+	}
+
+	// Now walk forward and compute the state of the following periods
+	for i := len(todo) - 1; i >= 0; i-- {
+		prev = todo[i]
+		mtp := prev.MedianTimePast()
+		switch state {
+		case THRESHOLD_DEFINED:
+			if mtp >= dep.Timeout {
+				state = THRESHOLD_FAILED
+			} else if mtp >= dep.StartTime {
+				state = THRESHOLD_STARTED
+			}
+
+		case THRESHOLD_STARTED:
+			if mtp >= dep.Timeout {
+				state = THRESHOLD_FAILED
+				break
+			}
+			var cnt uint32
+			n := prev
+			for j := uint32(0); j < period && n != nil; j++ {
+				if n.signals(dep.Bit) {
+					cnt++
+				}
+				n = n.Parent
+			}
+			if cnt >= ch.Params.RuleChangeActivationThreshold {
+				state = THRESHOLD_LOCKED_IN
+			}
+
+		case THRESHOLD_LOCKED_IN:
+			state = THRESHOLD_ACTIVE
+		}
+		prev.vbStates[d] = state
+	}
+	return
+}
+
+// Returns the cached state (allocating the cache if needed)
+func (n *BlockTreeNode) vbState(d, cnt int) byte {
+	if n.vbStates == nil {
+		n.vbStates = make([]byte, cnt)
+		for i := range n.vbStates {
+			n.vbStates[i] = vbStateUnknown
+		}
+	}
+	return n.vbStates[d]
+}
+
+// Returns script verification flags of all the deployments active for the block following prev
+func (ch *Chain) DeploymentFlags(prev *BlockTreeNode) (flags uint32) {
+	ch.vbMutex.Lock()
+	for d := range ch.Params.Deployments {
+		if ch.deploymentState(prev, d) == THRESHOLD_ACTIVE {
+			flags |= ch.Params.Deployments[d].VerifyFlags
+		}
+	}
+	ch.vbMutex.Unlock()
+	return
+}
+
+// Returns the state of deployment d for the block following last, as well as
+// how many blocks of the current period (ending with last) have signalled for it.
+func (ch *Chain) DeploymentStats(last *BlockTreeNode, d int) (state byte, signalled, blocks uint32) {
+	state = ch.DeploymentState(last, d)
+	bit := ch.Params.Deployments[d].Bit
+	blocks = (last.Height + 1) % ch.Params.MinerConfirmationWindow
+	n := last
+	for i := uint32(0); i < blocks; i++ {
+		if n.signals(bit) {
+			signalled++
+		}
+		n = n.Parent
+	}
+	return
+}
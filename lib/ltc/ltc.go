@@ -26,7 +26,7 @@ func AddrVerPubkey(testnet bool) byte {
 }
 
 func NewAddrFromPkScript(scr []byte, testnet bool) (ad *btc.BtcAddr) {
-	ad = btc.NewAddrFromPkScript(scr, testnet)
+	ad = btc.NewAddrFromPkScript(scr, btc.GetChainParams(testnet))
 	if ad != nil && ad.Version == btc.AddrVerPubkey(false) {
 		ad.Version = LTC_ADDR_VERSION
 	}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/wchh/gocoin/lib/btc"
 	"github.com/wchh/gocoin/lib/others/sys"
 	"github.com/wchh/gocoin/lib/others/utils"
 	"github.com/wchh/gocoin/lib/qdb"
@@ -26,7 +27,7 @@ var (
 	proxyPeer    *PeerAddr // when this is not nil we should only connect to this single node
 	peerdb_mutex sync.Mutex
 
-	Testnet     bool
+	Params      *btc.ChainParams = &btc.MainNetParams
 	ConnectOnly string
 	Services    uint64 = 1
 )
@@ -36,11 +37,7 @@ type PeerAddr struct {
 }
 
 func DefaultTcpPort() uint16 {
-	if Testnet {
-		return 18333
-	} else {
-		return 8333
-	}
+	return Params.DefaultPort
 }
 
 func NewEmptyPeer() (p *PeerAddr) {
@@ -234,7 +231,7 @@ func InitPeers(dir string) {
 	if ConnectOnly != "" {
 		x := strings.Index(ConnectOnly, ":")
 		if x == -1 {
-			ConnectOnly = fmt.Sprint(ConnectOnly, ":", DefaultTcpPort)
+			ConnectOnly = fmt.Sprint(ConnectOnly, ":", DefaultTcpPort())
 		}
 		oa, e := net.ResolveTCPAddr("tcp4", ConnectOnly)
 		if e != nil {
@@ -249,32 +246,19 @@ func InitPeers(dir string) {
 			oa.IP[0], oa.IP[1], oa.IP[2], oa.IP[3], oa.Port)
 	} else {
 		go func() {
-			if !Testnet {
-				initSeeds([]string{
-					"seed.bitcoin.sipa.be",
-					"dnsseed.bluematt.me",
-					"seed.bitcoinstats.com",
-					"seed.bitnodes.io",
-					"bitseed.xf2.org",
-				}, 8333)
-			} else {
-				for j := range testnet_seeds {
-					ip := net.ParseIP(testnet_seeds[j])
-					if ip != nil && len(ip) == 16 {
-						p := NewEmptyPeer()
-						p.Time = uint32(time.Now().Unix())
-						p.Services = 1
-						copy(p.Ip6[:], ip[:12])
-						copy(p.Ip4[:], ip[12:16])
-						p.Port = 18333
-						p.Save()
-					}
+			for j := range Params.FixedSeeds {
+				ip := net.ParseIP(Params.FixedSeeds[j])
+				if ip != nil && len(ip) == 16 {
+					p := NewEmptyPeer()
+					p.Time = uint32(time.Now().Unix())
+					p.Services = 1
+					copy(p.Ip6[:], ip[:12])
+					copy(p.Ip4[:], ip[12:16])
+					p.Port = Params.DefaultPort
+					p.Save()
 				}
-				initSeeds([]string{
-					//"testnet-seed.bitcoin.petertodd.org",
-					"testnet-seed.bluematt.me",
-				}, 18333)
 			}
+			initSeeds(Params.DNSSeeds, Params.DefaultPort)
 		}()
 	}
 }
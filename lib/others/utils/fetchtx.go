@@ -7,6 +7,7 @@ import (
 	"github.com/wchh/gocoin/lib/btc"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 type onetx struct {
@@ -78,7 +79,8 @@ func GetTxFromExplorer(txid *btc.Uint256) ([]byte, []byte) {
 				fmt.Printf("Transaction size mismatch: %d expexted, %d decoded\n", txx.Size, len(rawtx))
 				return nil, rawtx
 			}
-			curid := btc.NewSha2Hash(rawtx)
+			tx.SetHash(rawtx)
+			curid := tx.Hash
 			if !curid.Equal(txid) {
 				fmt.Println("The downloaded transaction does not match its ID.", txid.String())
 				return nil, rawtx
@@ -133,6 +135,26 @@ func GetTxFromWebBTC(txid *btc.Uint256) (raw []byte) {
 	return
 }
 
+// Download raw transaction from a gocoin node's WebUI (i.e. "127.0.0.1:8833").
+// The node must have the transaction in its memory pool or in its transaction index.
+func GetTxFromNode(host string, txid *btc.Uint256) (raw []byte) {
+	r, er := http.Get("http://" + host + "/raw_tx?hex&id=" + txid.String())
+	if er == nil && r.StatusCode == 200 {
+		c, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		raw, _ = hex.DecodeString(strings.TrimSpace(string(c)))
+		if tx, _ := btc.NewTx(raw); tx != nil {
+			tx.SetHash(raw)
+			if !txid.Equal(tx.Hash) {
+				raw = nil
+			}
+		} else {
+			raw = nil
+		}
+	}
+	return
+}
+
 // Download raw transaction from a web server (try one after another)
 func GetTxFromWeb(txid *btc.Uint256) (raw []byte) {
 	raw = GetTxFromWebBTC(txid)
@@ -0,0 +1,263 @@
+package qdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Batch groups changes of several databases (and some small files), so that they
+make it to the disk all together, or not at all.
+
+A database added to a batch no longer writes its changes to disk on its own
+(do not call its Sync either). The changes stay in memory, where Get and Browse
+see them, until the batch's Commit, which:
+ 1. Writes them all, along with the batch's files, into the journal file.
+    The journal is created under a temporary name and then renamed, so it
+    either appears complete or does not appear at all - that is the commit marker.
+ 2. Writes the changes into the databases' files, and then the batch's files.
+ 3. Removes the journal.
+
+After a crash, call RecoverBatch before opening the databases. It finishes
+the last batch if its journal made it to the disk, so each database ends up
+with the state from the same commit.
+
+Journal file (all LSB):
+
+	[0:8] - "QDBBATCH"
+	[4] - number of databases, each one followed by:
+		[2] - length + folder of the database (relative to the journal's folder)
+		[4] - number of records, each one being:
+			[8] - key, [4] - flags, [4] - length (0xffffffff if deleted) + data
+	[4] - number of files, each one followed by:
+		[2] - length + name of the file (relative to the journal's folder)
+		[4] - length + content
+	[32] - SHA256 of all the above
+*/
+type Batch struct {
+	journal string
+	dbs     []*DB
+	files   map[string][]byte
+}
+
+const (
+	batchMagic   = "QDBBATCH"
+	batchDeleted = 0xffffffff
+)
+
+// Creates a new batch, using the given journal file
+func NewBatch(journal string) (b *Batch) {
+	b = new(Batch)
+	b.journal = journal
+	b.files = make(map[string][]byte)
+	return
+}
+
+// Makes the database a part of the batch
+func (b *Batch) Add(db *DB) {
+	db.mutex.Lock()
+	db.batched = true
+	db.mutex.Unlock()
+	b.dbs = append(b.dbs, db)
+}
+
+// Sets content of the file (with the name relative to the journal's folder)
+// to be written with the next Commit
+func (b *Batch) WriteFile(name string, data []byte) {
+	b.files[name] = data
+}
+
+// Returns number of the changed records, not committed yet
+func (b *Batch) Pending() (cnt int) {
+	for _, db := range b.dbs {
+		db.mutex.Lock()
+		cnt += len(db.pending_recs)
+		db.mutex.Unlock()
+	}
+	return
+}
+
+// Writes all the pending changes to disk
+func (b *Batch) Commit() (e error) {
+	d, dbs := b.journalData()
+	if len(dbs) == 0 && len(b.files) == 0 {
+		return
+	}
+	cnt("BatchCommit")
+	if e = writeFileSync(b.journal, d); e != nil {
+		return
+	}
+	for _, db := range dbs {
+		db.mutex.Lock()
+		db.commitpending()
+		db.mutex.Unlock()
+	}
+	e = b.writeFiles()
+	if e == nil {
+		e = os.Remove(b.journal)
+	}
+	return
+}
+
+func (b *Batch) writeFiles() (e error) {
+	dir := filepath.Dir(b.journal)
+	for name, data := range b.files {
+		if e = writeFileSync(filepath.Join(dir, name), data); e != nil {
+			return
+		}
+	}
+	b.files = make(map[string][]byte)
+	return
+}
+
+// Serializes the pending changes. Returns also the databases that have any.
+func (b *Batch) journalData() (d []byte, dbs []*DB) {
+	dir := filepath.Dir(b.journal)
+	buf := new(bytes.Buffer)
+	buf.WriteString(batchMagic)
+	dbcnt := buf.Len()
+	buf.Write(make([]byte, 4)) // filled below
+	for _, db := range b.dbs {
+		db.mutex.Lock()
+		if len(db.pending_recs) > 0 {
+			rel, _ := filepath.Rel(dir, db.dir)
+			binary.Write(buf, binary.LittleEndian, uint16(len(rel)))
+			buf.WriteString(rel)
+			binary.Write(buf, binary.LittleEndian, uint32(len(db.pending_recs)))
+			for k := range db.pending_recs {
+				binary.Write(buf, binary.LittleEndian, k)
+				if rec := db.idx.get(k); rec != nil {
+					db.loadrec(rec)
+					binary.Write(buf, binary.LittleEndian, rec.flags)
+					binary.Write(buf, binary.LittleEndian, rec.datlen)
+					buf.Write(rec.Slice())
+				} else {
+					binary.Write(buf, binary.LittleEndian, uint32(0))
+					binary.Write(buf, binary.LittleEndian, uint32(batchDeleted))
+				}
+			}
+			dbs = append(dbs, db)
+		}
+		db.mutex.Unlock()
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(b.files)))
+	for name, data := range b.files {
+		binary.Write(buf, binary.LittleEndian, uint16(len(name)))
+		buf.WriteString(name)
+		binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+	d = buf.Bytes()
+	binary.LittleEndian.PutUint32(d[dbcnt:], uint32(len(dbs)))
+	sh := sha256.Sum256(d)
+	d = append(d, sh[:]...)
+	return
+}
+
+// Finishes the last commit of the batch that uses the given journal file,
+// if it got interrupted. Call it before opening any of the batch's databases.
+func RecoverBatch(journal string) (e error) {
+	os.Remove(journal + ".tmp") // not committed
+	d, e := ioutil.ReadFile(journal)
+	if e != nil {
+		if os.IsNotExist(e) {
+			e = nil
+		}
+		return
+	}
+	if len(d) < len(batchMagic)+4+4+32 || string(d[:len(batchMagic)]) != batchMagic {
+		return errors.New("Not a batch journal: " + journal)
+	}
+	if sh := sha256.Sum256(d[:len(d)-32]); !bytes.Equal(sh[:], d[len(d)-32:]) {
+		return errors.New("Broken batch journal: " + journal)
+	}
+	cnt("BatchRecover")
+
+	dir := filepath.Dir(journal)
+	b := NewBatch(journal)
+	rd := bytes.NewReader(d[len(batchMagic) : len(d)-32])
+	readstr := func() string {
+		var le uint16
+		binary.Read(rd, binary.LittleEndian, &le)
+		s := make([]byte, le)
+		rd.Read(s)
+		return string(s)
+	}
+
+	var dbcnt, reccnt, flags, le uint32
+	var key KeyType
+	binary.Read(rd, binary.LittleEndian, &dbcnt)
+	for ; dbcnt > 0; dbcnt-- {
+		var db *DB
+		if e = NewDBExt(&db, filepath.Join(dir, readstr()), false, nil, 0); e != nil {
+			return
+		}
+		binary.Read(rd, binary.LittleEndian, &reccnt)
+		for ; reccnt > 0; reccnt-- {
+			binary.Read(rd, binary.LittleEndian, &key)
+			binary.Read(rd, binary.LittleEndian, &flags)
+			binary.Read(rd, binary.LittleEndian, &le)
+			if le == batchDeleted {
+				db.idx.memdel(key)
+			} else {
+				val := make([]byte, le)
+				rd.Read(val)
+				db.idx.memput(key, newIdx(val, flags))
+			}
+			db.pending_recs[key] = true
+		}
+		db.commitpending()
+		db.Close()
+	}
+
+	binary.Read(rd, binary.LittleEndian, &dbcnt)
+	for ; dbcnt > 0; dbcnt-- {
+		name := readstr()
+		binary.Read(rd, binary.LittleEndian, &le)
+		data := make([]byte, le)
+		rd.Read(data)
+		b.WriteFile(name, data)
+	}
+	if e = b.writeFiles(); e == nil {
+		e = os.Remove(journal)
+	}
+	return
+}
+
+// Writes the pending records to disk and makes sure they are there
+func (db *DB) commitpending() {
+	db.sync()
+	db.Flush()
+}
+
+// Writes the file via a temporary one, making sure that the content is on disk before the rename
+func writeFileSync(fn string, data []byte) (e error) {
+	f, e := os.Create(fn + ".tmp")
+	if e != nil {
+		return
+	}
+	_, e = f.Write(data)
+	if e == nil {
+		e = f.Sync()
+	}
+	if er := f.Close(); e == nil {
+		e = er
+	}
+	if e == nil {
+		e = os.Rename(fn+".tmp", fn)
+	}
+	if e != nil {
+		os.Remove(fn + ".tmp")
+		return
+	}
+	if d, er := os.Open(filepath.Dir(fn)); er == nil {
+		d.Sync() // make the rename durable (where supported)
+		d.Close()
+	}
+	return
+}
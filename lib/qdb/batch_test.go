@@ -0,0 +1,103 @@
+package qdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const batchdir = "test_batch/"
+
+func openBatchDBs(b *Batch) (dbs [2]*DB) {
+	for i := range dbs {
+		NewDBExt(&dbs[i], batchdir+string('a'+byte(i)), true, nil, 0)
+		if b != nil {
+			b.Add(dbs[i])
+		}
+	}
+	return
+}
+
+func closeBatchDBs(dbs [2]*DB) {
+	for i := range dbs {
+		dbs[i].Close()
+	}
+}
+
+func TestBatch(t *testing.T) {
+	os.RemoveAll(batchdir)
+	defer os.RemoveAll(batchdir)
+
+	// Commit a batch
+	b := NewBatch(batchdir + "journal")
+	dbs := openBatchDBs(b)
+	for i := 0; i < 3*int(MaxPendingNoSync); i++ {
+		dbs[i&1].Put(KeyType(i), []byte{byte(i), 1})
+	}
+	if b.Pending() != 3*int(MaxPendingNoSync) {
+		t.Error("Bad number of pending records", b.Pending())
+	}
+	b.WriteFile("marker", []byte("one"))
+	if e := b.Commit(); e != nil {
+		t.Fatal("Commit failed", e)
+	}
+	if b.Pending() != 0 {
+		t.Error("Records still pending after commit", b.Pending())
+	}
+	if _, e := os.Stat(batchdir + "journal"); e == nil {
+		t.Error("Journal not removed")
+	}
+
+	// Changes that made it to the journal, but not to the databases
+	dbs[0].Put(1000000, []byte("new"))
+	dbs[0].Del(0)
+	dbs[1].Put(1, []byte("upd"))
+	b.WriteFile("marker", []byte("two"))
+	d, _ := b.journalData()
+	if e := writeFileSync(batchdir+"journal", d); e != nil {
+		t.Fatal("Cannot write journal", e)
+	}
+	// ... and some that did not make it anywhere
+	dbs[1].Put(2000000, []byte("lost"))
+	d, _ = b.journalData()
+	ioutil.WriteFile(batchdir+"journal.tmp", d[:len(d)/2], 0666)
+
+	// Crash - drop everything that is in memory
+	for i := range dbs {
+		dbs[i].pending_recs = make(map[KeyType]bool)
+	}
+	closeBatchDBs(dbs)
+
+	if e := RecoverBatch(batchdir + "journal"); e != nil {
+		t.Fatal("Recovery failed", e)
+	}
+	dbs = openBatchDBs(nil)
+	if dbs[0].Count()+dbs[1].Count() != 3*int(MaxPendingNoSync) {
+		t.Error("Bad number of records", dbs[0].Count(), dbs[1].Count())
+	}
+	if v := dbs[0].Get(1000000); !bytes.Equal(v, []byte("new")) {
+		t.Error("Committed put not recovered", v)
+	}
+	if v := dbs[0].Get(0); v != nil {
+		t.Error("Committed delete not recovered", v)
+	}
+	if v := dbs[1].Get(1); !bytes.Equal(v, []byte("upd")) {
+		t.Error("Committed update not recovered", v)
+	}
+	if v := dbs[1].Get(2000000); v != nil {
+		t.Error("Not committed record present", v)
+	}
+	if v := dbs[1].Get(3); !bytes.Equal(v, []byte{3, 1}) {
+		t.Error("Record from the first commit broken", v)
+	}
+	if m, _ := ioutil.ReadFile(batchdir + "marker"); string(m) != "two" {
+		t.Error("Bad marker file", string(m))
+	}
+	for _, fn := range []string{"journal", "journal.tmp"} {
+		if _, e := os.Stat(batchdir + fn); e == nil {
+			t.Error("File", fn, "not removed")
+		}
+	}
+	closeBatchDBs(dbs)
+}
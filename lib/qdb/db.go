@@ -63,6 +63,7 @@ type DB struct {
 	idx *dbidx
 
 	nosync bool
+	batched bool // see Batch
 	pending_recs map[KeyType] bool
 
 	rdfile map[uint32] *os.File
@@ -263,6 +264,9 @@ func (db *DB) ApplyFlags(key KeyType, fl uint32) {
 func (db *DB) Defrag() (doing bool) {
 	db.mutex.Lock()
 	doing = db.idx.extra_space_used > (uint64(DefragPercentVal)*db.idx.disk_space_needed/100)
+	if db.batched && len(db.pending_recs)>0 {
+		doing = false // it would write the changes that are not committed yet
+	}
 	if doing {
 		cnt("DefragYes")
 		go func() {
@@ -388,6 +392,9 @@ func (db *DB) Flush() {
 
 
 func (db *DB) syncneeded() bool {
+	if db.batched {
+		return false // Batch.Commit does it
+	}
 	if len(db.pending_recs) > int(MaxPendingNoSync) {
 		cnt("SyncNeedBig")
 		return true
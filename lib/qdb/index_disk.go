@@ -127,6 +127,7 @@ func (idx *dbidx) loadlog(used map[uint32]bool) {
 	}
 
 	d, _ := ioutil.ReadAll(idx.logfile)
+	var valid int
 	for pos:=0; pos+12<=len(d); {
 		key := KeyType(binary.LittleEndian.Uint64(d[pos:pos+8]))
 		fpos := binary.LittleEndian.Uint32(d[pos+8:pos+12])
@@ -145,6 +146,13 @@ func (idx *dbidx) loadlog(used map[uint32]bool) {
 		} else {
 			idx.memdel(key)
 		}
+		valid = pos
+	}
+
+	if valid!=len(d) {
+		// cut off a broken entry, so the next ones do not get appended after it
+		idx.logfile.Truncate(int64(4+valid))
+		idx.logfile.Seek(int64(4+valid), os.SEEK_SET)
 	}
 
 	return
@@ -199,6 +207,7 @@ func (idx *dbidx) writedatfile() {
 	f.Write([]byte{0xff,0xff,0xff,0xff})
 	binary.Write(f, binary.LittleEndian, idx.version_seq)
 	f.Write([]byte("FINI"))
+	f.Sync() // before the old files get deleted
 	f.Close()
 
 	// now delete the previous log
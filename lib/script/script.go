@@ -20,9 +20,26 @@ var (
 const (
 	VER_P2SH   = 1 << 0
 	VER_DERSIG = 1 << 2
+	VER_CLTV   = 1 << 9  // BIP-65: OP_NOP2 becomes OP_CHECKLOCKTIMEVERIFY
+	VER_CSV    = 1 << 10 // BIP-112: OP_NOP3 becomes OP_CHECKSEQUENCEVERIFY
+
+	VER_CLEANSTACK = 1 << 8  // only one element may remain on the stack (requires VER_P2SH)
+	VER_WITNESS    = 1 << 11 // BIP-141: verify witness programs
+
+	VER_WITNESS_UPGRADABLE = 1 << 12 // fail on witness programs of unknown version (policy only)
+
+	// Flags used when verifying transactions for the memory pool
+	STANDARD_VERIFY_FLAGS = VER_P2SH | VER_DERSIG | VER_CLTV | VER_CSV |
+		VER_CLEANSTACK | VER_WITNESS | VER_WITNESS_UPGRADABLE
+)
+
+// Signature versions, used to select the signature hash algorithm
+const (
+	SIGVER_BASE       = 0
+	SIGVER_WITNESS_V0 = 1
 )
 
-func VerifyTxScript(sigScr []byte, pkScr []byte, i int, tx *btc.Tx, ver_flags uint32) bool {
+func VerifyTxScript(sigScr []byte, pkScr []byte, amount uint64, i int, tx *btc.Tx, ver_flags uint32) bool {
 	if DBG_SCR {
 		fmt.Println("VerifyTxScript", tx.Hash.String(), i+1, "/", len(tx.TxIn))
 		fmt.Println("sigScript:", hex.EncodeToString(sigScr[:]))
@@ -30,7 +47,8 @@ func VerifyTxScript(sigScr []byte, pkScr []byte, i int, tx *btc.Tx, ver_flags ui
 	}
 
 	var st, stP2SH scrStack
-	if !evalScript(sigScr, &st, tx, i, ver_flags) {
+	var had_witness bool
+	if !evalScript(sigScr, amount, &st, tx, i, ver_flags, SIGVER_BASE) {
 		if DBG_ERR {
 			if tx != nil {
 				fmt.Println("VerifyTxScript", tx.Hash.String(), i+1, "/", len(tx.TxIn))
@@ -56,7 +74,7 @@ func VerifyTxScript(sigScr []byte, pkScr []byte, i int, tx *btc.Tx, ver_flags ui
 		}
 	}
 
-	if !evalScript(pkScr, &st, tx, i, ver_flags) {
+	if !evalScript(pkScr, amount, &st, tx, i, ver_flags, SIGVER_BASE) {
 		if DBG_SCR {
 			fmt.Println("* pkScript failed :", hex.EncodeToString(pkScr[:]))
 			fmt.Println("* VerifyTxScript", tx.Hash.String(), i+1, "/", len(tx.TxIn))
@@ -72,13 +90,32 @@ func VerifyTxScript(sigScr []byte, pkScr []byte, i int, tx *btc.Tx, ver_flags ui
 		return false
 	}
 
-	if !st.popBool() {
+	if !st.topBool(-1) {
 		if DBG_SCR {
 			fmt.Println("* FALSE on stack after executing scripts:", hex.EncodeToString(pkScr[:]))
 		}
 		return false
 	}
 
+	// Bare witness program
+	if (ver_flags & VER_WITNESS) != 0 {
+		if witver, witprog := btc.IsWitnessProgram(pkScr); witprog != nil {
+			had_witness = true
+			if len(sigScr) != 0 {
+				if DBG_ERR {
+					fmt.Println("Witness program with non-empty sigScript")
+				}
+				return false
+			}
+			if !verifyWitnessProgram(tx, i, amount, witver, witprog, ver_flags) {
+				return false
+			}
+			// Bypass the cleanstack check at the end. The actual stack is obviously not clean
+			// for witness programs.
+			st.resize(1)
+		}
+	}
+
 	// Additional validation for spend-to-script-hash transactions:
 	if (ver_flags&VER_P2SH) != 0 && btc.IsPayToScript(pkScr) {
 		if DBG_SCR {
@@ -98,36 +135,189 @@ func VerifyTxScript(sigScr []byte, pkScr []byte, i int, tx *btc.Tx, ver_flags ui
 			return false
 		}
 
-		pubKey2 := stP2SH.pop()
+		// stP2SH cannot be empty here, because if it was the
+		// P2SH  HASH <> EQUAL  scriptPubKey would be evaluated with
+		// an empty stack and the evalScript above would return false.
+		st = stP2SH
+
+		pubKey2 := st.pop()
 		if DBG_SCR {
 			fmt.Println("pubKey2:", hex.EncodeToString(pubKey2))
 		}
 
-		if !evalScript(pubKey2, &stP2SH, tx, i, ver_flags) {
+		if !evalScript(pubKey2, amount, &st, tx, i, ver_flags, SIGVER_BASE) {
 			if DBG_ERR {
 				fmt.Println("P2SH extra verification failed")
 			}
 			return false
 		}
 
-		if stP2SH.size() == 0 {
+		if st.size() == 0 {
 			if DBG_SCR {
 				fmt.Println("* P2SH stack empty after executing script:", hex.EncodeToString(pubKey2))
 			}
 			return false
 		}
 
-		if !stP2SH.popBool() {
+		if !st.topBool(-1) {
 			if DBG_SCR {
 				fmt.Println("* FALSE on stack after executing P2SH script:", hex.EncodeToString(pubKey2))
 			}
 			return false
 		}
+
+		// P2SH witness program
+		if (ver_flags & VER_WITNESS) != 0 {
+			if witver, witprog := btc.IsWitnessProgram(pubKey2); witprog != nil {
+				had_witness = true
+				// The sigScript must be exactly a single push of the redeemScript.
+				// Otherwise we reintroduce malleability.
+				if !bytes.Equal(sigScr, PushData(pubKey2)) {
+					if DBG_ERR {
+						fmt.Println("P2SH witness program with malleated sigScript")
+					}
+					return false
+				}
+				if !verifyWitnessProgram(tx, i, amount, witver, witprog, ver_flags) {
+					return false
+				}
+				st.resize(1)
+			}
+		}
+	}
+
+	// The CLEANSTACK check is only performed after potential P2SH evaluation,
+	// as the non-P2SH evaluation of a P2SH script will obviously not result in
+	// a clean stack (the P2SH inputs remain).
+	if (ver_flags & VER_CLEANSTACK) != 0 {
+		// Could have been done at the same time as P2SH, but since it's
+		// only a policy rule, we keep it separate.
+		if (ver_flags & VER_P2SH) == 0 {
+			if DBG_ERR {
+				fmt.Println("VER_CLEANSTACK without VER_P2SH")
+			}
+			return false
+		}
+		if st.size() != 1 {
+			if DBG_ERR {
+				fmt.Println("Stack not clean")
+			}
+			return false
+		}
+	}
+
+	// Witness data must be empty for inputs that are not spending witness programs
+	if (ver_flags&VER_WITNESS) != 0 && !had_witness && len(tx.TxIn[i].Witness) > 0 {
+		if DBG_ERR {
+			fmt.Println("Unexpected witness data")
+		}
+		return false
+	}
+
+	return true
+}
+
+// Verifies the input's witness stack against the given witness program (BIP-141)
+func verifyWitnessProgram(tx *btc.Tx, i int, amount uint64, witver int, prog []byte, ver_flags uint32) bool {
+	var st scrStack
+	var scr []byte
+	witness := tx.TxIn[i].Witness
+
+	if witver != 0 {
+		// Higher version witness programs are reserved for future soft forks
+		if (ver_flags & VER_WITNESS_UPGRADABLE) != 0 {
+			if DBG_ERR {
+				fmt.Println("Upgradable witness program", witver)
+			}
+			return false
+		}
+		return true
+	}
+
+	if len(prog) == 32 {
+		// P2WSH: the last item of the witness is the script to execute
+		if len(witness) == 0 {
+			if DBG_ERR {
+				fmt.Println("P2WSH with empty witness")
+			}
+			return false
+		}
+		scr = witness[len(witness)-1]
+		if len(scr) > btc.MAX_SCRIPT_SIZE {
+			if DBG_ERR {
+				fmt.Println("P2WSH script too long", len(scr))
+			}
+			return false
+		}
+		if h := sha256.Sum256(scr); !bytes.Equal(h[:], prog) {
+			if DBG_ERR {
+				fmt.Println("P2WSH script mismatch")
+			}
+			return false
+		}
+		witness = witness[:len(witness)-1]
+	} else if len(prog) == 20 {
+		// P2WPKH: the witness must consist of exactly a signature and a public key
+		if len(witness) != 2 {
+			if DBG_ERR {
+				fmt.Println("P2WPKH witness must have 2 items")
+			}
+			return false
+		}
+		scr = make([]byte, 0, 25)
+		scr = append(scr, 0x76, 0xa9, 0x14) // OP_DUP OP_HASH160 <20 bytes>
+		scr = append(scr, prog...)
+		scr = append(scr, 0x88, 0xac) // OP_EQUALVERIFY OP_CHECKSIG
+	} else {
+		if DBG_ERR {
+			fmt.Println("Witness program of a wrong length", len(prog))
+		}
+		return false
+	}
+
+	for _, it := range witness {
+		if len(it) > btc.MAX_SCRIPT_ELEMENT_SIZE {
+			if DBG_ERR {
+				fmt.Println("Witness item too long", len(it))
+			}
+			return false
+		}
+		st.push(it)
 	}
 
+	if !evalScript(scr, amount, &st, tx, i, ver_flags, SIGVER_WITNESS_V0) {
+		return false
+	}
+
+	// Scripts inside witness implicitly require cleanstack behaviour
+	if st.size() != 1 || !st.topBool(-1) {
+		if DBG_ERR {
+			fmt.Println("Witness script did not leave a single TRUE on the stack")
+		}
+		return false
+	}
 	return true
 }
 
+// Returns the data serialized as the shortest push operation
+func PushData(d []byte) []byte {
+	bb := new(bytes.Buffer)
+	if len(d) < btc.OP_PUSHDATA1 {
+		bb.WriteByte(byte(len(d)))
+	} else if len(d) <= 0xff {
+		bb.WriteByte(btc.OP_PUSHDATA1)
+		bb.WriteByte(byte(len(d)))
+	} else if len(d) <= 0xffff {
+		bb.WriteByte(btc.OP_PUSHDATA2)
+		binary.Write(bb, binary.LittleEndian, uint16(len(d)))
+	} else {
+		bb.WriteByte(btc.OP_PUSHDATA4)
+		binary.Write(bb, binary.LittleEndian, uint32(len(d)))
+	}
+	bb.Write(d)
+	return bb.Bytes()
+}
+
 func b2i(b bool) int64 {
 	if b {
 		return 1
@@ -136,12 +326,12 @@ func b2i(b bool) int64 {
 	}
 }
 
-func evalScript(p []byte, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32) bool {
+func evalScript(p []byte, amount uint64, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32, sigver int) bool {
 	if DBG_SCR {
 		fmt.Println("script len", len(p))
 	}
 
-	if len(p) > 10000 {
+	if len(p) > btc.MAX_SCRIPT_SIZE {
 		if DBG_ERR {
 			fmt.Println("script too long", len(p))
 		}
@@ -764,7 +954,12 @@ func evalScript(p []byte, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32
 				}
 
 				if len(si) > 0 {
-					sh := tx.SignatureHash(delSig(p[sta:], si), inp, int32(si[len(si)-1]))
+					var sh []byte
+					if sigver == SIGVER_WITNESS_V0 {
+						sh = tx.WitnessSigHash(p[sta:], inp, amount, int32(si[len(si)-1]))
+					} else {
+						sh = tx.SignatureHash(delSig(p[sta:], si), inp, int32(si[len(si)-1]))
+					}
 					ok = btc.EcdsaVerify(pk, si, sh)
 				}
 				if !ok && DBG_ERR {
@@ -831,8 +1026,11 @@ func evalScript(p []byte, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32
 				}
 
 				xxx := p[sta:]
-				for k := 0; k < int(sigscnt); k++ {
-					xxx = delSig(xxx, stack.top(-isig-k))
+				if sigver == SIGVER_BASE {
+					// Signatures are not removed from the witness scripts
+					for k := 0; k < int(sigscnt); k++ {
+						xxx = delSig(xxx, stack.top(-isig-k))
+					}
 				}
 
 				success := true
@@ -849,7 +1047,12 @@ func evalScript(p []byte, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32
 					}
 
 					if len(si) > 0 {
-						sh := tx.SignatureHash(xxx, inp, int32(si[len(si)-1]))
+						var sh []byte
+						if sigver == SIGVER_WITNESS_V0 {
+							sh = tx.WitnessSigHash(xxx, inp, amount, int32(si[len(si)-1]))
+						} else {
+							sh = tx.SignatureHash(xxx, inp, int32(si[len(si)-1]))
+						}
 						if btc.EcdsaVerify(pk, si, sh) {
 							isig++
 							sigscnt--
@@ -878,6 +1081,49 @@ func evalScript(p []byte, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32
 					stack.pushBool(success)
 				}
 
+			case opcode == 0xb1: //OP_CHECKLOCKTIMEVERIFY (former OP_NOP2)
+				if (ver_flags & VER_CLTV) == 0 {
+					break // without BIP-65 it is still a NOP
+				}
+				if stack.size() < 1 {
+					if DBG_ERR {
+						fmt.Println("Stack too short for opcode", opcode)
+					}
+					return false
+				}
+				// The lock time is 5 bytes long, to avoid year 2038 issue
+				if !CheckLockTime(stack.topIntExt(-1, 5), tx, inp) {
+					if DBG_ERR {
+						fmt.Println("OP_CHECKLOCKTIMEVERIFY failed")
+					}
+					return false
+				}
+
+			case opcode == 0xb2: //OP_CHECKSEQUENCEVERIFY (former OP_NOP3)
+				if (ver_flags & VER_CSV) == 0 {
+					break // without BIP-112 it is still a NOP
+				}
+				if stack.size() < 1 {
+					if DBG_ERR {
+						fmt.Println("Stack too short for opcode", opcode)
+					}
+					return false
+				}
+				seq := stack.topIntExt(-1, 5)
+				if seq < 0 {
+					if DBG_ERR {
+						fmt.Println("OP_CHECKSEQUENCEVERIFY: negative sequence")
+					}
+					return false
+				}
+				// With the disable flag set, the opcode behaves as a NOP
+				if (seq&btc.SEQUENCE_LOCKTIME_DISABLE_FLAG) == 0 && !CheckSequence(seq, tx, inp) {
+					if DBG_ERR {
+						fmt.Println("OP_CHECKSEQUENCEVERIFY failed")
+					}
+					return false
+				}
+
 			case opcode >= 0xb0 && opcode <= 0xb9: //OP_NOP
 				// just do nothing
 
@@ -920,21 +1166,7 @@ func evalScript(p []byte, stack *scrStack, tx *btc.Tx, inp int, ver_flags uint32
 
 func delSig(where, sig []byte) (res []byte) {
 	// recover the standard length
-	bb := new(bytes.Buffer)
-	if len(sig) < btc.OP_PUSHDATA1 {
-		bb.Write([]byte{byte(len(sig))})
-	} else if len(sig) <= 0xff {
-		bb.Write([]byte{btc.OP_PUSHDATA1})
-		bb.Write([]byte{byte(len(sig))})
-	} else if len(sig) <= 0xffff {
-		bb.Write([]byte{btc.OP_PUSHDATA2})
-		binary.Write(bb, binary.LittleEndian, uint16(len(sig)))
-	} else {
-		bb.Write([]byte{btc.OP_PUSHDATA4})
-		binary.Write(bb, binary.LittleEndian, uint32(len(sig)))
-	}
-	bb.Write(sig)
-	sig = bb.Bytes()
+	sig = PushData(sig)
 	var idx int
 	for idx < len(where) {
 		_, _, n, e := btc.GetOpcode(where[idx:])
@@ -1059,3 +1291,62 @@ func CheckSignatureEncoding(sig []byte, flags uint32) bool {
 	}
 	return true
 }
+
+// Checks the lock time of the given input against the value from the stack (BIP-65)
+func CheckLockTime(locktime int64, tx *btc.Tx, inp int) bool {
+	// Negative locktime is not allowed
+	if locktime < 0 {
+		return false
+	}
+
+	// Both lock times must be of the same type: either block height or timestamp
+	if !((tx.Lock_time < btc.LOCKTIME_THRESHOLD && locktime < btc.LOCKTIME_THRESHOLD) ||
+		(tx.Lock_time >= btc.LOCKTIME_THRESHOLD && locktime >= btc.LOCKTIME_THRESHOLD)) {
+		return false
+	}
+
+	// The transaction's lock time must have already passed
+	if locktime > int64(tx.Lock_time) {
+		return false
+	}
+
+	// The input must not be final, otherwise the tx's lock time would be ignored
+	if tx.TxIn[inp].Sequence == 0xffffffff {
+		return false
+	}
+
+	return true
+}
+
+// Checks the relative lock time of the given input against the value from the stack (BIP-112)
+func CheckSequence(seq int64, tx *btc.Tx, inp int) bool {
+	txseq := int64(tx.TxIn[inp].Sequence)
+
+	// Relative lock times are supported only by transactions version 2 or higher
+	if tx.Version < 2 {
+		return false
+	}
+
+	// The input's relative lock time must not be disabled
+	if (txseq & btc.SEQUENCE_LOCKTIME_DISABLE_FLAG) != 0 {
+		return false
+	}
+
+	// Only compare the type flag and the lock time value
+	const mask = btc.SEQUENCE_LOCKTIME_TYPE_FLAG | btc.SEQUENCE_LOCKTIME_MASK
+	txseq &= mask
+	seq &= mask
+
+	// Both values must be of the same type: either block height or time
+	if !((txseq < btc.SEQUENCE_LOCKTIME_TYPE_FLAG && seq < btc.SEQUENCE_LOCKTIME_TYPE_FLAG) ||
+		(txseq >= btc.SEQUENCE_LOCKTIME_TYPE_FLAG && seq >= btc.SEQUENCE_LOCKTIME_TYPE_FLAG)) {
+		return false
+	}
+
+	// The input's relative lock time must be at least the one from the stack
+	if seq > txseq {
+		return false
+	}
+
+	return true
+}
@@ -47,7 +47,7 @@ func TestScritpsValid(t *testing.T) {
 				continue
 			}
 
-			res := VerifyTxScript(s1, s2, 0, mk_out_tx(s1, s2), flags)
+			res := VerifyTxScript(s1, s2, 0, 0, mk_out_tx(s1, s2), flags)
 			if !res {
 				t.Error(tot, "VerifyTxScript failed in", vecs[i][0], "->", vecs[i][1], "/", vecs[i][2])
 				return
@@ -93,7 +93,7 @@ func TestScritpsInvalid(t *testing.T) {
 				continue
 			}
 
-			res := VerifyTxScript(s1, s2, 0, mk_out_tx(s1, s2), flags)
+			res := VerifyTxScript(s1, s2, 0, 0, mk_out_tx(s1, s2), flags)
 			if res {
 				t.Error(tot, "VerifyTxScript NOT failed in", vecs[i][0], "->", vecs[i][1], "/", vecs[i][2], "/", vecs[i][3])
 				return
@@ -113,6 +113,16 @@ func decode_flags(s string) (fl uint32, e error) {
 			fl |= VER_P2SH
 		case "DERSIG":
 			fl |= VER_DERSIG
+		case "CHECKLOCKTIMEVERIFY":
+			fl |= VER_CLTV
+		case "CHECKSEQUENCEVERIFY":
+			fl |= VER_CSV
+		case "CLEANSTACK":
+			fl |= VER_CLEANSTACK
+		case "WITNESS":
+			fl |= VER_WITNESS
+		case "DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM":
+			fl |= VER_WITNESS_UPGRADABLE
 		default:
 			e = errors.New("Unsupported flag " + ss[i])
 			return
@@ -139,3 +149,49 @@ func mk_out_tx(sig_scr, pk_scr []byte) (output_tx *btc.Tx) {
 
 	return
 }
+
+func TestCheckSequence(t *testing.T) {
+	DBG_ERR = false
+	var vecs = []struct {
+		txver  uint32
+		txseq  uint32
+		stack  string
+		result bool
+	}{
+		{2, 10, "10", true},
+		{2, 10, "11", false},
+		{2, 10, "0", true},
+		{1, 10, "10", false},                          // tx version too low
+		{2, 0xffffffff, "10", false},                  // input's lock time disabled
+		{2, 0x00400000 | 10, "10", false},             // time based vs height based
+		{2, 0x00400000 | 10, "0x04 0x0a004000", true}, // time based
+		{2, 10, "0x05 0x0000008000", true},            // disable flag set on the stack
+		{2, 10, "-1", false},                          // negative value
+	}
+
+	for i := range vecs {
+		s1, e := btc.DecodeScript(vecs[i].stack)
+		if e != nil {
+			t.Fatal(i, e.Error())
+		}
+		s2, _ := btc.DecodeScript("NOP3 1")
+		tx := mk_out_tx(s1, s2)
+		tx.Version = vecs[i].txver
+		tx.TxIn[0].Sequence = vecs[i].txseq
+		if res := VerifyTxScript(s1, s2, 0, 0, tx, VER_CSV); res != vecs[i].result {
+			t.Error(i, "VerifyTxScript returned", res)
+		}
+	}
+}
+
+// The chain params set the deployments' flags by value (lib/btc cannot import this package)
+func TestDeploymentFlags(t *testing.T) {
+	exp := map[string]uint32{"csv": VER_CSV, "segwit": VER_WITNESS}
+	for _, p := range []*btc.ChainParams{&btc.MainNetParams, &btc.TestNet3Params} {
+		for _, d := range p.Deployments {
+			if d.VerifyFlags != exp[d.Name] {
+				t.Error(p.Name, d.Name, "has wrong VerifyFlags", d.VerifyFlags)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package script
+
+import (
+	"github.com/wchh/gocoin/lib/btc"
+)
+
+const MAX_PUBKEYS_PER_MULTISIG = 20
+
+// Returns number of signature operations in the script.
+// With accurate set, the number of keys preceding CHECKMULTISIG
+// is taken from the script, otherwise it always counts as 20.
+func GetSigOpCount(scr []byte, accurate bool) (n int) {
+	lastop := 0xff
+	for idx := 0; idx < len(scr); {
+		op, _, le, e := btc.GetOpcode(scr[idx:])
+		if e != nil {
+			break
+		}
+		idx += le
+		switch op {
+		case 0xac, 0xad: // OP_CHECKSIG, OP_CHECKSIGVERIFY
+			n++
+		case 0xae, 0xaf: // OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY
+			if accurate && lastop >= btc.OP_1 && lastop <= btc.OP_16 {
+				n += lastop - btc.OP_1 + 1
+			} else {
+				n += MAX_PUBKEYS_PER_MULTISIG
+			}
+		}
+		lastop = op
+	}
+	return
+}
+
+// Returns the last data pushed by the script, or nil if it is not push only
+func lastPush(scr []byte) (res []byte) {
+	for idx := 0; idx < len(scr); {
+		op, pv, le, e := btc.GetOpcode(scr[idx:])
+		if e != nil || op > btc.OP_16 {
+			return nil
+		}
+		idx += le
+		res = pv
+	}
+	return
+}
+
+// Returns number of signature operations in the redeem script of a P2SH input
+func GetP2SHSigOpCount(sigScr, pkScr []byte) int {
+	if !btc.IsPayToScript(pkScr) {
+		return 0
+	}
+	return GetSigOpCount(lastPush(sigScr), true)
+}
+
+func witnessSigOps(witver int, prog []byte, witness [][]byte) int {
+	if witver == 0 {
+		if len(prog) == 20 {
+			return 1
+		}
+		if len(prog) == 32 && len(witness) > 0 {
+			return GetSigOpCount(witness[len(witness)-1], true)
+		}
+	}
+	// Future witness versions may define their own rules
+	return 0
+}
+
+// Returns number of signature operations of a witness input (bare or nested in P2SH)
+func GetWitnessSigOpCount(sigScr, pkScr []byte, witness [][]byte, ver_flags uint32) int {
+	if (ver_flags & VER_WITNESS) == 0 {
+		return 0
+	}
+	if witver, witprog := btc.IsWitnessProgram(pkScr); witprog != nil {
+		return witnessSigOps(witver, witprog, witness)
+	}
+	if btc.IsPayToScript(pkScr) {
+		if witver, witprog := btc.IsWitnessProgram(lastPush(sigScr)); witprog != nil {
+			return witnessSigOps(witver, witprog, witness)
+		}
+	}
+	return 0
+}
+
+// Returns the legacy (not P2SH aware) number of signature operations in the transaction
+func GetLegacySigOpCount(tx *btc.Tx) (n int) {
+	for i := range tx.TxIn {
+		n += GetSigOpCount(tx.TxIn[i].ScriptSig, false)
+	}
+	for i := range tx.TxOut {
+		n += GetSigOpCount(tx.TxOut[i].Pk_script, false)
+	}
+	return
+}
+
+// Returns the signature operations cost of the transaction (BIP-141).
+// Legacy and P2SH sigops count WITNESS_SCALE_FACTOR times the witness ones.
+// prevouts are the outputs spent by the inputs (ignored for a coinbase).
+func GetSigOpCost(tx *btc.Tx, prevouts []*btc.TxOut, ver_flags uint32) (n int) {
+	n = GetLegacySigOpCount(tx) * btc.WITNESS_SCALE_FACTOR
+	if tx.IsCoinBase() {
+		return
+	}
+	for i := range tx.TxIn {
+		if (ver_flags & VER_P2SH) != 0 {
+			n += GetP2SHSigOpCount(tx.TxIn[i].ScriptSig, prevouts[i].Pk_script) * btc.WITNESS_SCALE_FACTOR
+		}
+		n += GetWitnessSigOpCount(tx.TxIn[i].ScriptSig, prevouts[i].Pk_script, tx.TxIn[i].Witness, ver_flags)
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package script
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSigOpCount(t *testing.T) {
+	var ta = []struct {
+		scr      string
+		legacy   int
+		accurate int
+	}{
+		{"76a914751e76e8199196d454941c45d1b3a323f1433bd688ac", 1, 1}, // P2PKH
+		{"a914751e76e8199196d454941c45d1b3a323f1433bd687", 0, 0},     // P2SH
+		{"52210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" +
+			"210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f8179852ae", 20, 2}, // 2-of-2
+		{"00ae", 20, 20},   // CHECKMULTISIG without a key count
+		{"ad60af", 21, 17}, // CHECKSIGVERIFY, 16 CHECKMULTISIGVERIFY
+		{"ac4c", 1, 1},     // truncated push stops the counting
+	}
+	for i := range ta {
+		scr, _ := hex.DecodeString(ta[i].scr)
+		if n := GetSigOpCount(scr, false); n != ta[i].legacy {
+			t.Error(i, "legacy count", n, "expected", ta[i].legacy)
+		}
+		if n := GetSigOpCount(scr, true); n != ta[i].accurate {
+			t.Error(i, "accurate count", n, "expected", ta[i].accurate)
+		}
+	}
+
+	// P2SH input with a 2-of-2 multisig redeem script
+	redeem, _ := hex.DecodeString(ta[2].scr)
+	sigscr := append([]byte{0x00}, PushData(redeem)...)
+	p2sh, _ := hex.DecodeString(ta[1].scr)
+	if n := GetP2SHSigOpCount(sigscr, p2sh); n != 2 {
+		t.Error("P2SH count", n)
+	}
+	if n := GetP2SHSigOpCount(sigscr, redeem); n != 0 {
+		t.Error("P2SH count for non-P2SH output", n)
+	}
+
+	// Witness: P2WPKH counts as one, P2WSH counts the witness script
+	p2wpkh, _ := hex.DecodeString("0014751e76e8199196d454941c45d1b3a323f1433bd6")
+	if n := GetWitnessSigOpCount(nil, p2wpkh, nil, VER_WITNESS); n != 1 {
+		t.Error("P2WPKH count", n)
+	}
+	if n := GetWitnessSigOpCount(nil, p2wpkh, nil, 0); n != 0 {
+		t.Error("P2WPKH count without VER_WITNESS", n)
+	}
+	p2wsh, _ := hex.DecodeString("00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262")
+	if n := GetWitnessSigOpCount(nil, p2wsh, [][]byte{nil, redeem}, VER_WITNESS); n != 2 {
+		t.Error("P2WSH count", n)
+	}
+	if n := GetWitnessSigOpCount(PushData(p2wpkh), p2sh, nil, VER_WITNESS); n != 1 {
+		t.Error("P2SH-P2WPKH count", n)
+	}
+}
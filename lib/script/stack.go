@@ -54,7 +54,12 @@ func (s *scrStack) pushInt(val int64) {
 
 
 func bts2int(d []byte) (res int64) {
-	if len(d) > nMaxNumSize {
+	return bts2int_ext(d, nMaxNumSize)
+}
+
+
+func bts2int_ext(d []byte, max_bytes int) (res int64) {
+	if len(d) > max_bytes {
 		panic("Int on the stack is too long")
 		// Make sure this panic is captured in evalScript (cause the script to fail, not crash)
 	}
@@ -109,6 +114,10 @@ func (s *scrStack) topInt(idx int) int64 {
 	return bts2int(s.data[len(s.data)+idx])
 }
 
+func (s *scrStack) topIntExt(idx int, max_bytes int) int64 {
+	return bts2int_ext(s.data[len(s.data)+idx], max_bytes)
+}
+
 func (s *scrStack) topBool(idx int) bool {
 	return bts2bool(s.data[len(s.data)+idx])
 }
@@ -132,6 +141,10 @@ func (s *scrStack) nofalse() bool {
 	return true
 }
 
+func (s *scrStack) resize(siz int) {
+	s.data = s.data[:siz]
+}
+
 func (s *scrStack) size() int {
 	return len(s.data)
 }
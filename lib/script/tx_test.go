@@ -2,6 +2,7 @@ package script
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -11,9 +12,10 @@ import (
 )
 
 type oneinp struct {
-	txid  *btc.Uint256
-	vout  int
-	pkscr string
+	txid   *btc.Uint256
+	vout   int
+	pkscr  string
+	amount uint64 // optional, used by witness programs
 }
 
 type testvector struct {
@@ -41,8 +43,11 @@ func parserec(vv []interface{}) (ret *testvector) {
 		switch uu := u.(type) {
 		case []interface{}:
 			txid := btc.NewUint256FromString(uu[0].(string))
-			ret.inps = append(ret.inps, oneinp{txid: txid,
-				vout: int(uu[1].(float64)), pkscr: uu[2].(string)})
+			inp := oneinp{txid: txid, vout: int(uu[1].(float64)), pkscr: uu[2].(string)}
+			if len(uu) > 3 {
+				inp.amount = uint64(uu[3].(float64))
+			}
+			ret.inps = append(ret.inps, inp)
 		default:
 			fmt.Printf(" - %d is of a type %T\n", i, uu)
 		}
@@ -72,15 +77,9 @@ func skip_broken_tests(tx *btc.Tx) bool {
 		}
 	}
 
-	// Duplicate inputs
-	if len(tx.TxIn) > 1 {
-		for i := 0; i < len(tx.TxIn)-1; i++ {
-			for j := i + 1; j < len(tx.TxIn); j++ {
-				if tx.TxIn[i].Input == tx.TxIn[j].Input {
-					return true
-				}
-			}
-		}
+	// Duplicate inputs, null prevouts and such
+	if tx.CheckTransaction() != nil {
+		return true
 	}
 
 	// Coinbase of w wrong size
@@ -108,7 +107,10 @@ func execute_test_tx(t *testing.T, tv *testvector) bool {
 	}
 	tx, _ := btc.NewTx(rd)
 	if tx == nil {
-		t.Error("Canot decode tx")
+		// A tx with no inputs cannot be decoded, as it looks like having BIP-144 marker
+		if len(rd) < 5 || rd[4] != 0 {
+			t.Error("Canot decode tx")
+		}
 		return false
 	}
 	tx.Size = uint32(len(rd))
@@ -142,7 +144,7 @@ func execute_test_tx(t *testing.T, tv *testvector) bool {
 		if tv.inps[j].vout >= 0 {
 			ss = tx.TxIn[i].ScriptSig
 		}
-		if VerifyTxScript(ss, pk, i, tx, tv.ver_flags) {
+		if VerifyTxScript(ss, pk, tv.inps[j].amount, i, tx, tv.ver_flags) {
 			oks++
 		}
 	}
@@ -256,3 +258,53 @@ func TestSighash(t *testing.T) {
 		}
 	}
 }
+
+func TestWitnessTx(t *testing.T) {
+	DBG_ERR = false
+	// Native P2WPKH example from BIP-143
+	rd, _ := hex.DecodeString("01000000000102fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f00000000494830450221008b9d1dc26ba6a9cb62127b02742fa9d754cd3bebf337f7a55d114c8e5cdd30be022040529b194ba3f9281a99f2b1c0a19c0489bc22ede944ccf4ecbab4cc618ef3ed01eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac000247304402203609e17b84f6a7d30c80bfa610b5b4542f32a8a0d5447a12fb1366d7f01cc44a0220573a954c4518331561406f90300e8f3358f51928d43c212a8caed02de67eebee0121025476c2e83188368da1ff3e292e7acafcdb3566bb0ad253f62fc70f07aeee635711000000")
+	tx, _ := btc.NewTx(rd)
+	if tx == nil {
+		t.Fatal("Cannot decode tx")
+	}
+	tx.SetHash(rd)
+	pk0, _ := hex.DecodeString("2103c9f4836b9a4f77fc0d81f7bcb01b7f1b35916864b9476c241ce9fc198bd25432ac")
+	pk1, _ := hex.DecodeString("00141d0f172a0ecb48aee1be1f2687d2963ae33f71a1")
+	const flags = VER_P2SH | VER_WITNESS
+
+	if !VerifyTxScript(tx.TxIn[0].ScriptSig, pk0, 625000000, 0, tx, flags) {
+		t.Error("Legacy input failed")
+	}
+	if !VerifyTxScript(tx.TxIn[1].ScriptSig, pk1, 600000000, 1, tx, flags) {
+		t.Error("P2WPKH input failed")
+	}
+	if VerifyTxScript(tx.TxIn[1].ScriptSig, pk1, 600000001, 1, tx, flags) {
+		t.Error("P2WPKH input with a wrong amount did not fail")
+	}
+	if VerifyTxScript([]byte{0x51}, pk1, 600000000, 1, tx, flags) {
+		t.Error("P2WPKH input with non-empty sigScript did not fail")
+	}
+	if !VerifyTxScript(tx.TxIn[1].ScriptSig, pk1, 600000001, 1, tx, VER_P2SH) {
+		t.Error("Witness program should be anyone-can-spend without VER_WITNESS")
+	}
+
+	// Witness on a legacy input is not allowed
+	tx.TxIn[0].Witness = tx.TxIn[1].Witness
+	if VerifyTxScript(tx.TxIn[0].ScriptSig, pk0, 625000000, 0, tx, flags) {
+		t.Error("Unexpected witness did not fail")
+	}
+	tx.TxIn[0].Witness = nil
+
+	// CLEANSTACK requires P2SH
+	if VerifyTxScript(tx.TxIn[0].ScriptSig, pk0, 625000000, 0, tx, VER_CLEANSTACK) {
+		t.Error("VER_CLEANSTACK without VER_P2SH did not fail")
+	}
+
+	// P2WSH script must not be longer than MAX_SCRIPT_SIZE
+	scr := bytes.Repeat([]byte{0x51}, btc.MAX_SCRIPT_SIZE+1)
+	h := sha256.Sum256(scr)
+	tx.TxIn[1].Witness = [][]byte{scr}
+	if VerifyTxScript(nil, append([]byte{0x00, 0x20}, h[:]...), 600000000, 1, tx, flags) {
+		t.Error("Too long P2WSH script did not fail")
+	}
+}
@@ -41,7 +41,7 @@ func walk(ch *chain.Chain, hash, hdr []byte, height, blen, txs uint32) {
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Specify a path to folder containig blockchain.dat and blockchain.new")
+		fmt.Println("Specify a path to folder containig the blocks database (with the \"blocks\" subfolder)")
 		fmt.Println("Output bootstrap.dat file will be written in the current folder.")
 		return
 	}
@@ -179,7 +179,7 @@ func main() {
 				pkscr, _ := hex.DecodeString(r.Unspent_outputs[i].Script)
 				b58adr := "???"
 				if pkscr != nil {
-					ba := btc.NewAddrFromPkScript(pkscr, false)
+					ba := btc.NewAddrFromPkScript(pkscr, &btc.MainNetParams)
 					if ba != nil {
 						b58adr = ba.String()
 					}
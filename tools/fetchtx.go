@@ -14,11 +14,21 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fmt.Println("Specify transaction id on the command line (MSB).")
+		fmt.Println("Optionally followed by WebUI address of your node, to ask it first (default 127.0.0.1:8833).")
 		return
 	}
 
 	txid := btc.NewUint256FromString(os.Args[1])
-	rawtx := utils.GetTxFromWeb(txid)
+	node := "127.0.0.1:8833"
+	if len(os.Args) > 2 {
+		node = os.Args[2]
+	}
+	rawtx := utils.GetTxFromNode(node, txid)
+	if rawtx != nil {
+		println("GetTxFromNode - OK")
+	} else {
+		rawtx = utils.GetTxFromWeb(txid)
+	}
 	if rawtx == nil {
 		fmt.Println("Error fetching the transaction")
 	} else {
@@ -14,10 +14,9 @@ import (
 const Trust = true // Set this to false if you want to re-check all scripts
 
 var (
-	Magic         [4]byte
 	GocoinHomeDir string
 	BtcRootDir    string
-	GenesisBlock  *btc.Uint256
+	Params        *btc.ChainParams
 )
 
 func stat(totnsec, pernsec int64, totbytes, perbytes uint64, height uint32) {
@@ -33,8 +32,8 @@ func stat(totnsec, pernsec int64, totbytes, perbytes uint64, height uint32) {
 }
 
 func import_blockchain(dir string) {
-	BlockDatabase := blockdb.NewBlockDB(dir, Magic)
-	chain := chain.NewChain(GocoinHomeDir, GenesisBlock, false)
+	BlockDatabase := blockdb.NewBlockDB(dir, Params.Magic)
+	chain := chain.NewChain(GocoinHomeDir, Params, false)
 
 	var bl *btc.Block
 	var er error
@@ -129,7 +128,8 @@ func main() {
 		println(e.Error())
 		os.Exit(1)
 	}
-	_, e = f.Read(Magic[:])
+	var magic [4]byte
+	_, e = f.Read(magic[:])
 	f.Close()
 	if e != nil {
 		println(e.Error())
@@ -142,28 +142,29 @@ func main() {
 		GocoinHomeDir = sys.BitcoinHome() + "gocoin" + string(os.PathSeparator)
 	}
 
-	if Magic == [4]byte{0x0B, 0x11, 0x09, 0x07} {
-		// testnet3
-		fmt.Println("There are Testnet3 blocks")
-		GenesisBlock = btc.NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
-		GocoinHomeDir += "tstnet" + string(os.PathSeparator)
-	} else if Magic == [4]byte{0xF9, 0xBE, 0xB4, 0xD9} {
-		fmt.Println("There are valid Bitcoin blocks")
-		GenesisBlock = btc.NewUint256FromString("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
-		GocoinHomeDir += "btcnet" + string(os.PathSeparator)
-	} else {
+	for _, p := range btc.AllChainParams {
+		if p.Magic == magic {
+			Params = p
+			break
+		}
+	}
+	if Params == nil {
 		println("blk00000.dat has an unexpected magic")
 		os.Exit(1)
 	}
+	fmt.Println("There are", Params.Name, "blocks")
+	GocoinHomeDir += Params.DataSubdir + string(os.PathSeparator)
 
 	fmt.Println("Importing blockchain data into", GocoinHomeDir, "...")
 
-	if exists(GocoinHomeDir+"blockchain.dat") ||
+	if exists(GocoinHomeDir+"blocks") ||
+		exists(GocoinHomeDir+"blockchain.dat") ||
 		exists(GocoinHomeDir+"blockchain.idx") ||
 		exists(GocoinHomeDir+"unspent") {
 		println("Destination folder contains some database files.")
 		println("Either move them somewhere else or delete manually.")
 		println("None of the following files/folders must exist before you proceed:")
+		println(" *", GocoinHomeDir+"blocks")
 		println(" *", GocoinHomeDir+"blockchain.dat")
 		println(" *", GocoinHomeDir+"blockchain.idx")
 		println(" *", GocoinHomeDir+"unspent")
@@ -29,7 +29,7 @@ func make_p2sh() {
 		return
 	}
 
-	fmt.Println("The P2SH data points to address", ms.BtcAddr(testnet).String())
+	fmt.Println("The P2SH data points to address", ms.BtcAddr(btc.GetChainParams(testnet)).String())
 
 	sd := ms.Bytes()
 
@@ -77,7 +77,7 @@ func sign_tx(tx *btc.Tx) (all_signed bool) {
 
 func write_tx_file(tx *btc.Tx) {
 	signedrawtx := tx.Serialize()
-	tx.Hash = btc.NewSha2Hash(signedrawtx)
+	tx.SetHash(signedrawtx)
 
 	hs := tx.Hash.String()
 	fmt.Println("TxID", hs)
@@ -128,7 +128,7 @@ func make_signed_tx() {
 
 	// Build transaction outputs:
 	for o := range sendTo {
-		outs, er := btc.NewSpendOutputs(sendTo[o].addr, sendTo[o].amount, testnet)
+		outs, er := btc.NewSpendOutputs(sendTo[o].addr, sendTo[o].amount, btc.GetChainParams(testnet))
 		if er != nil {
 			fmt.Println("ERROR:", er.Error())
 			cleanExit(1)
@@ -142,7 +142,7 @@ func make_signed_tx() {
 		if *verbose {
 			fmt.Println("Sending change", changeBtc, "to", chad.String())
 		}
-		outs, er := btc.NewSpendOutputs(chad, changeBtc, testnet)
+		outs, er := btc.NewSpendOutputs(chad, changeBtc, btc.GetChainParams(testnet))
 		if er != nil {
 			fmt.Println("ERROR:", er.Error())
 			cleanExit(1)
@@ -139,7 +139,7 @@ func raw_tx_from_file(fn string) *btc.Tx {
 	}
 	tx, txle := btc.NewTx(dat)
 	if tx != nil {
-		tx.Hash = btc.NewSha2Hash(dat)
+		tx.SetHash(dat)
 		if txle != len(dat) {
 			fmt.Println("WARNING: Raw transaction length mismatch", txle, len(dat))
 		}
@@ -155,16 +155,18 @@ func tx_from_balance(txid *btc.Uint256, error_is_fatal bool) (tx *btc.Tx) {
 	fn := "balance/" + txid.String() + ".tx"
 	buf, er := ioutil.ReadFile(fn)
 	if er == nil && buf != nil {
-		var th [32]byte
-		btc.ShaHash(buf, th[:])
-		if txid.Hash == th {
-			tx, _ = btc.NewTx(buf)
-			if error_is_fatal && tx == nil {
-				println("Transaction is corrupt:", txid.String())
-				cleanExit(1)
+		tx, _ = btc.NewTx(buf)
+		if tx != nil {
+			tx.SetHash(buf)
+			if !tx.Hash.Equal(txid) {
+				tx = nil
+				if error_is_fatal {
+					println("Transaction file is corrupt:", txid.String())
+					cleanExit(1)
+				}
 			}
 		} else if error_is_fatal {
-			println("Transaction file is corrupt:", txid.String())
+			println("Transaction is corrupt:", txid.String())
 			cleanExit(1)
 		}
 	} else if error_is_fatal {
@@ -216,12 +218,19 @@ func addr_from_pkscr(scr []byte) *btc.BtcAddr {
 	if litecoin {
 		return ltc.NewAddrFromPkScript(scr, testnet)
 	} else {
-		return btc.NewAddrFromPkScript(scr, testnet)
+		return btc.NewAddrFromPkScript(scr, btc.GetChainParams(testnet))
 	}
 }
 
 // make sure the version byte in the given address is what we expect
 func assert_address_version(a *btc.BtcAddr) {
+	if a.SegwitProg != nil {
+		if a.SegwitProg.HRP != btc.SegwitHRP(testnet) {
+			println("Sending address", a.String(), "has an incorrect prefix", a.SegwitProg.HRP)
+			cleanExit(1)
+		}
+		return
+	}
 	if a.Version != ver_pubkey() && a.Version != ver_script() && a.Version != ver_stealth() {
 		println("Sending address", a.String(), "has an incorrect version", a.Version)
 		cleanExit(1)
@@ -111,7 +111,7 @@ func make_wallet() {
 		}
 	} else if waltype == 4 {
 		lab = "TypHD"
-		hdwal = btc.MasterKey(pass, testnet)
+		hdwal = btc.MasterKey(pass, btc.GetChainParams(testnet))
 		sys.ClearBuffer(pass)
 	} else {
 		sys.ClearBuffer(pass)